@@ -1,5 +1,7 @@
 package api
 
+import "encoding/json"
+
 //===========================================================================
 // Top Level Requests and Responses
 //===========================================================================
@@ -17,3 +19,259 @@ type StatusReply struct {
 	Version string `json:"version,omitempty"`
 	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
 }
+
+//===========================================================================
+// Users and Credentials
+//===========================================================================
+
+// User is a registered user along with the credentials they have registered.
+type User struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Email       string        `json:"email"`
+	Credentials []*Credential `json:"credentials"`
+}
+
+// UserUpdate changes the email address and/or display name of a user; fields that are
+// empty are not modified.
+type UserUpdate struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// UserList is returned when listing all registered users.
+type UserList struct {
+	Users []*User `json:"users"`
+}
+
+// Credential describes a registered authenticator without its public key. Timestamps
+// are RFC3339 formatted; LastUsed is omitted if the credential has never been used.
+// ResidentKey is only meaningful if CredProps is true, e.g. the client reported it.
+type Credential struct {
+	ID              string   `json:"id"`
+	Nickname        string   `json:"nickname"`
+	Authenticator   string   `json:"authenticator"`
+	AAGUID          string   `json:"aaguid"`
+	AttestationType string   `json:"attestation_type"`
+	Transports      []string `json:"transports"`
+	Attachment      string   `json:"attachment,omitempty"`
+	SignCount       uint32   `json:"sign_count"`
+	CloneWarning    bool     `json:"clone_warning"`
+	UserPresent     bool     `json:"user_present"`
+	UserVerified    bool     `json:"user_verified"`
+	BackupEligible  bool     `json:"backup_eligible"`
+	BackupState     bool     `json:"backup_state"`
+	Created         string   `json:"created"`
+	LastUsed        string   `json:"last_used,omitempty"`
+	ClientIP        string   `json:"client_ip,omitempty"`
+	UserAgent       string   `json:"user_agent,omitempty"`
+	Revoked         string   `json:"revoked,omitempty"`
+	Reason          string   `json:"reason,omitempty"`
+
+	AttestationFormat   string `json:"attestation_format,omitempty"`
+	AttestationVerified bool   `json:"attestation_verified"`
+	MetadataStatus      string `json:"metadata_status,omitempty"`
+	Algorithm           string `json:"algorithm,omitempty"`
+	CredProps           bool   `json:"cred_props"`
+	ResidentKey         bool   `json:"resident_key"`
+	CredProtect         string `json:"cred_protect,omitempty"`
+	PRF                 bool   `json:"prf"`
+	LargeBlob           bool   `json:"large_blob"`
+}
+
+// CredentialRevoke specifies why a credential is being revoked.
+type CredentialRevoke struct {
+	Reason string `json:"reason"`
+}
+
+// CredentialList is returned when listing the credentials of a user.
+type CredentialList struct {
+	Credentials []*Credential `json:"credentials"`
+}
+
+// CredentialUpdate contains the user-editable fields of a credential.
+type CredentialUpdate struct {
+	Nickname string `json:"nickname"`
+}
+
+//===========================================================================
+// Authenticated Sessions
+//===========================================================================
+
+// Session describes the login session of the current user.
+type Session struct {
+	UserID       string `json:"user_id"`
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	CredentialID string `json:"credential_id"`
+	UserVerified bool   `json:"user_verified"`
+	AuthTime     string `json:"auth_time"`
+	Expires      string `json:"expires"`
+}
+
+// ActiveSession is a login session of a user that has not expired or been revoked.
+type ActiveSession struct {
+	ID           string `json:"id"`
+	CredentialID string `json:"credential_id"`
+	Nickname     string `json:"nickname,omitempty"`
+	UserVerified bool   `json:"user_verified"`
+	ClientIP     string `json:"client_ip"`
+	UserAgent    string `json:"user_agent"`
+	Created      string `json:"created"`
+	LastSeen     string `json:"last_seen"`
+	Expires      string `json:"expires"`
+	Current      bool   `json:"current"`
+}
+
+// ActiveSessionList contains the active login sessions of a user.
+type ActiveSessionList struct {
+	Sessions []*ActiveSession `json:"sessions"`
+}
+
+//===========================================================================
+// Access and Refresh Tokens
+//===========================================================================
+
+// Tokens are returned with a successful login if token issuance is enabled. The access
+// token is a signed JWT that can be verified with the keys published at
+// /.well-known/jwks.json; ExpiresIn is the number of seconds until it expires. The
+// refresh token is opaque and is replaced each time it is used.
+type Tokens struct {
+	AccessToken    string `json:"access_token"`
+	TokenType      string `json:"token_type"`
+	ExpiresIn      int64  `json:"expires_in"`
+	RefreshToken   string `json:"refresh_token"`
+	RefreshExpires string `json:"refresh_expires"`
+}
+
+// TokenRefresh exchanges a refresh token for new access and refresh tokens.
+type TokenRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// TokenRevoke revokes a refresh token along with all refresh tokens rotated from it.
+type TokenRevoke struct {
+	Token string `json:"token"`
+}
+
+//===========================================================================
+// Reauthentication
+//===========================================================================
+
+// ReauthRequired is returned with a 401 status when a sensitive operation requires the
+// user to perform a fresh WebAuthn assertion. The client should begin and finish the
+// assertion using the URLs in Reauth and then retry the original request.
+type ReauthRequired struct {
+	Error  string  `json:"error"`
+	Reauth *Reauth `json:"reauth"`
+}
+
+// Reauth describes how the user can satisfy a reauthentication requirement.
+type Reauth struct {
+	UserID           string `json:"user_id"`
+	UserVerification string `json:"user_verification"`
+	Window           string `json:"window"`
+	Begin            string `json:"begin"`
+	Finish           string `json:"finish"`
+}
+
+// ReauthReply is returned when the user has successfully reauthenticated.
+type ReauthReply struct {
+	Message      string `json:"message"`
+	UserVerified bool   `json:"user_verified"`
+	Expires      string `json:"expires"`
+}
+
+//===========================================================================
+// Transaction Confirmation
+//===========================================================================
+
+// TransactionChallenge is returned when a transaction payload is submitted for
+// confirmation. The challenge of the credential request options is the SHA-256 hash of
+// the nonce followed by the payload. Options should be passed to the authenticator and
+// the nonce returned with the assertion.
+type TransactionChallenge struct {
+	Nonce       []byte      `json:"nonce"`
+	PayloadHash string      `json:"payload_hash"`
+	Options     interface{} `json:"options"`
+}
+
+// TransactionConfirmation contains the nonce and payload of the transaction along with
+// the assertion of the authenticator over the transaction challenge.
+type TransactionConfirmation struct {
+	Nonce     []byte          `json:"nonce"`
+	Payload   []byte          `json:"payload"`
+	Assertion json.RawMessage `json:"assertion"`
+}
+
+// ReceiptVerification is the result of verifying a transaction receipt.
+type ReceiptVerification struct {
+	Valid        bool   `json:"valid"`
+	Error        string `json:"error,omitempty"`
+	UserID       string `json:"user_id,omitempty"`
+	Email        string `json:"email,omitempty"`
+	CredentialID string `json:"credential_id,omitempty"`
+	Nickname     string `json:"nickname,omitempty"`
+	Revoked      bool   `json:"revoked"`
+	Signed       string `json:"signed,omitempty"`
+}
+
+//===========================================================================
+// Diagnostics
+//===========================================================================
+
+// AlgorithmReport describes the public key algorithms requested during registration in
+// order of preference and the algorithms that each authenticator model actually chose.
+type AlgorithmReport struct {
+	Preferred      []string                   `json:"preferred"`
+	Authenticators []*AuthenticatorAlgorithms `json:"authenticators"`
+}
+
+// AuthenticatorAlgorithms counts the registered credentials of an authenticator model
+// by public key algorithm.
+type AuthenticatorAlgorithms struct {
+	AAGUID        string            `json:"aaguid"`
+	Authenticator string            `json:"authenticator"`
+	Algorithms    []*AlgorithmCount `json:"algorithms"`
+}
+
+// AlgorithmCount is the number of credentials using a public key algorithm. Preference
+// is the 1-indexed position of the algorithm in the preferred algorithms or 0 if the
+// algorithm is no longer requested.
+type AlgorithmCount struct {
+	Algorithm   string `json:"algorithm"`
+	Preference  int    `json:"preference"`
+	Credentials int    `json:"credentials"`
+}
+
+//===========================================================================
+// Security Events
+//===========================================================================
+
+// SecurityEvent is an audit record of a security-relevant occurrence.
+type SecurityEvent struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	UserID       string `json:"user_id"`
+	CredentialID string `json:"credential_id,omitempty"`
+	ClientIP     string `json:"client_ip,omitempty"`
+	Detail       string `json:"detail"`
+	Created      string `json:"created"`
+}
+
+// SecurityEventList is returned when listing security events.
+type SecurityEventList struct {
+	Events []*SecurityEvent `json:"events"`
+}
+
+//===========================================================================
+// Registration Policy
+//===========================================================================
+
+// RegistrationPolicy describes the AAGUIDs that may or may not be registered and
+// whether a verifiable attestation is required.
+type RegistrationPolicy struct {
+	RequireAttestation bool     `json:"require_attestation"`
+	Allow              []string `json:"allow"`
+	Deny               []string `json:"deny"`
+}
@@ -2,17 +2,81 @@ package yubikey
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/store"
 	"github.com/gin-gonic/gin"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/rs/zerolog/log"
 )
 
+// RegistrationForm contains the user to register along with optional overrides of the
+// configured authenticator selection and attestation options for debugging; empty
+// values use the server configuration.
 type RegistrationForm struct {
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	Email            string `json:"email"`
+	Name             string `json:"name"`
+	ResidentKey      string `json:"resident_key,omitempty"`
+	UserVerification string `json:"user_verification,omitempty"`
+	Attachment       string `json:"attachment,omitempty"`
+	Attestation      string `json:"attestation,omitempty"`
+	Timeout          string `json:"timeout,omitempty"` // in seconds
+}
+
+// Returns the registration options that override the configured defaults.
+func (f *RegistrationForm) Options(conf config.WebAuthnConfig) (opts []webauthn.RegistrationOption, err error) {
+	if f.ResidentKey != "" {
+		if err = config.ValidateChoice("resident key requirement", f.ResidentKey, config.ResidentKeyRequirements); err != nil {
+			return nil, err
+		}
+		conf.ResidentKey = f.ResidentKey
+	}
+
+	if f.UserVerification != "" {
+		if err = config.ValidateChoice("user verification requirement", f.UserVerification, config.UserVerificationRequirements); err != nil {
+			return nil, err
+		}
+		conf.UserVerification = f.UserVerification
+	}
+
+	if f.Attachment != "" {
+		if err = config.ValidateChoice("authenticator attachment", f.Attachment, config.Attachments); err != nil {
+			return nil, err
+		}
+		conf.Attachment = f.Attachment
+	}
+
+	opts = append(opts, webauthn.WithAuthenticatorSelection(conf.AuthenticatorSelection()))
+	opts = append(opts, webauthn.WithCredentialParameters(conf.CredentialParameters()))
+
+	if extensions := conf.RegistrationExtensions(); extensions != nil {
+		opts = append(opts, webauthn.WithExtensions(extensions))
+	}
+
+	if f.Attestation != "" {
+		if err = config.ValidateChoice("attestation conveyance preference", f.Attestation, config.ConveyancePreferences); err != nil {
+			return nil, err
+		}
+		opts = append(opts, webauthn.WithConveyancePreference(protocol.ConveyancePreference(f.Attestation)))
+	}
+
+	if f.Timeout != "" {
+		var seconds int
+		if seconds, err = strconv.Atoi(f.Timeout); err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("%q is not a valid timeout in seconds", f.Timeout)
+		}
+
+		opts = append(opts, func(cco *protocol.PublicKeyCredentialCreationOptions) {
+			cco.Timeout = seconds * 1000
+		})
+	}
+	return opts, nil
 }
 
 func (s *Server) BeginRegistration(c *gin.Context) {
@@ -29,10 +93,16 @@ func (s *Server) BeginRegistration(c *gin.Context) {
 		return
 	}
 
+	options, err := form.Options(s.conf.WebAuthn)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Find or create a new user
 	user, err := s.users.NewUser(form.Name, form.Email)
 	if err != nil {
-		if errors.Is(err, ErrUserAlreadyExists) {
+		if errors.Is(err, store.ErrUserAlreadyExists) {
 			if user, err = s.users.GetUser(form.Email); err != nil {
 				log.Warn().Err(err).Msg("could not retrieve an existing user")
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -48,8 +118,9 @@ func (s *Server) BeginRegistration(c *gin.Context) {
 	registerOptions := func(credCreationOpts *protocol.PublicKeyCredentialCreationOptions) {
 		credCreationOpts.CredentialExcludeList = user.CredentialExcludeList()
 	}
+	options = append(options, registerOptions)
 
-	opts, session, err := s.authn.BeginRegistration(user, registerOptions)
+	opts, session, err := s.authn.BeginRegistration(user, options...)
 	if err != nil {
 		log.Error().Err(err).Msg("could not begin webauthn registration")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not begin webauthn registration"})
@@ -69,13 +140,13 @@ func (s *Server) BeginRegistration(c *gin.Context) {
 
 func (s *Server) FinishRegistration(c *gin.Context) {
 	var (
-		user    *User
+		user    *store.User
 		session webauthn.SessionData
 		err     error
 	)
 
 	// Load the session data
-	if session, err = s.sessions.GetWebauthnSession("registration", c.Request); err != nil {
+	if session, err = s.sessions.GetWebauthnSession("registration", c.Request, c.Writer); err != nil {
 		log.Warn().Err(err).Msg("could not get session data from request")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -90,8 +161,15 @@ func (s *Server) FinishRegistration(c *gin.Context) {
 		return
 	}
 
+	var parsed *protocol.ParsedCredentialCreationData
+	if parsed, err = protocol.ParseCredentialCreationResponse(c.Request); err != nil {
+		log.Warn().Err(err).Msg("could not parse registration response")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	var credential *webauthn.Credential
-	if credential, err = s.authn.FinishRegistration(user, session, c.Request); err != nil {
+	if credential, err = s.authn.CreateCredential(user, session, parsed); err != nil {
 		log.Warn().Err(err).Msg("could not finish registration")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -103,13 +181,48 @@ func (s *Server) FinishRegistration(c *gin.Context) {
 		return
 	}
 
-	// Add the credential to the user and return the response
-	user.AddCredential(*credential)
+	// Ensure the authenticator chose one of the requested public key algorithms
+	algorithm := store.PublicKeyAlgorithm(credential.PublicKey)
+	if !s.conf.WebAuthn.AcceptsAlgorithm(algorithm) {
+		log.Warn().Str("algorithm", config.AlgorithmName(algorithm)).Msg("authenticator chose an unrequested public key algorithm")
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %s", ErrUnrequestedAlgorithm, config.AlgorithmName(algorithm))})
+		return
+	}
+
+	// Add the credential with its registration metadata to the user and return the response
+	record := store.Credential{
+		Credential: *credential,
+		Created:    time.Now().UTC(),
+		ClientIP:   c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		Algorithm:  algorithm,
+	}
+	updateExtensions(&record.Extensions, parsed.ClientExtensionResults, parsed.Response.AttestationObject.AuthData.ExtData)
+
+	// Verify the attestation against the authenticator metadata
+	if record.Metadata, err = s.verifyAttestation(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	// Ensure the authenticator is permitted by the registration policy
+	if err = s.checkPolicy(c, user, credential, record.Metadata); err != nil {
+		return
+	}
+	record.Nickname = record.AuthenticatorName()
+
+	if err = s.users.AddCredential(user, record); err != nil {
+		log.Error().Err(err).Msg("could not store credential")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not store credential"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "registration successful"})
 }
 
+// LoginForm identifies the user to login; the user verification requirement may be
+// overridden for debugging, otherwise the configured requirement is used.
 type LoginForm struct {
-	Email string `json:"email"`
+	Email            string `json:"email"`
+	UserVerification string `json:"user_verification,omitempty"`
 }
 
 func (s *Server) BeginLogin(c *gin.Context) {
@@ -132,7 +245,20 @@ func (s *Server) BeginLogin(c *gin.Context) {
 		return
 	}
 
-	opts, session, err := s.authn.BeginLogin(user)
+	options := make([]webauthn.LoginOption, 0, 2)
+	if extensions := s.conf.WebAuthn.LoginExtensions(); extensions != nil {
+		options = append(options, webauthn.WithAssertionExtensions(extensions))
+	}
+
+	if form.UserVerification != "" {
+		if err = config.ValidateChoice("user verification requirement", form.UserVerification, config.UserVerificationRequirements); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		options = append(options, webauthn.WithUserVerification(protocol.UserVerificationRequirement(form.UserVerification)))
+	}
+
+	opts, session, err := s.authn.BeginLogin(user, options...)
 	if err != nil {
 		log.Error().Err(err).Msg("could not begin webauthn login")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -151,13 +277,13 @@ func (s *Server) BeginLogin(c *gin.Context) {
 
 func (s *Server) FinishLogin(c *gin.Context) {
 	var (
-		user    *User
+		user    *store.User
 		session webauthn.SessionData
 		err     error
 	)
 
 	// Load the session data
-	if session, err = s.sessions.GetWebauthnSession("authentication", c.Request); err != nil {
+	if session, err = s.sessions.GetWebauthnSession("authentication", c.Request, c.Writer); err != nil {
 		log.Warn().Err(err).Msg("could not get session data from request")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -171,11 +297,219 @@ func (s *Server) FinishLogin(c *gin.Context) {
 		return
 	}
 
-	if _, err = s.authn.FinishLogin(user, session, c.Request); err != nil {
-		log.Warn().Err(err).Msg("could not finish registration")
+	var parsed *protocol.ParsedCredentialAssertionData
+	if parsed, err = protocol.ParseCredentialRequestResponse(c.Request); err != nil {
+		log.Warn().Err(err).Msg("could not parse login response")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var credential *webauthn.Credential
+	if credential, err = s.authn.ValidateLogin(user, session, parsed); err != nil {
+		log.Warn().Err(err).Msg("could not finish login")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var warning string
+	if warning, err = s.updateCredential(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	var tokens *v1.Tokens
+	if tokens, err = s.startSession(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	reply := gin.H{"message": "login successful"}
+	if warning != "" {
+		reply["warning"] = warning
+	}
+
+	if tokens != nil {
+		reply["tokens"] = tokens
+	}
+	c.JSON(http.StatusOK, reply)
+}
+
+// BeginDiscoverableLogin issues a challenge with an empty allow list so that the
+// authenticator selects a discoverable (resident) credential and returns the user handle
+// of the user that registered it; no email address is required.
+func (s *Server) BeginDiscoverableLogin(c *gin.Context) {
+	s.beginDiscoverableLogin(c, "discoverable")
+}
+
+func (s *Server) FinishDiscoverableLogin(c *gin.Context) {
+	s.finishDiscoverableLogin(c, "discoverable")
+}
+
+// BeginConditionalLogin issues a discoverable login challenge when the login page is
+// loaded so that the browser can offer passkeys in the autofill UI of the email input
+// (conditional mediation). The challenge is stored separately from the modal login
+// challenges so that an abandoned conditional request does not interfere with them; it
+// is replaced when the page is reloaded and pruned from the cookie once it expires.
+func (s *Server) BeginConditionalLogin(c *gin.Context) {
+	s.beginDiscoverableLogin(c, "conditional")
+}
+
+func (s *Server) FinishConditionalLogin(c *gin.Context) {
+	s.finishDiscoverableLogin(c, "conditional")
+}
+
+func (s *Server) beginDiscoverableLogin(c *gin.Context, key string) {
+	options := make([]webauthn.LoginOption, 0, 1)
+	if extensions := s.conf.WebAuthn.LoginExtensions(); extensions != nil {
+		options = append(options, webauthn.WithAssertionExtensions(extensions))
+	}
+
+	opts, session, err := s.authn.BeginDiscoverableLogin(options...)
+	if err != nil {
+		log.Error().Err(err).Msg("could not begin webauthn discoverable login")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Session values must be stored
+	if err := s.sessions.SaveWebauthnSession(key, session, c.Request, c.Writer); err != nil {
+		log.Error().Err(err).Msg("could not save session data")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, opts)
+}
+
+func (s *Server) finishDiscoverableLogin(c *gin.Context, key string) {
+	var (
+		user    *store.User
+		session webauthn.SessionData
+		err     error
+	)
+
+	// Load the session data
+	if session, err = s.sessions.GetWebauthnSession(key, c.Request, c.Writer); err != nil {
+		log.Warn().Err(err).Msg("could not get session data from request")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "login successful"})
+	var parsed *protocol.ParsedCredentialAssertionData
+	if parsed, err = protocol.ParseCredentialRequestResponse(c.Request); err != nil {
+		log.Warn().Err(err).Msg("could not parse login response")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Resolve the user from the user handle returned by the authenticator, ensuring
+	// that the credential used to sign the assertion belongs to that user.
+	handler := func(rawID, userHandle []byte) (_ webauthn.User, err error) {
+		if user, err = s.users.Lookup(userHandle); err != nil {
+			return nil, err
+		}
+
+		var owner *store.User
+		if owner, _, err = s.users.LookupByCredentialID(rawID); err != nil {
+			return nil, err
+		}
+
+		if owner.ID != user.ID {
+			return nil, store.ErrCredentialNotFound
+		}
+		return user, nil
+	}
+
+	var credential *webauthn.Credential
+	if credential, err = s.authn.ValidateDiscoverableLogin(handler, session, parsed); err != nil {
+		log.Warn().Err(err).Msg("could not finish discoverable login")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var warning string
+	if warning, err = s.updateCredential(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	var tokens *v1.Tokens
+	if tokens, err = s.startSession(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	reply := gin.H{"message": "login successful", "user": user.WebAuthnDisplayName()}
+	if warning != "" {
+		reply["warning"] = warning
+	}
+
+	if tokens != nil {
+		reply["tokens"] = tokens
+	}
+	c.JSON(http.StatusOK, reply)
+}
+
+// Update the stored credential after a successful assertion, recording the new sign
+// counter, flags, extension results, and time of use. If the sign counter did not increase the configured
+// clone policy is applied. An error is returned if the login should not proceed, in
+// which case the error response has already been written; otherwise a warning message
+// for the user may be returned if the clone policy requires it.
+func (s *Server) updateCredential(c *gin.Context, user *store.User, credential *webauthn.Credential, parsed *protocol.ParsedCredentialAssertionData) (warning string, err error) {
+	var record store.Credential
+	if record, err = user.Credential(credential.ID); err != nil {
+		log.Error().Err(err).Msg("could not find credential used to login")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not finish login"})
+		return "", err
+	}
+
+	// Revoked credentials cannot be used to login
+	if record.IsRevoked() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "credential has been revoked"})
+		return "", ErrCredentialRevoked
+	}
+
+	stored := record.Authenticator.SignCount
+	record.Authenticator.SignCount = credential.Authenticator.SignCount
+	record.Authenticator.CloneWarning = credential.Authenticator.CloneWarning
+	record.Flags = credential.Flags
+
+	counter := parsed.Response.AuthenticatorData.Counter
+	if counterRegressed(stored, counter) {
+		detail := fmt.Sprintf("sign counter %d did not increase from stored value %d, authenticator may be cloned (policy: %s)", counter, stored, s.conf.WebAuthn.ClonePolicy)
+		s.securityEvent(c, store.EventCloneWarning, user, record.ID, detail)
+
+		switch s.conf.WebAuthn.ClonePolicy {
+		case config.ClonePolicyWarn:
+			warning = "the signature counter of this authenticator did not increase; it may have been cloned"
+		case config.ClonePolicyReject, config.ClonePolicyDisable:
+			if s.conf.WebAuthn.ClonePolicy == config.ClonePolicyDisable {
+				record.Revoke("cloned authenticator detected")
+			}
+
+			if err = s.users.UpdateCredential(user, record); err != nil {
+				log.Error().Err(err).Msg("could not update credential after clone detection")
+			}
+
+			if record.IsRevoked() {
+				s.revokeSessions(c, user, "cloned authenticator detected")
+			}
+
+			c.JSON(http.StatusForbidden, gin.H{"error": "authenticator may be cloned, login rejected"})
+			return "", ErrClonedAuthenticator
+		}
+	}
+
+	updateExtensions(&record.Extensions, parsed.ClientExtensionResults, parsed.Response.AuthenticatorData.ExtData)
+	record.LastUsed = time.Now().UTC()
+	if err = s.users.UpdateCredential(user, record); err != nil {
+		log.Error().Err(err).Msg("could not update credential after login")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not finish login"})
+		return "", err
+	}
+	return warning, nil
+}
+
+// Returns true if the sign counter from the authenticator data is not greater than the
+// stored sign counter; authenticators that do not implement counters always return 0.
+//
+// Specification: §7.2. Verifying an Authentication Assertion step 21 (https://www.w3.org/TR/webauthn/#sctn-verifying-assertion)
+func counterRegressed(stored, counter uint32) bool {
+	return counter <= stored && (counter != 0 || stored != 0)
 }
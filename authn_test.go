@@ -0,0 +1,389 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestCounterRegressed(t *testing.T) {
+	tests := []struct {
+		stored, counter uint32
+		expected        bool
+	}{
+		{0, 0, false},
+		{0, 1, false},
+		{1, 2, false},
+		{41, 1000, false},
+		{1, 1, true},
+		{2, 1, true},
+		{5, 0, true},
+	}
+
+	for _, tc := range tests {
+		if actual := counterRegressed(tc.stored, tc.counter); actual != tc.expected {
+			t.Errorf("stored %d, counter %d: expected %t, got %t", tc.stored, tc.counter, tc.expected, actual)
+		}
+	}
+}
+
+func TestClonePolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		counter uint32
+		err     error
+		warning bool
+		revoked bool
+		status  int
+	}{
+		{config.ClonePolicyLog, 11, nil, false, false, http.StatusOK},
+		{config.ClonePolicyWarn, 11, nil, false, false, http.StatusOK},
+		{config.ClonePolicyReject, 11, nil, false, false, http.StatusOK},
+		{config.ClonePolicyDisable, 11, nil, false, false, http.StatusOK},
+		{config.ClonePolicyLog, 10, nil, false, false, http.StatusOK},
+		{config.ClonePolicyWarn, 10, nil, true, false, http.StatusOK},
+		{config.ClonePolicyReject, 10, ErrClonedAuthenticator, false, false, http.StatusForbidden},
+		{config.ClonePolicyDisable, 9, ErrClonedAuthenticator, false, true, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		s := newTestServer(t, config.Config{WebAuthn: config.WebAuthnConfig{ClonePolicy: tc.policy}})
+		user, err := s.users.NewUser("Jane Doe", "jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cred := store.Credential{Credential: webauthn.Credential{
+			ID:            []byte{0x01, 0x02, 0x03},
+			PublicKey:     []byte{0x04},
+			Authenticator: webauthn.Authenticator{AAGUID: make([]byte, 16), SignCount: 10},
+		}}
+
+		if err = s.users.AddCredential(user, cred); err != nil {
+			t.Fatal(err)
+		}
+
+		login := &session.LoginSession{UserID: user.ID, CredentialID: cred.ID, Expires: time.Now().Add(time.Hour)}
+		if err = s.sessions.Logins.Track(login); err != nil {
+			t.Fatal(err)
+		}
+
+		credential := &webauthn.Credential{ID: cred.ID, Authenticator: webauthn.Authenticator{SignCount: tc.counter}}
+		parsed := &protocol.ParsedCredentialAssertionData{}
+		parsed.Response.AuthenticatorData.Counter = tc.counter
+
+		c, w := newTestContext(http.MethodPost, "/login/finish")
+		warning, err := s.updateCredential(c, user, credential, parsed)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s policy, counter %d: expected error %v, got %v", tc.policy, tc.counter, tc.err, err)
+		}
+
+		if (warning != "") != tc.warning {
+			t.Errorf("%s policy, counter %d: expected warning %t, got %q", tc.policy, tc.counter, tc.warning, warning)
+		}
+
+		if w.Code != tc.status {
+			t.Errorf("%s policy, counter %d: expected status %d, got %d", tc.policy, tc.counter, tc.status, w.Code)
+		}
+
+		stored, _ := user.Credential(cred.ID)
+		if stored.IsRevoked() != tc.revoked {
+			t.Errorf("%s policy, counter %d: expected revoked %t", tc.policy, tc.counter, tc.revoked)
+		}
+
+		// A regressed counter always records an event; disabling the credential also
+		// revokes the sessions of the user.
+		events, _ := s.users.ListEvents(user.ID)
+		regressed := counterRegressed(10, tc.counter)
+		if regressed && (len(events) == 0 || events[0].Type != store.EventCloneWarning) {
+			t.Errorf("%s policy, counter %d: expected a clone warning event", tc.policy, tc.counter)
+		} else if !regressed && len(events) != 0 {
+			t.Errorf("%s policy, counter %d: expected no security events, got %d", tc.policy, tc.counter, len(events))
+		}
+
+		if _, err = s.sessions.Logins.Get(login.ID); (err == nil) == tc.revoked {
+			t.Errorf("%s policy, counter %d: expected sessions revoked %t", tc.policy, tc.counter, tc.revoked)
+		}
+
+		if tc.err == nil && stored.Authenticator.SignCount != tc.counter {
+			t.Errorf("%s policy, counter %d: expected the sign count to be updated, got %d", tc.policy, tc.counter, stored.Authenticator.SignCount)
+		}
+	}
+}
+
+func TestDiscoverableLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		begin  string
+		finish string
+		cred   string // the credential that signs the assertion
+		handle string // the user whose handle is returned
+		status int
+	}{
+		{"discoverable", "discoverable", "discoverable", "jane", "jane", http.StatusOK},
+		{"conditional", "conditional", "conditional", "jane", "jane", http.StatusOK},
+		{"other user handle", "discoverable", "discoverable", "jane", "john", http.StatusBadRequest},
+		{"unknown credential", "discoverable", "discoverable", "unknown", "jane", http.StatusBadRequest},
+		{"revoked credential", "discoverable", "discoverable", "revoked", "jane", http.StatusBadRequest},
+		{"conditional challenge", "conditional", "discoverable", "jane", "jane", http.StatusBadRequest},
+		{"discoverable challenge", "discoverable", "conditional", "jane", "jane", http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		s := newDefaultServer(t)
+		users := make(map[string]*store.User)
+		for _, email := range []string{"jane@example.com", "john@example.com"} {
+			user, err := s.users.NewUser("Test User", email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			users[email[:4]] = user
+		}
+
+		authenticators := map[string]*testAuthenticator{
+			"jane":    newTestAuthenticator(t),
+			"revoked": newTestAuthenticator(t),
+			"unknown": newTestAuthenticator(t),
+		}
+
+		for _, name := range []string{"jane", "revoked"} {
+			if err := s.users.AddCredential(users["jane"], authenticators[name].credential(t)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.users.RevokeCredential(users["jane"], authenticators["revoked"].id, "lost"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Begin the ceremony without an email address
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login/"+tc.begin+"/begin", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", tc.name, http.StatusOK, w.Code)
+		}
+
+		opts := &protocol.CredentialAssertion{}
+		if err := json.Unmarshal(w.Body.Bytes(), opts); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(opts.Response.AllowedCredentials) != 0 {
+			t.Errorf("%s: expected an empty allow list, got %d credentials", tc.name, len(opts.Response.AllowedCredentials))
+		}
+
+		cookies := w.Result().Cookies()
+		assertion := authenticators[tc.cred].assert(t, opts.Response.Challenge.String(), users[tc.handle].WebAuthnID())
+		finish := func() *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/login/"+tc.finish+"/finish", bytes.NewReader(assertion))
+			for _, cookie := range cookies {
+				r.AddCookie(cookie)
+			}
+
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, r)
+			return w
+		}
+
+		if w = finish(); w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+			continue
+		}
+
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		// The challenge cannot be used again
+		if w = finish(); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a replayed assertion to be rejected, got %d", tc.name, w.Code)
+		}
+
+		cred, _ := users["jane"].Credential(authenticators["jane"].id)
+		if cred.LastUsed.IsZero() {
+			t.Errorf("%s: expected the credential to be marked as used", tc.name)
+		}
+	}
+}
+
+// An ES256 authenticator with a discoverable credential that signs login assertions for
+// the tests.
+type testAuthenticator struct {
+	id      []byte
+	key     *ecdsa.PrivateKey
+	counter uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{id: id, key: key}
+}
+
+// Returns the credential as it is stored after registration.
+func (a *testAuthenticator) credential(t *testing.T) store.Credential {
+	key := webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	}
+
+	publicKey, err := webauthncbor.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store.Credential{Credential: webauthn.Credential{
+		ID:            a.id,
+		PublicKey:     publicKey,
+		Authenticator: webauthn.Authenticator{AAGUID: make([]byte, 16)},
+	}}
+}
+
+// Returns the JSON encoded assertion response to the login challenge for the default
+// relying party, including the user handle of a discoverable credential.
+func (a *testAuthenticator) assert(t *testing.T, challenge string, userHandle []byte) []byte {
+	clientData, err := json.Marshal(protocol.CollectedClientData{
+		Type:      protocol.AssertCeremony,
+		Challenge: challenge,
+		Origin:    "https://yubikey.local",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RP ID hash, user present and verified flags, and the signature counter
+	a.counter++
+	rpIDHash := sha256.Sum256([]byte("yubikey.local"))
+	authData := append(rpIDHash[:], byte(protocol.FlagUserPresent|protocol.FlagUserVerified))
+	authData = binary.BigEndian.AppendUint32(authData, a.counter)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	var signature []byte
+	if signature, err = ecdsa.SignASN1(rand.Reader, a.key, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	assertion, err := json.Marshal(map[string]interface{}{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode(userHandle),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestRegistrationFormOptions(t *testing.T) {
+	conf := config.WebAuthnConfig{
+		ResidentKey:      "preferred",
+		UserVerification: "preferred",
+		Attestation:      "none",
+		Algorithms:       []string{"ES256", "EdDSA"},
+		Extensions:       []string{config.ExtensionCredProps},
+	}
+
+	tests := []struct {
+		name   string
+		form   RegistrationForm
+		check  func(*protocol.PublicKeyCredentialCreationOptions) bool
+		errors bool
+	}{
+		{"defaults", RegistrationForm{}, func(o *protocol.PublicKeyCredentialCreationOptions) bool {
+			return o.AuthenticatorSelection.ResidentKey == protocol.ResidentKeyRequirementPreferred && o.Attestation == "" && o.Timeout == 0
+		}, false},
+		{"resident key", RegistrationForm{ResidentKey: "required"}, func(o *protocol.PublicKeyCredentialCreationOptions) bool {
+			return o.AuthenticatorSelection.ResidentKey == protocol.ResidentKeyRequirementRequired && *o.AuthenticatorSelection.RequireResidentKey
+		}, false},
+		{"user verification", RegistrationForm{UserVerification: "discouraged"}, func(o *protocol.PublicKeyCredentialCreationOptions) bool {
+			return o.AuthenticatorSelection.UserVerification == protocol.VerificationDiscouraged
+		}, false},
+		{"attachment", RegistrationForm{Attachment: "cross-platform"}, func(o *protocol.PublicKeyCredentialCreationOptions) bool {
+			return o.AuthenticatorSelection.AuthenticatorAttachment == protocol.CrossPlatform
+		}, false},
+		{"attestation", RegistrationForm{Attestation: "direct"}, func(o *protocol.PublicKeyCredentialCreationOptions) bool {
+			return o.Attestation == protocol.PreferDirectAttestation
+		}, false},
+		{"timeout", RegistrationForm{Timeout: "30"}, func(o *protocol.PublicKeyCredentialCreationOptions) bool {
+			return o.Timeout == 30000
+		}, false},
+		{"invalid resident key", RegistrationForm{ResidentKey: "always"}, nil, true},
+		{"invalid user verification", RegistrationForm{UserVerification: "never"}, nil, true},
+		{"invalid attachment", RegistrationForm{Attachment: "usb"}, nil, true},
+		{"invalid attestation", RegistrationForm{Attestation: "self"}, nil, true},
+		{"invalid timeout", RegistrationForm{Timeout: "soon"}, nil, true},
+		{"negative timeout", RegistrationForm{Timeout: "-1"}, nil, true},
+	}
+
+	for _, tc := range tests {
+		opts, err := tc.form.Options(conf)
+		if tc.errors {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		creation := &protocol.PublicKeyCredentialCreationOptions{}
+		for _, opt := range opts {
+			opt(creation)
+		}
+
+		if !tc.check(creation) {
+			t.Errorf("%s: unexpected creation options %+v", tc.name, creation)
+		}
+
+		// The configured algorithms and extensions are always requested
+		if len(creation.Parameters) != 2 || creation.Parameters[0].Algorithm != webauthncose.AlgES256 || creation.Parameters[1].Algorithm != webauthncose.AlgEdDSA {
+			t.Errorf("%s: expected the configured algorithms in order, got %+v", tc.name, creation.Parameters)
+		}
+
+		if _, ok := creation.Extensions["credProps"]; !ok {
+			t.Errorf("%s: expected the configured extensions, got %+v", tc.name, creation.Extensions)
+		}
+	}
+}
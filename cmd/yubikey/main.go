@@ -1,12 +1,21 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/bbengfort/yubikey"
 	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/bbengfort/yubikey/token"
+	"github.com/bbengfort/yubikey/transaction"
 	"github.com/joho/godotenv"
 	confire "github.com/rotationalio/confire/usage"
 	"github.com/urfave/cli/v2"
@@ -30,6 +39,211 @@ func main() {
 			Action:   serve,
 			Flags:    []cli.Flag{},
 		},
+		{
+			Name:     "users",
+			Usage:    "manage registered users",
+			Category: "admin",
+			Before:   openStore,
+			After:    closeStore,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list all registered users",
+					Action: listUsers,
+				},
+				{
+					Name:   "rename",
+					Usage:  "change the display name of a user",
+					Action: renameUser,
+					Flags: []cli.Flag{
+						emailFlag,
+						&cli.StringFlag{
+							Name:     "name",
+							Aliases:  []string{"n"},
+							Usage:    "the new display name of the user",
+							Required: true,
+						},
+					},
+				},
+				{
+					Name:   "change-email",
+					Usage:  "change the email address of a user",
+					Action: changeEmail,
+					Flags: []cli.Flag{
+						emailFlag,
+						&cli.StringFlag{
+							Name:     "new-email",
+							Aliases:  []string{"E"},
+							Usage:    "the new email address of the user",
+							Required: true,
+						},
+					},
+				},
+				{
+					Name:   "delete",
+					Usage:  "delete a user and all of their credentials",
+					Action: deleteUser,
+					Flags: []cli.Flag{
+						emailFlag,
+					},
+				},
+			},
+		},
+		{
+			Name:     "credentials",
+			Usage:    "manage the credentials registered by a user",
+			Category: "admin",
+			Before:   openStore,
+			After:    closeStore,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the credentials registered by a user",
+					Action: listCredentials,
+					Flags: []cli.Flag{
+						emailFlag,
+					},
+				},
+				{
+					Name:   "owner",
+					Usage:  "find the user that registered a credential",
+					Action: credentialOwner,
+					Flags: []cli.Flag{
+						credentialFlag,
+					},
+				},
+				{
+					Name:   "revoke",
+					Usage:  "disable a credential so it can no longer be used to login",
+					Action: revokeCredential,
+					Flags: []cli.Flag{
+						emailFlag,
+						credentialFlag,
+						&cli.StringFlag{
+							Name:    "reason",
+							Aliases: []string{"r"},
+							Usage:   "the reason the credential is being revoked",
+							Value:   "revoked by administrator",
+						},
+					},
+				},
+				{
+					Name:   "delete",
+					Usage:  "permanently remove a credential from a user",
+					Action: deleteCredential,
+					Flags: []cli.Flag{
+						emailFlag,
+						credentialFlag,
+					},
+				},
+			},
+		},
+		{
+			Name:     "sessions",
+			Usage:    "manage the login sessions of a user",
+			Category: "admin",
+			Before:   openStore,
+			After:    closeStore,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the active login sessions of a user",
+					Action: listSessions,
+					Flags: []cli.Flag{
+						emailFlag,
+					},
+				},
+				{
+					Name:   "revoke",
+					Usage:  "revoke all login sessions of a user or a single session by id",
+					Action: revokeSessions,
+					Flags: []cli.Flag{
+						emailFlag,
+						&cli.StringFlag{
+							Name:    "session",
+							Aliases: []string{"s"},
+							Usage:   "revoke only the login session with the specified id",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "export all users and credentials to a file",
+			ArgsUsage: "[path]",
+			Category:  "admin",
+			Before:    openStore,
+			After:     closeStore,
+			Action:    exportUsers,
+			Flags: []cli.Flag{
+				formatFlag,
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "import users and credentials from an export file",
+			ArgsUsage: "path",
+			Category:  "admin",
+			Before:    openStore,
+			After:     closeStore,
+			Action:    importUsers,
+			Flags: []cli.Flag{
+				formatFlag,
+			},
+		},
+		{
+			Name:     "transactions",
+			Usage:    "verify transactions confirmed with a security key",
+			Category: "admin",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "verify a transaction receipt against the stored public key",
+					ArgsUsage: "path",
+					Before:    openStore,
+					After:     closeStore,
+					Action:    verifyReceipt,
+				},
+			},
+		},
+		{
+			Name:     "encryption",
+			Usage:    "manage the master keys used to encrypt the store at rest",
+			Category: "admin",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "keygen",
+					Usage:  "generate a new master key for the configuration",
+					Action: generateMasterKey,
+				},
+				{
+					Name:   "rotate",
+					Usage:  "re-wrap the data key with the active (first) master key",
+					Before: openStore,
+					After:  closeStore,
+					Action: rotateMasterKey,
+				},
+			},
+		},
+		{
+			Name:     "keys",
+			Usage:    "manage the keys used to sign and encrypt session cookies and tokens",
+			Category: "admin",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "generate",
+					Usage:  "generate a new session key pair for the configuration",
+					Action: generateSessionKey,
+				},
+				{
+					Name:      "token",
+					Usage:     "generate a new ES256 private key for signing access tokens",
+					ArgsUsage: "[path]",
+					Action:    generateTokenKey,
+				},
+			},
+		},
 		{
 			Name:     "config",
 			Usage:    "print yubikey authn configuration guide",
@@ -71,6 +285,340 @@ func serve(c *cli.Context) (err error) {
 	return nil
 }
 
+//===========================================================================
+// Admin Commands
+//===========================================================================
+
+var (
+	db store.Store
+
+	emailFlag = &cli.StringFlag{
+		Name:     "email",
+		Aliases:  []string{"e"},
+		Usage:    "the email address of the user",
+		Required: true,
+	}
+
+	formatFlag = &cli.StringFlag{
+		Name:    "format",
+		Aliases: []string{"f"},
+		Usage:   "the export format, json or cbor (inferred from the file extension if not set)",
+	}
+
+	credentialFlag = &cli.StringFlag{
+		Name:     "id",
+		Aliases:  []string{"i"},
+		Usage:    "the base64 encoded credential id",
+		Required: true,
+	}
+)
+
+func listUsers(c *cli.Context) (err error) {
+	var users []*store.User
+	if users, err = db.ListUsers(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+	fmt.Fprintln(tabs, "ID\tName\tEmail\tCredentials")
+	for _, user := range users {
+		fmt.Fprintf(tabs, "%s\t%s\t%s\t%d\n", user.ID, user.WebAuthnDisplayName(), user.WebAuthnName(), len(user.Credentials()))
+	}
+	tabs.Flush()
+	return nil
+}
+
+func renameUser(c *cli.Context) (err error) {
+	var user *store.User
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = db.UpdateName(user, c.String("name")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("user %s renamed to %q\n", user.WebAuthnName(), user.WebAuthnDisplayName())
+	return nil
+}
+
+func changeEmail(c *cli.Context) (err error) {
+	var user *store.User
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = db.UpdateEmail(user, c.String("new-email")); err != nil {
+		if errors.Is(err, store.ErrUserAlreadyExists) {
+			return cli.Exit(fmt.Errorf("%s is already registered to another user", c.String("new-email")), 1)
+		}
+		return cli.Exit(err, 1)
+	}
+
+	recordEvent(store.EventEmailChanged, user, nil, fmt.Sprintf("email changed from %s to %s", c.String("email"), c.String("new-email")))
+	fmt.Printf("user email changed to %s\n", user.WebAuthnName())
+	return nil
+}
+
+func deleteUser(c *cli.Context) (err error) {
+	var user *store.User
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = db.DeleteUser(user.ID); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	recordEvent(store.EventUserDeleted, user, nil, fmt.Sprintf("user %s deleted", user.WebAuthnName()))
+	killSessions(user, "user deleted")
+	fmt.Printf("user %s deleted\n", user.WebAuthnName())
+	return nil
+}
+
+func listCredentials(c *cli.Context) (err error) {
+	var user *store.User
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+	fmt.Fprintln(tabs, "ID\tNickname\tAuthenticator\tCreated\tLast Used\tStatus")
+	for _, cred := range user.Credentials() {
+		status := "active"
+		if cred.IsRevoked() {
+			status = fmt.Sprintf("revoked: %s", cred.Reason)
+		}
+
+		lastUsed := "never"
+		if !cred.LastUsed.IsZero() {
+			lastUsed = cred.LastUsed.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\t%s\t%s\n", cred.KeyID(), cred.Nickname, cred.AuthenticatorName(), cred.Created.Format(time.RFC3339), lastUsed, status)
+	}
+	tabs.Flush()
+	return nil
+}
+
+func credentialOwner(c *cli.Context) (err error) {
+	var credentialID []byte
+	if credentialID, err = store.DecodeKeyID(c.String("id")); err != nil {
+		return cli.Exit(fmt.Errorf("could not parse credential id: %w", err), 1)
+	}
+
+	var (
+		user *store.User
+		cred store.Credential
+	)
+
+	if user, cred, err = db.LookupByCredentialID(credentialID); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	status := "active"
+	if cred.IsRevoked() {
+		status = fmt.Sprintf("revoked: %s", cred.Reason)
+	}
+
+	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+	fmt.Fprintln(tabs, "User ID\tName\tEmail\tNickname\tAuthenticator\tStatus")
+	fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\t%s\t%s\n", user.ID, user.WebAuthnDisplayName(), user.WebAuthnName(), cred.Nickname, cred.AuthenticatorName(), status)
+	tabs.Flush()
+	return nil
+}
+
+func revokeCredential(c *cli.Context) (err error) {
+	var (
+		user         *store.User
+		credentialID []byte
+	)
+
+	if user, credentialID, err = lookupCredential(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = db.RevokeCredential(user, credentialID, c.String("reason")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	recordEvent(store.EventCredentialRevoked, user, credentialID, c.String("reason"))
+	killSessions(user, "credential revoked")
+	fmt.Printf("credential %s revoked\n", c.String("id"))
+	return nil
+}
+
+func deleteCredential(c *cli.Context) (err error) {
+	var (
+		user         *store.User
+		credentialID []byte
+	)
+
+	if user, credentialID, err = lookupCredential(c); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = db.RemoveCredential(user, credentialID); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	recordEvent(store.EventCredentialDeleted, user, credentialID, "credential deleted by administrator")
+	killSessions(user, "credential deleted")
+	fmt.Printf("credential %s deleted\n", c.String("id"))
+	return nil
+}
+
+func listSessions(c *cli.Context) (err error) {
+	var user *store.User
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var logins []*session.LoginSession
+	if logins, err = session.NewLogins(db).List(user.ID); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+	fmt.Fprintln(tabs, "ID\tCredential\tClient IP\tCreated\tLast Seen\tUser Agent")
+	for _, login := range logins {
+		fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\t%s\t%s\n", login.ID, store.EncodeKeyID(login.CredentialID), login.ClientIP, login.Created.Format(time.RFC3339), login.LastSeen.Format(time.RFC3339), login.UserAgent)
+	}
+	tabs.Flush()
+	return nil
+}
+
+func revokeSessions(c *cli.Context) (err error) {
+	var user *store.User
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	logins := session.NewLogins(db)
+	if id := c.String("session"); id != "" {
+		var login *session.LoginSession
+		if login, err = logins.Get(id); err != nil || login.UserID != user.ID {
+			return cli.Exit(store.ErrSessionNotFound, 1)
+		}
+
+		if err = logins.Revoke(id); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		recordEvent(store.EventSessionsRevoked, user, login.CredentialID, fmt.Sprintf("session %s revoked by administrator", id))
+		fmt.Printf("session %s revoked\n", id)
+		return nil
+	}
+
+	var revoked int
+	if revoked, err = logins.RevokeAll(user.ID); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if revoked > 0 {
+		recordEvent(store.EventSessionsRevoked, user, nil, fmt.Sprintf("%d sessions revoked: revoked by administrator", revoked))
+	}
+	fmt.Printf("%d sessions revoked for %s\n", revoked, user.WebAuthnName())
+	return nil
+}
+
+func exportUsers(c *cli.Context) (err error) {
+	var data *store.Export
+	if data, err = store.ExportUsers(db); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	out := os.Stdout
+	if path := c.Args().First(); path != "" {
+		if out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return cli.Exit(err, 1)
+		}
+		defer out.Close()
+	}
+
+	if err = data.Write(out, exportFormat(c)); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if out != os.Stdout {
+		fmt.Printf("exported %d users to %s\n", len(data.Users), c.Args().First())
+	}
+	return nil
+}
+
+func importUsers(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the path to the export file to import", 1)
+	}
+
+	var f *os.File
+	if f, err = os.Open(c.Args().First()); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer f.Close()
+
+	var data *store.Export
+	if data, err = store.ReadExport(f, exportFormat(c)); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = store.ImportUsers(db, data); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("imported %d users from %s\n", len(data.Users), c.Args().First())
+	return nil
+}
+
+func verifyReceipt(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the path to the transaction receipt to verify", 1)
+	}
+
+	var conf config.Config
+	if conf, err = config.New(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var f *os.File
+	if f, err = os.Open(c.Args().First()); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer f.Close()
+
+	var receipt *transaction.Receipt
+	if receipt, err = transaction.ReadReceipt(f); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var (
+		user *store.User
+		cred store.Credential
+	)
+
+	if user, cred, err = transaction.Verify(db, receipt, conf.WebAuthn.RPID, conf.WebAuthn.Origins); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	status := "active"
+	if cred.IsRevoked() {
+		status = fmt.Sprintf("revoked: %s", cred.Reason)
+	}
+
+	fmt.Println("receipt is valid")
+	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+	fmt.Fprintln(tabs, "Email\tCredential\tNickname\tStatus\tSigned")
+	fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\t%s\n", user.WebAuthnName(), cred.KeyID(), cred.Nickname, status, receipt.Signed.Format(time.RFC3339))
+	tabs.Flush()
+
+	fmt.Printf("\n%s\n", receipt.Payload)
+	return nil
+}
+
+//===========================================================================
+// Utility Commands
+//===========================================================================
+
 func usage(c *cli.Context) (err error) {
 	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
 	format := confire.DefaultTableFormat
@@ -85,3 +633,181 @@ func usage(c *cli.Context) (err error) {
 	tabs.Flush()
 	return nil
 }
+
+func generateMasterKey(c *cli.Context) (err error) {
+	var key string
+	if key, err = store.GenerateMasterKey(); err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func generateSessionKey(c *cli.Context) (err error) {
+	var key string
+	if key, err = session.GenerateKeyPair(); err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func generateTokenKey(c *cli.Context) (err error) {
+	var key *token.SigningKey
+	if key, err = token.GenerateSigningKey(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var data []byte
+	if data, err = key.PEM(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	path := c.Args().First()
+	if path == "" {
+		fmt.Print(string(data))
+		return nil
+	}
+
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Printf("token signing key %s written to %s\n", key.ID, path)
+	return nil
+}
+
+// The data key is re-wrapped with the active master key when the store is opened, so
+// rotation only requires opening the store with the new key prepended to the old keys;
+// the master key that wraps the data key is checked to ensure the rotation succeeded.
+func rotateMasterKey(c *cli.Context) (err error) {
+	var conf config.Config
+	if conf, err = config.New(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var keys [][]byte
+	if keys, err = conf.Database.Keys(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if len(keys) == 0 {
+		return cli.Exit("no master keys are configured, the store is not encrypted", 1)
+	}
+
+	var active *store.MasterKey
+	if active, err = store.NewMasterKey(keys[0]); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	encrypted, ok := db.(store.Encrypted)
+	if !ok {
+		return cli.Exit("the configured store does not support encryption at rest", 1)
+	}
+
+	opened, current := encrypted.MasterKeyIDs()
+	switch {
+	case opened == "":
+		fmt.Printf("data key generated and wrapped with master key %s\n", current)
+	case opened == current:
+		fmt.Printf("data key was already wrapped with master key %s\n", current)
+	default:
+		fmt.Printf("data key re-wrapped from master key %s to master key %s\n", opened, current)
+	}
+
+	if current != active.ID {
+		return cli.Exit(fmt.Sprintf("data key is wrapped with master key %s, not the active master key %s", current, active.ID), 1)
+	}
+	return nil
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// Open the store specified by the configuration for admin commands. Note that the
+// memory store cannot be managed from the command line since it is not persisted.
+func openStore(c *cli.Context) (err error) {
+	var conf config.Config
+	if conf, err = config.New(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if strings.HasPrefix(conf.Database.URL, "memory://") {
+		return cli.Exit("cannot manage an in-memory store, specify a persistent database url", 1)
+	}
+
+	var keys [][]byte
+	if keys, err = conf.Database.Keys(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if db, err = store.Open(conf.Database.URL, keys...); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
+
+func closeStore(c *cli.Context) (err error) {
+	if db != nil {
+		if err = db.Close(); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	return nil
+}
+
+func lookupCredential(c *cli.Context) (user *store.User, credentialID []byte, err error) {
+	if user, err = db.GetUser(c.String("email")); err != nil {
+		return nil, nil, err
+	}
+
+	if credentialID, err = store.DecodeKeyID(c.String("id")); err != nil {
+		return nil, nil, fmt.Errorf("could not parse credential id: %w", err)
+	}
+
+	if _, err = user.Credential(credentialID); err != nil {
+		return nil, nil, err
+	}
+	return user, credentialID, nil
+}
+
+// Returns the export format from the flag or the extension of the path argument.
+func exportFormat(c *cli.Context) string {
+	if format := c.String("format"); format != "" {
+		return strings.ToLower(format)
+	}
+
+	if strings.ToLower(filepath.Ext(c.Args().First())) == ".cbor" {
+		return store.FormatCBOR
+	}
+	return store.FormatJSON
+}
+
+// Revoke all login sessions of the user after their credentials have changed so that a
+// compromised session cannot outlive the credential that was used to create it.
+func killSessions(user *store.User, reason string) {
+	revoked, err := session.NewLogins(db).RevokeAll(user.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not revoke login sessions: %s\n", err)
+		return
+	}
+
+	if revoked > 0 {
+		recordEvent(store.EventSessionsRevoked, user, nil, fmt.Sprintf("%d sessions revoked: %s", revoked, reason))
+		fmt.Printf("%d sessions revoked\n", revoked)
+	}
+}
+
+// Record a security event for an action taken from the command line.
+func recordEvent(eventType string, user *store.User, credentialID []byte, detail string) {
+	event := &store.SecurityEvent{
+		Type:         eventType,
+		UserID:       user.ID,
+		CredentialID: credentialID,
+		Detail:       detail + " (via cli)",
+	}
+
+	if err := db.RecordEvent(event); err != nil {
+		fmt.Fprintf(os.Stderr, "could not record security event: %s\n", err)
+	}
+}
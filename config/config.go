@@ -1,26 +1,42 @@
 package config
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bbengfort/yubikey/logger"
 	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
 	"github.com/rotationalio/confire"
 	"github.com/rs/zerolog"
 )
 
 type Config struct {
-	Maintenance  bool                `default:"false"`
-	BindAddr     string              `split_words:"true" default:":443"`
-	Mode         string              `default:"release"`
-	LogLevel     logger.LevelDecoder `split_words:"true" default:"info"`
-	ConsoleLog   bool                `split_words:"true" default:"false"`
-	AllowOrigins []string            `split_words:"true" default:"https://yubikey.local"`
-	WebAuthn     WebAuthnConfig      `split_words:"true"`
-	TLS          TLSConfig
-	processed    bool // set when the config is properly processed from the environment
+	Maintenance    bool                `default:"false"`
+	BindAddr       string              `split_words:"true" default:":443"`
+	Mode           string              `default:"release"`
+	LogLevel       logger.LevelDecoder `split_words:"true" default:"info"`
+	ConsoleLog     bool                `split_words:"true" default:"false"`
+	AllowOrigins   []string            `split_words:"true" default:"https://yubikey.local"`
+	TrustedProxies []string            `split_words:"true"`
+	WebAuthn       WebAuthnConfig      `split_words:"true"`
+	Database       DatabaseConfig
+	Metadata       MetadataConfig
+	Policy         PolicyConfig
+	Reauth         ReauthConfig
+	Session        SessionConfig
+	Token          TokenConfig
+	TLS            TLSConfig
+	processed      bool // set when the config is properly processed from the environment
 }
 
 type TLSConfig struct {
@@ -29,17 +45,136 @@ type TLSConfig struct {
 	KeyFile  string `split_words:"true" default:"tmp/server.key"`
 }
 
+// DatabaseConfig specifies the persistence backend for users and credentials. The URL
+// scheme selects the backend, e.g. memory:// or sqlite3:///path/to/yubikey.db
+// MasterKeys are base64 encoded 32 byte keys used to encrypt the store at rest; the
+// first key is the active key and any others are previous keys used during rotation.
+type DatabaseConfig struct {
+	URL        string   `default:"memory://"`
+	MasterKeys []string `split_words:"true"`
+}
+
+// MetadataConfig specifies a locally downloaded FIDO Metadata Service (MDS3) blob that
+// is used to verify the attestation of registered authenticators. If RootCert is not
+// specified, the blob is verified against the FIDO Alliance production root.
+type MetadataConfig struct {
+	Path     string
+	RootCert string `split_words:"true"`
+}
+
+// Returns true if a metadata blob has been configured.
+func (c MetadataConfig) Enabled() bool {
+	return c.Path != ""
+}
+
+// PolicyConfig specifies a JSON file containing the AAGUID allow/deny registration
+// policy. The file is reloaded on SIGHUP; if no path is specified any authenticator may
+// be registered.
+type PolicyConfig struct {
+	Path string
+}
+
+// ReauthConfig specifies how recently a user must have performed a WebAuthn assertion
+// before sensitive operations such as deleting credentials are allowed to proceed.
+type ReauthConfig struct {
+	Window           time.Duration `default:"5m"`
+	UserVerification bool          `split_words:"true" default:"true"`
+}
+
+// SessionConfig specifies how long a user remains logged in after a successful login,
+// the keys used to sign and encrypt the session cookie, and the cookie attributes. Keys
+// are hash:block key pairs of base64 encoded keys; the first pair is used to encode
+// cookies and any others are previous pairs that are still accepted during rotation. If
+// no keys are configured, a random pair is generated and sessions do not survive a
+// restart or work across multiple replicas. Session values are stored in the cookie
+// unless Store is server, in which case they are stored in the database for the TTL and
+// the cookie only holds the session ID.
+type SessionConfig struct {
+	Lifetime time.Duration `default:"12h"`
+	Keys     []string
+	Store    string        `default:"cookie"`
+	TTL      time.Duration `default:"24h"`
+	Cookie   CookieConfig
+}
+
+// Session stores specify where session values are kept.
+const (
+	SessionStoreCookie = "cookie"
+	SessionStoreServer = "server"
+)
+
+// CookieConfig specifies the attributes of the session cookie. SameSite is one of lax,
+// strict, none, or default (no attribute); a MaxAge of zero creates a cookie that is
+// deleted when the browser is closed. If Secure is not set, the cookie is secure if the
+// server uses TLS; it must be set explicitly if TLS is terminated by a proxy.
+type CookieConfig struct {
+	Domain   string
+	Path     string        `default:"/"`
+	MaxAge   time.Duration `split_words:"true" default:"720h"`
+	Secure   *bool
+	HTTPOnly bool   `split_words:"true" default:"true"`
+	SameSite string `split_words:"true" default:"lax"`
+}
+
+// Valid values of the cookie SameSite attribute.
+var SameSiteModes = map[string]http.SameSite{
+	"default": http.SameSiteDefaultMode,
+	"lax":     http.SameSiteLaxMode,
+	"strict":  http.SameSiteStrictMode,
+	"none":    http.SameSiteNoneMode,
+}
+
+// TokenConfig specifies whether signed JWT access tokens and rotating refresh tokens are
+// issued after a successful login so that other services can trust logins without the
+// session keys. Keys are paths to PEM encoded ECDSA, RSA, or Ed25519 private keys; the
+// first key signs tokens and the others are still published in the JWKS so that tokens
+// signed before a rotation can be verified. If no keys are configured, a random key is
+// generated and tokens cannot be verified after a restart.
+type TokenConfig struct {
+	Enabled    bool   `default:"false"`
+	Issuer     string `default:"https://yubikey.local"`
+	Audience   []string
+	AccessTTL  time.Duration `split_words:"true" default:"15m"`
+	RefreshTTL time.Duration `split_words:"true" default:"24h"`
+	Keys       []string
+}
+
 type WebAuthnConfig struct {
-	RPID        string   `default:"yubikey.local"`
-	DisplayName string   `split_words:"true" default:"Yubikey Authn Debugger"`
-	Origins     []string `default:"https://yubikey.local"`
+	RPID             string        `default:"yubikey.local"`
+	DisplayName      string        `split_words:"true" default:"Yubikey Authn Debugger"`
+	Origins          []string      `default:"https://yubikey.local"`
+	ClonePolicy      string        `split_words:"true" default:"warn"`
+	ResidentKey      string        `split_words:"true" default:"preferred"` // required, preferred, or discouraged
+	UserVerification string        `split_words:"true" default:"preferred"` // required, preferred, or discouraged
+	Attachment       string        // platform, cross-platform, or empty for any
+	Attestation      string        `default:"none"` // none, indirect, direct, or enterprise
+	Timeout          time.Duration `default:"5m"`   // time allowed to complete a ceremony
+	Algorithms       []string      `default:"ES256,ES384,ES512,RS256,RS384,RS512,PS256,PS384,PS512,EdDSA"`
+	Extensions       []string      `default:"credProps"` // credProps, credProtect, prf, and/or largeBlob
+	CredProtect      string        `split_words:"true" default:"userVerificationOptionalWithCredentialIDList"`
 }
 
+// Clone policies specify how the server responds when the sign counter of an
+// authenticator does not increase, indicating that the authenticator may be cloned.
+const (
+	ClonePolicyLog     = "log"     // record a security event and allow the login
+	ClonePolicyWarn    = "warn"    // record a security event and warn the user but allow the login
+	ClonePolicyReject  = "reject"  // record a security event and reject the login
+	ClonePolicyDisable = "disable" // record a security event, reject the login, and disable the credential
+)
+
 func New() (conf Config, err error) {
 	if err = confire.Process("yubikey", &conf); err != nil {
 		return Config{}, err
 	}
 
+	// Unless it is set explicitly, the session cookie is only secure if the server uses
+	// TLS, otherwise browsers would not send the cookie back over plain http.
+	if conf.Session.Cookie.Secure == nil {
+		secure := conf.TLS.UseTLS
+		conf.Session.Cookie.Secure = &secure
+	}
+
 	if err = conf.Validate(); err != nil {
 		return Config{}, err
 	}
@@ -60,6 +195,26 @@ func (c Config) Validate() (err error) {
 	if c.Mode != gin.ReleaseMode && c.Mode != gin.DebugMode && c.Mode != gin.TestMode {
 		return fmt.Errorf("invalid configuration: %q is not a valid gin mode", c.Mode)
 	}
+
+	if err = c.WebAuthn.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Database.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Reauth.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Session.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Token.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -79,10 +234,380 @@ func (c TLSConfig) Config() *tls.Config {
 	return nil
 }
 
+func (c ReauthConfig) Validate() error {
+	if c.Window <= 0 {
+		return fmt.Errorf("invalid configuration: reauthentication window must be greater than zero")
+	}
+	return nil
+}
+
+func (c SessionConfig) Validate() (err error) {
+	if c.Lifetime <= 0 {
+		return fmt.Errorf("invalid configuration: session lifetime must be greater than zero")
+	}
+
+	if c.Store != SessionStoreCookie && c.Store != SessionStoreServer {
+		return fmt.Errorf("invalid configuration: %q is not a valid session store, use cookie or server", c.Store)
+	}
+
+	if c.TTL <= 0 {
+		return fmt.Errorf("invalid configuration: session ttl must be greater than zero")
+	}
+
+	if _, err = c.KeyPairs(); err != nil {
+		return err
+	}
+	return c.Cookie.Validate()
+}
+
+// KeyPairs decodes the configured session keys into the alternating hash and block keys
+// expected by the cookie store.
+func (c SessionConfig) KeyPairs() (_ [][]byte, err error) {
+	pairs := make([][]byte, 0, 2*len(c.Keys))
+	for i, encoded := range c.Keys {
+		hashKey, blockKey, ok := strings.Cut(encoded, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid configuration: session key %d must be a hash:block key pair", i)
+		}
+
+		var hash, block []byte
+		if hash, err = base64.StdEncoding.DecodeString(hashKey); err != nil {
+			return nil, fmt.Errorf("invalid configuration: could not decode session hash key %d: %w", i, err)
+		}
+
+		if len(hash) < 32 {
+			return nil, fmt.Errorf("invalid configuration: session hash key %d must be at least 32 bytes", i)
+		}
+
+		if block, err = base64.StdEncoding.DecodeString(blockKey); err != nil {
+			return nil, fmt.Errorf("invalid configuration: could not decode session block key %d: %w", i, err)
+		}
+
+		if n := len(block); n != 16 && n != 24 && n != 32 {
+			return nil, fmt.Errorf("invalid configuration: session block key %d must be 16, 24, or 32 bytes", i)
+		}
+		pairs = append(pairs, hash, block)
+	}
+	return pairs, nil
+}
+
+func (c CookieConfig) Validate() error {
+	mode, ok := SameSiteModes[strings.ToLower(c.SameSite)]
+	if !ok {
+		return fmt.Errorf("invalid configuration: %q is not a valid cookie same site mode", c.SameSite)
+	}
+
+	// Secure is only nil before the default is applied from the TLS configuration.
+	if mode == http.SameSiteNoneMode && c.Secure != nil && !*c.Secure {
+		return fmt.Errorf("invalid configuration: cookies with same site mode none must be secure")
+	}
+
+	if c.MaxAge < 0 {
+		return fmt.Errorf("invalid configuration: cookie max age cannot be negative")
+	}
+	return nil
+}
+
+// IsSecure returns true if the cookie should only be sent over https.
+func (c CookieConfig) IsSecure() bool {
+	return c.Secure != nil && *c.Secure
+}
+
+// Options returns the session cookie options; the configuration must be valid.
+func (c CookieConfig) Options() *sessions.Options {
+	return &sessions.Options{
+		Domain:   c.Domain,
+		Path:     c.Path,
+		MaxAge:   int(c.MaxAge.Seconds()),
+		Secure:   c.IsSecure(),
+		HttpOnly: c.HTTPOnly,
+		SameSite: SameSiteModes[strings.ToLower(c.SameSite)],
+	}
+}
+
+func (c TokenConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.Issuer == "" {
+		return fmt.Errorf("invalid configuration: token issuer is required")
+	}
+
+	if c.AccessTTL <= 0 {
+		return fmt.Errorf("invalid configuration: access token ttl must be greater than zero")
+	}
+
+	if c.RefreshTTL <= 0 {
+		return fmt.Errorf("invalid configuration: refresh token ttl must be greater than zero")
+	}
+	return nil
+}
+
+func (c DatabaseConfig) Validate() (err error) {
+	_, err = c.Keys()
+	return err
+}
+
+// Keys decodes the master keys used to encrypt the store at rest.
+func (c DatabaseConfig) Keys() (_ [][]byte, err error) {
+	keys := make([][]byte, 0, len(c.MasterKeys))
+	for i, encoded := range c.MasterKeys {
+		var key []byte
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("invalid configuration: could not decode master key %d: %w", i, err)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid configuration: master key %d must be 32 bytes", i)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Valid values of the authenticator selection and attestation options, used to validate
+// both the configuration and the per-request overrides in the registration form.
+var (
+	ResidentKeyRequirements      = []string{"required", "preferred", "discouraged"}
+	UserVerificationRequirements = []string{"required", "preferred", "discouraged"}
+	Attachments                  = []string{"", "platform", "cross-platform"}
+	ConveyancePreferences        = []string{"none", "indirect", "direct", "enterprise"}
+)
+
+// WebAuthn extensions that can be requested from the client and authenticator.
+const (
+	ExtensionCredProps   = "credProps"
+	ExtensionCredProtect = "credProtect"
+	ExtensionPRF         = "prf"
+	ExtensionLargeBlob   = "largeBlob"
+)
+
+// Valid extensions and credential protection policies; the index of a protection policy
+// is one less than the credProtect level returned by the authenticator.
+var (
+	Extensions          = []string{ExtensionCredProps, ExtensionCredProtect, ExtensionPRF, ExtensionLargeBlob}
+	CredProtectPolicies = []string{"userVerificationOptional", "userVerificationOptionalWithCredentialIDList", "userVerificationRequired"}
+)
+
+// PRFSalt is evaluated by the prf extension during login; the result is not stored, it
+// only demonstrates that the authenticator can evaluate the PRF for the credential.
+var PRFSalt = sha256.Sum256([]byte("yubikey authn debugger prf salt"))
+
+// CredProtectName returns the name of the credential protection policy of the level
+// returned by the authenticator or an empty string if the level is unknown.
+func CredProtectName(level int) string {
+	if level < 1 || level > len(CredProtectPolicies) {
+		return ""
+	}
+	return CredProtectPolicies[level-1]
+}
+
+// COSEAlgorithms maps the names of the supported public key algorithms to their COSE
+// algorithm identifiers.
+var COSEAlgorithms = map[string]webauthncose.COSEAlgorithmIdentifier{
+	"ES256":  webauthncose.AlgES256,
+	"ES384":  webauthncose.AlgES384,
+	"ES512":  webauthncose.AlgES512,
+	"ES256K": webauthncose.AlgES256K,
+	"RS1":    webauthncose.AlgRS1,
+	"RS256":  webauthncose.AlgRS256,
+	"RS384":  webauthncose.AlgRS384,
+	"RS512":  webauthncose.AlgRS512,
+	"PS256":  webauthncose.AlgPS256,
+	"PS384":  webauthncose.AlgPS384,
+	"PS512":  webauthncose.AlgPS512,
+	"EdDSA":  webauthncose.AlgEdDSA,
+}
+
+// ParseAlgorithm returns the COSE algorithm identifier of the named algorithm; names are
+// case insensitive.
+func ParseAlgorithm(name string) (webauthncose.COSEAlgorithmIdentifier, error) {
+	for algName, alg := range COSEAlgorithms {
+		if strings.EqualFold(name, algName) {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a supported public key algorithm", name)
+}
+
+// AlgorithmName returns the name of the COSE algorithm identifier, or the identifier
+// itself if the algorithm is not known.
+func AlgorithmName(alg int64) string {
+	for name, id := range COSEAlgorithms {
+		if int64(id) == alg {
+			return name
+		}
+	}
+	return strconv.FormatInt(alg, 10)
+}
+
+func (c WebAuthnConfig) Validate() (err error) {
+	switch c.ClonePolicy {
+	case ClonePolicyLog, ClonePolicyWarn, ClonePolicyReject, ClonePolicyDisable:
+	default:
+		return fmt.Errorf("invalid configuration: %q is not a valid clone policy", c.ClonePolicy)
+	}
+
+	if err = ValidateChoice("resident key requirement", c.ResidentKey, ResidentKeyRequirements); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err = ValidateChoice("user verification requirement", c.UserVerification, UserVerificationRequirements); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err = ValidateChoice("authenticator attachment", c.Attachment, Attachments); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err = ValidateChoice("attestation conveyance preference", c.Attestation, ConveyancePreferences); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid configuration: timeout must be greater than zero")
+	}
+
+	for _, extension := range c.Extensions {
+		if err = ValidateChoice("extension", extension, Extensions); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+
+	if err = ValidateChoice("credential protection policy", c.CredProtect, CredProtectPolicies); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if len(c.Algorithms) == 0 {
+		return fmt.Errorf("invalid configuration: at least one public key algorithm is required")
+	}
+
+	seen := make(map[webauthncose.COSEAlgorithmIdentifier]struct{}, len(c.Algorithms))
+	for _, name := range c.Algorithms {
+		var alg webauthncose.COSEAlgorithmIdentifier
+		if alg, err = ParseAlgorithm(name); err != nil {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+
+		if _, ok := seen[alg]; ok {
+			return fmt.Errorf("invalid configuration: public key algorithm %q is duplicated", name)
+		}
+		seen[alg] = struct{}{}
+	}
+	return nil
+}
+
+// ValidateChoice returns an error if the value is not one of the valid options.
+func ValidateChoice(name, value string, valid []string) error {
+	for _, option := range valid {
+		if value == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a valid %s", value, name)
+}
+
 func (c WebAuthnConfig) Config() *webauthn.Config {
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    c.Timeout,
+		TimeoutUVD: c.Timeout,
+	}
+
 	return &webauthn.Config{
-		RPID:          c.RPID,
-		RPDisplayName: c.DisplayName,
-		RPOrigins:     c.Origins,
+		RPID:                   c.RPID,
+		RPDisplayName:          c.DisplayName,
+		RPOrigins:              c.Origins,
+		AttestationPreference:  protocol.ConveyancePreference(c.Attestation),
+		AuthenticatorSelection: c.AuthenticatorSelection(),
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	}
+}
+
+// CredentialParameters returns the public key algorithms that are acceptable for new
+// credentials in order of preference. Invalid algorithm names are skipped, they should
+// be caught when the configuration is validated.
+func (c WebAuthnConfig) CredentialParameters() []protocol.CredentialParameter {
+	params := make([]protocol.CredentialParameter, 0, len(c.Algorithms))
+	for _, name := range c.Algorithms {
+		if alg, err := ParseAlgorithm(name); err == nil {
+			params = append(params, protocol.CredentialParameter{
+				Type:      protocol.PublicKeyCredentialType,
+				Algorithm: alg,
+			})
+		}
+	}
+	return params
+}
+
+// RegistrationExtensions returns the inputs of the configured extensions that are sent
+// to the client when registering a new credential or nil if no extensions are enabled.
+func (c WebAuthnConfig) RegistrationExtensions() protocol.AuthenticationExtensions {
+	if len(c.Extensions) == 0 {
+		return nil
+	}
+
+	extensions := make(protocol.AuthenticationExtensions, len(c.Extensions))
+	for _, extension := range c.Extensions {
+		switch extension {
+		case ExtensionCredProps:
+			extensions["credProps"] = true
+		case ExtensionCredProtect:
+			extensions["credentialProtectionPolicy"] = c.CredProtect
+			extensions["enforceCredentialProtectionPolicy"] = false
+		case ExtensionPRF:
+			extensions["prf"] = map[string]interface{}{}
+		case ExtensionLargeBlob:
+			extensions["largeBlob"] = map[string]interface{}{"support": "preferred"}
+		}
+	}
+	return extensions
+}
+
+// LoginExtensions returns the inputs of the configured extensions that are sent to the
+// client when logging in or nil if no login extensions are enabled. Binary inputs are
+// base64 URL encoded and must be decoded by the client.
+func (c WebAuthnConfig) LoginExtensions() protocol.AuthenticationExtensions {
+	extensions := make(protocol.AuthenticationExtensions)
+	for _, extension := range c.Extensions {
+		switch extension {
+		case ExtensionPRF:
+			extensions["prf"] = map[string]interface{}{
+				"eval": map[string]interface{}{"first": base64.RawURLEncoding.EncodeToString(PRFSalt[:])},
+			}
+		case ExtensionLargeBlob:
+			extensions["largeBlob"] = map[string]interface{}{"read": true}
+		}
+	}
+
+	if len(extensions) == 0 {
+		return nil
+	}
+	return extensions
+}
+
+// AcceptsAlgorithm returns true if the COSE algorithm is one of the configured algorithms.
+func (c WebAuthnConfig) AcceptsAlgorithm(alg int64) bool {
+	for _, param := range c.CredentialParameters() {
+		if int64(param.Algorithm) == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticatorSelection returns the default authenticator selection criteria that are
+// sent to the client when registering a new credential.
+func (c WebAuthnConfig) AuthenticatorSelection() protocol.AuthenticatorSelection {
+	requireResidentKey := c.ResidentKey == string(protocol.ResidentKeyRequirementRequired)
+	return protocol.AuthenticatorSelection{
+		AuthenticatorAttachment: protocol.AuthenticatorAttachment(c.Attachment),
+		RequireResidentKey:      &requireResidentKey,
+		ResidentKey:             protocol.ResidentKeyRequirement(c.ResidentKey),
+		UserVerification:        protocol.UserVerificationRequirement(c.UserVerification),
 	}
 }
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+func TestCookieSecure(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected bool
+		err      bool
+	}{
+		{"default", nil, false, false},
+		{"tls", map[string]string{"YUBIKEY_TLS_USE_TLS": "true"}, true, false},
+		{"proxy", map[string]string{"YUBIKEY_SESSION_COOKIE_SECURE": "true"}, true, false},
+		{"tls not secure", map[string]string{"YUBIKEY_TLS_USE_TLS": "true", "YUBIKEY_SESSION_COOKIE_SECURE": "false"}, false, false},
+		{"same site none", map[string]string{"YUBIKEY_SESSION_COOKIE_SAME_SITE": "none"}, false, true},
+		{"same site none with tls", map[string]string{"YUBIKEY_TLS_USE_TLS": "true", "YUBIKEY_SESSION_COOKIE_SAME_SITE": "none"}, true, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, val := range tc.env {
+				t.Setenv(key, val)
+			}
+
+			conf, err := New()
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected a configuration error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if secure := conf.Session.Cookie.Options().Secure; secure != tc.expected {
+				t.Errorf("expected secure cookie %t, got %t", tc.expected, secure)
+			}
+		})
+	}
+}
+
+func TestWebAuthnValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*WebAuthnConfig)
+		valid  bool
+	}{
+		{"default", func(*WebAuthnConfig) {}, true},
+		{"resident key required", func(c *WebAuthnConfig) { c.ResidentKey = "required" }, true},
+		{"invalid resident key", func(c *WebAuthnConfig) { c.ResidentKey = "always" }, false},
+		{"user verification required", func(c *WebAuthnConfig) { c.UserVerification = "required" }, true},
+		{"invalid user verification", func(c *WebAuthnConfig) { c.UserVerification = "never" }, false},
+		{"platform attachment", func(c *WebAuthnConfig) { c.Attachment = "platform" }, true},
+		{"invalid attachment", func(c *WebAuthnConfig) { c.Attachment = "usb" }, false},
+		{"direct attestation", func(c *WebAuthnConfig) { c.Attestation = "direct" }, true},
+		{"invalid attestation", func(c *WebAuthnConfig) { c.Attestation = "self" }, false},
+		{"no timeout", func(c *WebAuthnConfig) { c.Timeout = 0 }, false},
+		{"algorithms", func(c *WebAuthnConfig) { c.Algorithms = []string{"eddsa", "ES256"} }, true},
+		{"no algorithms", func(c *WebAuthnConfig) { c.Algorithms = nil }, false},
+		{"unknown algorithm", func(c *WebAuthnConfig) { c.Algorithms = []string{"ES256", "HS256"} }, false},
+		{"duplicate algorithm", func(c *WebAuthnConfig) { c.Algorithms = []string{"ES256", "es256"} }, false},
+		{"extensions", func(c *WebAuthnConfig) { c.Extensions = Extensions }, true},
+		{"no extensions", func(c *WebAuthnConfig) { c.Extensions = nil }, true},
+		{"unknown extension", func(c *WebAuthnConfig) { c.Extensions = []string{"appid"} }, false},
+		{"invalid cred protect", func(c *WebAuthnConfig) { c.CredProtect = "required" }, false},
+	}
+
+	defaults, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tests {
+		conf := defaults.WebAuthn
+		tc.modify(&conf)
+		if err := conf.Validate(); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %t, got %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestAuthenticatorSelection(t *testing.T) {
+	tests := []struct {
+		residentKey      string
+		userVerification string
+		attachment       string
+		requireRK        bool
+	}{
+		{"preferred", "preferred", "", false},
+		{"required", "required", "cross-platform", true},
+		{"discouraged", "discouraged", "platform", false},
+	}
+
+	for _, tc := range tests {
+		conf := WebAuthnConfig{ResidentKey: tc.residentKey, UserVerification: tc.userVerification, Attachment: tc.attachment}
+		selection := conf.AuthenticatorSelection()
+
+		if string(selection.ResidentKey) != tc.residentKey || string(selection.UserVerification) != tc.userVerification || string(selection.AuthenticatorAttachment) != tc.attachment {
+			t.Errorf("%s resident key: unexpected selection %+v", tc.residentKey, selection)
+		}
+
+		// requireResidentKey is set for clients that only support level 1
+		if selection.RequireResidentKey == nil || *selection.RequireResidentKey != tc.requireRK {
+			t.Errorf("%s resident key: expected require resident key %t", tc.residentKey, tc.requireRK)
+		}
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	conf := WebAuthnConfig{Algorithms: []string{"EdDSA", "es256", "RS256"}}
+	expected := []webauthncose.COSEAlgorithmIdentifier{webauthncose.AlgEdDSA, webauthncose.AlgES256, webauthncose.AlgRS256}
+
+	params := conf.CredentialParameters()
+	if len(params) != len(expected) {
+		t.Fatalf("expected %d credential parameters, got %d", len(expected), len(params))
+	}
+
+	for i, param := range params {
+		if param.Algorithm != expected[i] || param.Type != protocol.PublicKeyCredentialType {
+			t.Errorf("expected parameter %d to be %d, got %+v", i, expected[i], param)
+		}
+
+		if !conf.AcceptsAlgorithm(int64(expected[i])) {
+			t.Errorf("expected algorithm %d to be accepted", expected[i])
+		}
+	}
+
+	if conf.AcceptsAlgorithm(int64(webauthncose.AlgES384)) {
+		t.Error("expected an algorithm that was not configured to be rejected")
+	}
+
+	names := []struct {
+		alg  int64
+		name string
+	}{
+		{int64(webauthncose.AlgES256), "ES256"},
+		{int64(webauthncose.AlgEdDSA), "EdDSA"},
+		{int64(webauthncose.AlgPS512), "PS512"},
+		{-65535, "RS1"},
+		{42, "42"},
+	}
+
+	for _, tc := range names {
+		if name := AlgorithmName(tc.alg); name != tc.name {
+			t.Errorf("expected algorithm %d to be named %q, got %q", tc.alg, tc.name, name)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	tests := []struct {
+		extensions   []string
+		registration []string
+		login        []string
+	}{
+		{nil, nil, nil},
+		{[]string{ExtensionCredProps}, []string{"credProps"}, nil},
+		{[]string{ExtensionCredProtect}, []string{"credentialProtectionPolicy", "enforceCredentialProtectionPolicy"}, nil},
+		{[]string{ExtensionPRF}, []string{"prf"}, []string{"prf"}},
+		{[]string{ExtensionLargeBlob}, []string{"largeBlob"}, []string{"largeBlob"}},
+		{Extensions, []string{"credProps", "credentialProtectionPolicy", "enforceCredentialProtectionPolicy", "prf", "largeBlob"}, []string{"prf", "largeBlob"}},
+	}
+
+	for _, tc := range tests {
+		conf := WebAuthnConfig{Extensions: tc.extensions, CredProtect: "userVerificationRequired"}
+		registration := conf.RegistrationExtensions()
+		if len(registration) != len(tc.registration) {
+			t.Errorf("%v: expected %d registration extensions, got %d", tc.extensions, len(tc.registration), len(registration))
+		}
+
+		for _, key := range tc.registration {
+			if _, ok := registration[key]; !ok {
+				t.Errorf("%v: expected registration extension %q", tc.extensions, key)
+			}
+		}
+
+		login := conf.LoginExtensions()
+		if len(login) != len(tc.login) {
+			t.Errorf("%v: expected %d login extensions, got %d", tc.extensions, len(tc.login), len(login))
+		}
+
+		for _, key := range tc.login {
+			if _, ok := login[key]; !ok {
+				t.Errorf("%v: expected login extension %q", tc.extensions, key)
+			}
+		}
+
+		if policy, ok := registration["credentialProtectionPolicy"]; ok && policy != "userVerificationRequired" {
+			t.Errorf("%v: expected the configured credential protection policy, got %v", tc.extensions, policy)
+		}
+	}
+
+	for level, name := range map[int]string{0: "", 1: CredProtectPolicies[0], 3: CredProtectPolicies[2], 4: ""} {
+		if actual := CredProtectName(level); actual != name {
+			t.Errorf("expected credProtect level %d to be %q, got %q", level, name, actual)
+		}
+	}
+}
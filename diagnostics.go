@@ -0,0 +1,79 @@
+package yubikey
+
+import (
+	"net/http"
+	"sort"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/config"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// AlgorithmDiagnostics returns the public key algorithms chosen by each authenticator
+// model along with the configured algorithm preferences.
+func (s *Server) AlgorithmDiagnostics(c *gin.Context) {
+	report, err := s.algorithmReport()
+	if err != nil {
+		log.Error().Err(err).Msg("could not create algorithm report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create algorithm report"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// Count the registered credentials of each authenticator model by public key algorithm.
+func (s *Server) algorithmReport() (_ *v1.AlgorithmReport, err error) {
+	report := &v1.AlgorithmReport{
+		Preferred:      make([]string, 0, len(s.conf.WebAuthn.Algorithms)),
+		Authenticators: make([]*v1.AuthenticatorAlgorithms, 0),
+	}
+
+	preference := make(map[int64]int, len(s.conf.WebAuthn.Algorithms))
+	for i, param := range s.conf.WebAuthn.CredentialParameters() {
+		alg := int64(param.Algorithm)
+		preference[alg] = i + 1
+		report.Preferred = append(report.Preferred, config.AlgorithmName(alg))
+	}
+
+	users, err := s.users.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	models := make(map[uuid.UUID]*v1.AuthenticatorAlgorithms)
+	counts := make(map[uuid.UUID]map[int64]*v1.AlgorithmCount)
+	for _, user := range users {
+		for _, cred := range user.Credentials() {
+			aaguid := cred.AAGUID()
+			model, ok := models[aaguid]
+			if !ok {
+				model = &v1.AuthenticatorAlgorithms{
+					AAGUID:        aaguid.String(),
+					Authenticator: cred.AuthenticatorName(),
+				}
+				models[aaguid] = model
+				counts[aaguid] = make(map[int64]*v1.AlgorithmCount)
+				report.Authenticators = append(report.Authenticators, model)
+			}
+
+			alg := cred.KeyAlgorithm()
+			count, ok := counts[aaguid][alg]
+			if !ok {
+				count = &v1.AlgorithmCount{
+					Algorithm:  config.AlgorithmName(alg),
+					Preference: preference[alg],
+				}
+				counts[aaguid][alg] = count
+				model.Algorithms = append(model.Algorithms, count)
+			}
+			count.Credentials++
+		}
+	}
+
+	sort.Slice(report.Authenticators, func(i, j int) bool {
+		return report.Authenticators[i].Authenticator < report.Authenticators[j].Authenticator
+	})
+	return report, nil
+}
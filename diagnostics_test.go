@@ -0,0 +1,62 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+func TestAlgorithmReport(t *testing.T) {
+	s := newTestServer(t, config.Config{WebAuthn: config.WebAuthnConfig{Algorithms: []string{"EdDSA", "ES256"}}})
+	for _, email := range []string{"jane@example.com", "john@example.com"} {
+		user, err := s.users.NewUser("Test User", email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The algorithm is parsed from the public key if it was not recorded
+		if err = s.users.AddCredential(user, newTestAuthenticator(t).credential(t)); err != nil {
+			t.Fatal(err)
+		}
+
+		cred := newTestAuthenticator(t).credential(t)
+		cred.Algorithm = int64(webauthncose.AlgRS256)
+		if err = s.users.AddCredential(user, cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.algorithmReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Preferred) != 2 || report.Preferred[0] != "EdDSA" || report.Preferred[1] != "ES256" {
+		t.Errorf("expected the preferred algorithms in order, got %v", report.Preferred)
+	}
+
+	if len(report.Authenticators) != 1 {
+		t.Fatalf("expected credentials to be grouped by authenticator model, got %d models", len(report.Authenticators))
+	}
+
+	expected := []struct {
+		algorithm   string
+		preference  int
+		credentials int
+	}{
+		{"ES256", 2, 2},
+		{"RS256", 0, 2},
+	}
+
+	algorithms := report.Authenticators[0].Algorithms
+	if len(algorithms) != len(expected) {
+		t.Fatalf("expected %d algorithms, got %d", len(expected), len(algorithms))
+	}
+
+	for i, tc := range expected {
+		if alg := algorithms[i]; alg.Algorithm != tc.algorithm || alg.Preference != tc.preference || alg.Credentials != tc.credentials {
+			t.Errorf("expected %s with preference %d and %d credentials, got %+v", tc.algorithm, tc.preference, tc.credentials, alg)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package yubikey
+
+import "errors"
+
+var (
+	ErrCredentialRevoked    = errors.New("credential has been revoked")
+	ErrClonedAuthenticator  = errors.New("authenticator may be cloned")
+	ErrAttestationRejected  = errors.New("authenticator attestation rejected")
+	ErrPolicyRejected       = errors.New("authenticator not permitted by registration policy")
+	ErrReauthRequired       = errors.New("reauthentication required")
+	ErrNotAuthenticated     = errors.New("login required")
+	ErrNotAuthorized        = errors.New("not permitted to access this user")
+	ErrUnrequestedAlgorithm = errors.New("authenticator chose a public key algorithm that was not requested")
+	ErrTokensDisabled       = errors.New("token issuance is not enabled")
+)
@@ -0,0 +1,73 @@
+package yubikey
+
+import (
+	"net/http"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// ListUserEvents returns the security events recorded for the user in the URL.
+func (s *Server) ListUserEvents(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+
+	events, err := s.users.ListEvents(user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("could not list security events")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list security events"})
+		return
+	}
+
+	out := &v1.SecurityEventList{Events: make([]*v1.SecurityEvent, 0, len(events))}
+	for _, event := range events {
+		out.Events = append(out.Events, eventReply(event))
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// Record a security event for the user and credential, logging it as a warning so that
+// it is also visible in the server logs. Errors are logged rather than returned so that
+// failing to record the event does not change the outcome of the request.
+func (s *Server) securityEvent(c *gin.Context, eventType string, user *store.User, credentialID []byte, detail string) {
+	event := &store.SecurityEvent{
+		Type:         eventType,
+		UserID:       user.ID,
+		CredentialID: credentialID,
+		ClientIP:     c.ClientIP(),
+		Detail:       detail,
+	}
+
+	log.Warn().
+		Str("security_event", eventType).
+		Str("user_id", user.ID.String()).
+		Str("credential_id", store.EncodeKeyID(credentialID)).
+		Str("client_ip", event.ClientIP).
+		Msg(detail)
+
+	if err := s.users.RecordEvent(event); err != nil {
+		log.Error().Err(err).Str("security_event", eventType).Msg("could not record security event")
+	}
+}
+
+// eventReply converts a stored security event into its API representation.
+func eventReply(event *store.SecurityEvent) *v1.SecurityEvent {
+	out := &v1.SecurityEvent{
+		ID:       event.ID.String(),
+		Type:     event.Type,
+		UserID:   event.UserID.String(),
+		ClientIP: event.ClientIP,
+		Detail:   event.Detail,
+		Created:  event.Created.Format(time.RFC3339),
+	}
+
+	if len(event.CredentialID) > 0 {
+		out.CredentialID = store.EncodeKeyID(event.CredentialID)
+	}
+	return out
+}
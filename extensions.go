@@ -0,0 +1,55 @@
+package yubikey
+
+import (
+	"github.com/bbengfort/yubikey/store"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+// Update the extension results of a credential from the client extension outputs and
+// the authenticator extension outputs in the authenticator data. Extensions that were
+// not processed by the client or authenticator do not modify the stored results.
+func updateExtensions(ext *store.CredentialExtensions, results protocol.AuthenticationExtensionsClientOutputs, extData []byte) {
+	// credProps is only returned during registration
+	if credProps, ok := results["credProps"].(map[string]interface{}); ok {
+		if rk, ok := credProps["rk"].(bool); ok {
+			ext.ResidentKey = &rk
+		}
+	}
+
+	// prf returns enabled during registration and the evaluated results during login
+	if prf, ok := results["prf"].(map[string]interface{}); ok {
+		if enabled, ok := prf["enabled"].(bool); ok {
+			ext.PRF = enabled
+		}
+
+		if _, ok := prf["results"]; ok {
+			ext.PRF = true
+		}
+	}
+
+	// largeBlob returns supported during registration and the blob (if any) during login
+	if largeBlob, ok := results["largeBlob"].(map[string]interface{}); ok {
+		if supported, ok := largeBlob["supported"].(bool); ok {
+			ext.LargeBlob = supported
+		}
+
+		if _, ok := largeBlob["blob"]; ok {
+			ext.LargeBlob = true
+		}
+	}
+
+	// credProtect is an authenticator extension returned in the authenticator data
+	if len(extData) > 0 {
+		outputs := make(map[string]interface{})
+		if err := cbor.Unmarshal(extData, &outputs); err != nil {
+			log.Debug().Err(err).Msg("could not parse authenticator extension outputs")
+			return
+		}
+
+		if level, ok := outputs["credProtect"].(uint64); ok {
+			ext.CredProtect = int(level)
+		}
+	}
+}
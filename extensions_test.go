@@ -0,0 +1,48 @@
+package yubikey
+
+import (
+	"testing"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+func TestUpdateExtensions(t *testing.T) {
+	credProtect, err := cbor.Marshal(map[string]interface{}{"credProtect": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rk := true
+	tests := []struct {
+		name     string
+		stored   store.CredentialExtensions
+		results  protocol.AuthenticationExtensionsClientOutputs
+		extData  []byte
+		expected store.CredentialExtensions
+	}{
+		{"none", store.CredentialExtensions{}, nil, nil, store.CredentialExtensions{}},
+		{"cred props", store.CredentialExtensions{}, protocol.AuthenticationExtensionsClientOutputs{"credProps": map[string]interface{}{"rk": true}}, nil, store.CredentialExtensions{ResidentKey: &rk}},
+		{"prf enabled", store.CredentialExtensions{}, protocol.AuthenticationExtensionsClientOutputs{"prf": map[string]interface{}{"enabled": true}}, nil, store.CredentialExtensions{PRF: true}},
+		{"prf results", store.CredentialExtensions{}, protocol.AuthenticationExtensionsClientOutputs{"prf": map[string]interface{}{"results": map[string]interface{}{}}}, nil, store.CredentialExtensions{PRF: true}},
+		{"large blob supported", store.CredentialExtensions{}, protocol.AuthenticationExtensionsClientOutputs{"largeBlob": map[string]interface{}{"supported": true}}, nil, store.CredentialExtensions{LargeBlob: true}},
+		{"large blob read", store.CredentialExtensions{}, protocol.AuthenticationExtensionsClientOutputs{"largeBlob": map[string]interface{}{"blob": "AA"}}, nil, store.CredentialExtensions{LargeBlob: true}},
+		{"cred protect", store.CredentialExtensions{}, nil, credProtect, store.CredentialExtensions{CredProtect: 3}},
+		{"invalid authenticator outputs", store.CredentialExtensions{CredProtect: 2}, nil, []byte{0xff}, store.CredentialExtensions{CredProtect: 2}},
+		{"not processed", store.CredentialExtensions{ResidentKey: &rk, PRF: true, LargeBlob: true, CredProtect: 2}, protocol.AuthenticationExtensionsClientOutputs{}, nil, store.CredentialExtensions{ResidentKey: &rk, PRF: true, LargeBlob: true, CredProtect: 2}},
+	}
+
+	for _, tc := range tests {
+		ext := tc.stored
+		updateExtensions(&ext, tc.results, tc.extData)
+
+		if (ext.ResidentKey == nil) != (tc.expected.ResidentKey == nil) || (ext.ResidentKey != nil && *ext.ResidentKey != *tc.expected.ResidentKey) {
+			t.Errorf("%s: expected resident key %v, got %v", tc.name, tc.expected.ResidentKey, ext.ResidentKey)
+		}
+
+		if ext.PRF != tc.expected.PRF || ext.LargeBlob != tc.expected.LargeBlob || ext.CredProtect != tc.expected.CredProtect {
+			t.Errorf("%s: expected extensions %+v, got %+v", tc.name, tc.expected, ext)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package mds
+
+import "errors"
+
+var (
+	ErrNoCertificateChain            = errors.New("metadata blob does not contain an x5c certificate chain")
+	ErrInvalidRoot                   = errors.New("could not parse metadata root certificate")
+	ErrUndesiredStatus               = errors.New("authenticator has an undesired metadata status")
+	ErrInvalidAttestation            = errors.New("attestation certificate does not chain to a metadata root certificate")
+	ErrInvalidAttestationCertificate = errors.New("could not parse attestation certificate")
+)
@@ -0,0 +1,266 @@
+package mds
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Metadata is an index of FIDO Metadata Service (MDS3) entries by AAGUID that is loaded
+// from a locally downloaded blob so that the attestation of registered authenticators
+// can be verified without calling out to the network.
+type Metadata struct {
+	Number     int
+	NextUpdate string
+	entries    map[uuid.UUID]*Entry
+}
+
+// Entry is the subset of an MDS3 metadata BLOB payload entry that is used to verify
+// attestation statements and the status of an authenticator model.
+type Entry struct {
+	AAGUID                 string         `json:"aaguid"`
+	MetadataStatement      Statement      `json:"metadataStatement"`
+	StatusReports          []StatusReport `json:"statusReports"`
+	TimeOfLastStatusChange string         `json:"timeOfLastStatusChange"`
+}
+
+// Statement describes the authenticator model and the trust anchors of its attestation.
+type Statement struct {
+	Description                 string   `json:"description"`
+	AuthenticatorVersion        uint32   `json:"authenticatorVersion"`
+	ProtocolFamily              string   `json:"protocolFamily"`
+	AttestationTypes            []string `json:"attestationTypes"`
+	AttestationRootCertificates []string `json:"attestationRootCertificates"`
+}
+
+// StatusReport is a certification or security status of the authenticator model.
+type StatusReport struct {
+	Status               metadata.AuthenticatorStatus `json:"status"`
+	EffectiveDate        string                       `json:"effectiveDate"`
+	AuthenticatorVersion uint32                       `json:"authenticatorVersion"`
+	URL                  string                       `json:"url"`
+}
+
+// The claims of the signed metadata BLOB.
+type payload struct {
+	jwt.RegisteredClaims
+	LegalHeader string   `json:"legalHeader"`
+	Number      int      `json:"no"`
+	NextUpdate  string   `json:"nextUpdate"`
+	Entries     []*Entry `json:"entries"`
+}
+
+// Load the MDS3 JWT blob at the specified path, verifying its signature with the
+// certificate chain in the x5c header, which must chain to the specified root
+// certificate (DER encoded). Note that certificate revocation lists are not checked
+// since the metadata must be loaded without network access.
+func Load(path string, root []byte) (_ *Metadata, err error) {
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+
+	var rootCert *x509.Certificate
+	if rootCert, err = x509.ParseCertificate(root); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRoot, err)
+	}
+
+	claims := &payload{}
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		return verifyChain(token, rootCert)
+	}
+
+	if _, err = jwt.ParseWithClaims(string(data), claims, keyfunc, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"})); err != nil {
+		return nil, fmt.Errorf("could not verify metadata blob: %w", err)
+	}
+
+	mds := &Metadata{
+		Number:     claims.Number,
+		NextUpdate: claims.NextUpdate,
+		entries:    make(map[uuid.UUID]*Entry, len(claims.Entries)),
+	}
+
+	// Only FIDO2 authenticators are identified by an AAGUID; U2F and UAF entries are skipped.
+	for _, entry := range claims.Entries {
+		var aaguid uuid.UUID
+		if aaguid, err = uuid.Parse(entry.AAGUID); err != nil {
+			continue
+		}
+		mds.entries[aaguid] = entry
+	}
+
+	if next, err := time.Parse("2006-01-02", mds.NextUpdate); err == nil && next.Before(time.Now()) {
+		log.Warn().Str("next_update", mds.NextUpdate).Msg("metadata blob is out of date, download a new blob from the metadata service")
+	}
+
+	log.Info().Int("no", mds.Number).Int("entries", len(mds.entries)).Msg("fido metadata loaded")
+	return mds, nil
+}
+
+// LoadRoot reads a PEM or DER encoded root certificate from the specified path; if the
+// path is empty the root of the production FIDO Metadata Service is returned.
+func LoadRoot(path string) (_ []byte, err error) {
+	if path == "" {
+		return base64.StdEncoding.DecodeString(metadata.ProductionMDSRoot)
+	}
+
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	return data, nil
+}
+
+// Verify that the x5c certificate chain in the JWT header chains to the root and return
+// the public key of the signing certificate to verify the signature of the blob.
+func verifyChain(token *jwt.Token, root *x509.Certificate) (_ interface{}, err error) {
+	x5c, ok := token.Header["x5c"].([]interface{})
+	if !ok || len(x5c) == 0 {
+		return nil, ErrNoCertificateChain
+	}
+
+	certs := make([]*x509.Certificate, 0, len(x5c))
+	for _, item := range x5c {
+		encoded, ok := item.(string)
+		if !ok {
+			return nil, ErrNoCertificateChain
+		}
+
+		var der []byte
+		if der, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, err
+		}
+
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(der); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if err = verifyCertificate(certs[0], certs[1:], []*x509.Certificate{root}); err != nil {
+		return nil, err
+	}
+	return certs[0].PublicKey, nil
+}
+
+func verifyCertificate(leaf *x509.Certificate, intermediates, roots []*x509.Certificate) (err error) {
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	for _, cert := range intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	for _, cert := range roots {
+		opts.Roots.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(opts)
+	return err
+}
+
+// Lookup the metadata entry for the authenticator model with the specified AAGUID.
+func (m *Metadata) Lookup(aaguid uuid.UUID) (entry *Entry, ok bool) {
+	entry, ok = m.entries[aaguid]
+	return entry, ok
+}
+
+// Len returns the number of authenticator models in the metadata.
+func (m *Metadata) Len() int {
+	return len(m.entries)
+}
+
+// Result of verifying an attestation statement against the metadata.
+type Result struct {
+	Entry    *Entry // the metadata entry of the authenticator model or nil if unknown
+	Verified bool   // true if the attestation certificate chains to a metadata root
+}
+
+// Verify the attestation of a newly registered credential against the metadata. If the
+// most recent status report of the authenticator model is undesired (e.g. revoked or
+// compromised) or if the attestation certificate chain (x5c) does not chain to one of
+// the attestation root certificates of the model, an error is returned. If the model is unknown or the
+// attestation does not include a certificate chain (e.g. none or self attestation) the
+// result is returned unverified so that the caller can decide whether to accept it.
+func (m *Metadata) Verify(aaguid uuid.UUID, x5c []interface{}) (result *Result, err error) {
+	result = &Result{}
+
+	var ok bool
+	if result.Entry, ok = m.Lookup(aaguid); !ok {
+		return result, nil
+	}
+
+	// Only the latest report applies so that a model whose advisory has been resolved by
+	// a later update or certification is not rejected.
+	if status := result.Entry.Status().Status; metadata.IsUndesiredAuthenticatorStatus(status) {
+		return result, fmt.Errorf("%w: %s", ErrUndesiredStatus, status)
+	}
+
+	if len(x5c) == 0 {
+		return result, nil
+	}
+
+	certs := make([]*x509.Certificate, 0, len(x5c))
+	for _, item := range x5c {
+		der, ok := item.([]byte)
+		if !ok {
+			return result, ErrInvalidAttestationCertificate
+		}
+
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(der); err != nil {
+			return result, fmt.Errorf("%w: %s", ErrInvalidAttestationCertificate, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	roots := make([]*x509.Certificate, 0, len(result.Entry.MetadataStatement.AttestationRootCertificates))
+	for _, encoded := range result.Entry.MetadataStatement.AttestationRootCertificates {
+		var der []byte
+		if der, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			continue
+		}
+
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(der); err != nil {
+			continue
+		}
+		roots = append(roots, cert)
+	}
+
+	if err = verifyCertificate(certs[0], certs[1:], roots); err != nil {
+		return result, fmt.Errorf("%w: %s", ErrInvalidAttestation, err)
+	}
+
+	result.Verified = true
+	return result, nil
+}
+
+// Status returns the most recent status report of the authenticator model.
+func (e *Entry) Status() (report StatusReport) {
+	if len(e.StatusReports) == 0 {
+		return report
+	}
+
+	reports := make([]StatusReport, len(e.StatusReports))
+	copy(reports, e.StatusReports)
+	sort.SliceStable(reports, func(i, j int) bool { return reports[i].EffectiveDate < reports[j].EffectiveDate })
+	return reports[len(reports)-1]
+}
@@ -0,0 +1,51 @@
+package mds
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/google/uuid"
+)
+
+func TestVerifyStatus(t *testing.T) {
+	report := func(status metadata.AuthenticatorStatus, date string) StatusReport {
+		return StatusReport{Status: status, EffectiveDate: date}
+	}
+
+	tests := []struct {
+		name    string
+		reports []StatusReport
+		err     error
+	}{
+		{"no reports", nil, nil},
+		{"certified", []StatusReport{report(metadata.FidoCertified, "2020-01-01")}, nil},
+		{"revoked", []StatusReport{report(metadata.FidoCertified, "2020-01-01"), report(metadata.Revoked, "2021-01-01")}, ErrUndesiredStatus},
+		{"compromised", []StatusReport{report(metadata.UserKeyRemoteCompromise, "2021-01-01")}, ErrUndesiredStatus},
+		{"fixed advisory", []StatusReport{report(metadata.FidoCertified, "2020-01-01"), report(metadata.UserVerificationBypass, "2020-06-01"), report(metadata.UpdateAvailable, "2020-09-01")}, nil},
+		{"recertified", []StatusReport{report(metadata.AttestationKeyCompromise, "2020-06-01"), report(metadata.FidoCertifiedL1, "2021-01-01")}, nil},
+		{"unordered reports", []StatusReport{report(metadata.Revoked, "2022-01-01"), report(metadata.FidoCertified, "2020-01-01")}, ErrUndesiredStatus},
+	}
+
+	for _, tc := range tests {
+		aaguid := uuid.New()
+		mds := &Metadata{entries: map[uuid.UUID]*Entry{
+			aaguid: {AAGUID: aaguid.String(), StatusReports: tc.reports},
+		}}
+
+		result, err := mds.Verify(aaguid, nil)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+
+		if result.Entry == nil || result.Verified {
+			t.Errorf("%s: expected an unverified result with the metadata entry", tc.name)
+		}
+	}
+
+	// Unknown authenticator models are returned unverified without an error.
+	result, err := (&Metadata{}).Verify(uuid.New(), nil)
+	if err != nil || result.Entry != nil || result.Verified {
+		t.Errorf("expected an unknown model to be unverified, got %+v %v", result, err)
+	}
+}
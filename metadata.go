@@ -0,0 +1,51 @@
+package yubikey
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bbengfort/yubikey/mds"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Verify the attestation statement of a newly registered credential against the FIDO
+// metadata (if loaded) and return the resolved metadata to store with the credential.
+// If the authenticator has an undesired status or its attestation certificate does not
+// chain to the metadata roots, a security event is recorded, the error response is
+// written, and an error is returned.
+func (s *Server) verifyAttestation(c *gin.Context, user *store.User, credential *webauthn.Credential, parsed *protocol.ParsedCredentialCreationData) (meta store.AuthenticatorMetadata, err error) {
+	meta.Format = parsed.Response.AttestationObject.Format
+	if s.mds == nil {
+		return meta, nil
+	}
+
+	aaguid, _ := uuid.FromBytes(credential.Authenticator.AAGUID)
+	x5c, _ := parsed.Response.AttestationObject.AttStatement["x5c"].([]interface{})
+
+	var result *mds.Result
+	result, err = s.mds.Verify(aaguid, x5c)
+
+	if result.Entry != nil {
+		status := result.Entry.Status()
+		meta.Description = result.Entry.MetadataStatement.Description
+		meta.Status = string(status.Status)
+		meta.StatusDate = status.EffectiveDate
+		meta.Serial = s.mds.Number
+	}
+	meta.Verified = result.Verified
+
+	if err != nil {
+		detail := fmt.Sprintf("registration of authenticator %s rejected: %s", aaguid, err)
+		s.securityEvent(c, store.EventAttestationRejected, user, credential.ID, detail)
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s: %s", ErrAttestationRejected, err)})
+		return meta, ErrAttestationRejected
+	}
+
+	log.Debug().Str("aaguid", aaguid.String()).Bool("verified", meta.Verified).Str("status", meta.Status).Msg("attestation checked against metadata")
+	return meta, nil
+}
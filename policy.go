@@ -0,0 +1,90 @@
+package yubikey
+
+import (
+	"fmt"
+	"net/http"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/policy"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// ReloadPolicy reads the registration policy from the configured path and replaces the
+// current policy. If the policy cannot be loaded the current policy remains in effect.
+func (s *Server) ReloadPolicy() (err error) {
+	var updated *policy.Policy
+	if updated, err = s.loadPolicy(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.policy = updated
+	s.Unlock()
+
+	log.Info().Int("allow", len(updated.Allow)).Int("deny", len(updated.Deny)).Bool("require_attestation", updated.RequireAttestation).Msg("registration policy loaded")
+	return nil
+}
+
+// Load the registration policy from the configured path, ensuring that the policy can
+// be enforced with the configured attestation metadata.
+func (s *Server) loadPolicy() (_ *policy.Policy, err error) {
+	var loaded *policy.Policy
+	if loaded, err = policy.Load(s.conf.Policy.Path); err != nil {
+		return nil, err
+	}
+
+	if loaded.RequiresMetadata() && s.mds == nil {
+		return nil, fmt.Errorf("%w: configure a metadata path or remove require_attestation and the allow list", policy.ErrMetadataRequired)
+	}
+	return loaded, nil
+}
+
+// Returns the registration policy currently in effect.
+func (s *Server) registrationPolicy() *policy.Policy {
+	s.RLock()
+	defer s.RUnlock()
+	return s.policy
+}
+
+// Check that the authenticator of a newly registered credential is permitted by the
+// registration policy. If it is not, a security event is recorded, the error response
+// is written, and an error is returned.
+func (s *Server) checkPolicy(c *gin.Context, user *store.User, credential *webauthn.Credential, meta store.AuthenticatorMetadata) (err error) {
+	// The authenticator is only attested if its attestation chains to a metadata root; a
+	// certificate chain that is only checked against itself can be self-signed.
+	aaguid, _ := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err = s.registrationPolicy().Check(aaguid, meta.Verified); err != nil {
+		detail := fmt.Sprintf("registration of authenticator %s rejected: %s", aaguid, err)
+		s.securityEvent(c, store.EventPolicyRejected, user, credential.ID, detail)
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s: %s", ErrPolicyRejected, err)})
+		return ErrPolicyRejected
+	}
+	return nil
+}
+
+// GetPolicy returns the registration policy currently in effect.
+func (s *Server) GetPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, policyReply(s.registrationPolicy()))
+}
+
+// policyReply converts the registration policy into its API representation.
+func policyReply(p *policy.Policy) *v1.RegistrationPolicy {
+	out := &v1.RegistrationPolicy{
+		RequireAttestation: p.RequireAttestation,
+		Allow:              make([]string, 0, len(p.Allow)),
+		Deny:               make([]string, 0, len(p.Deny)),
+	}
+
+	for _, aaguid := range p.Allow {
+		out.Allow = append(out.Allow, aaguid.String())
+	}
+
+	for _, aaguid := range p.Deny {
+		out.Deny = append(out.Deny, aaguid.String())
+	}
+	return out
+}
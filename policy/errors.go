@@ -0,0 +1,10 @@
+package policy
+
+import "errors"
+
+var (
+	ErrDenied              = errors.New("authenticator is on the registration deny list")
+	ErrNotAllowed          = errors.New("authenticator is not on the registration allow list")
+	ErrAttestationRequired = errors.New("registration policy requires a verifiable attestation")
+	ErrMetadataRequired    = errors.New("registration policy requires attestation metadata to verify authenticators")
+)
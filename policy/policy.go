@@ -0,0 +1,83 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// Policy restricts which authenticators may be registered by AAGUID. If the allow list
+// is not empty only the listed authenticators may be registered; authenticators on the
+// deny list are always rejected. RequireAttestation rejects authenticators that do not
+// provide a verifiable attestation (e.g. synced platform passkeys), which should be
+// enabled with an allow list since an unattested AAGUID is self-reported. Attestations
+// can only be verified against FIDO metadata, so policies that require attestation or
+// that have an allow list must be used with metadata (see RequiresMetadata).
+type Policy struct {
+	RequireAttestation bool        `json:"require_attestation"`
+	Allow              []uuid.UUID `json:"allow"`
+	Deny               []uuid.UUID `json:"deny"`
+	allow              map[uuid.UUID]struct{}
+	deny               map[uuid.UUID]struct{}
+}
+
+// Load a policy from a JSON file. An empty path returns a policy that permits any
+// authenticator to be registered.
+func Load(path string) (_ *Policy, err error) {
+	policy := &Policy{}
+	if path != "" {
+		var data []byte
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("could not read registration policy: %w", err)
+		}
+
+		if err = json.Unmarshal(data, policy); err != nil {
+			return nil, fmt.Errorf("could not parse registration policy: %w", err)
+		}
+	}
+
+	policy.index()
+	return policy, nil
+}
+
+func (p *Policy) index() {
+	p.allow = make(map[uuid.UUID]struct{}, len(p.Allow))
+	for _, aaguid := range p.Allow {
+		p.allow[aaguid] = struct{}{}
+	}
+
+	p.deny = make(map[uuid.UUID]struct{}, len(p.Deny))
+	for _, aaguid := range p.Deny {
+		p.deny[aaguid] = struct{}{}
+	}
+}
+
+// RequiresMetadata returns true if the policy can only be enforced if attestations are
+// verified against FIDO metadata: an attestation is only verifiable if it chains to a
+// metadata root and an allow list can be bypassed by a self-signed attestation that
+// reports an allowed AAGUID.
+func (p *Policy) RequiresMetadata() bool {
+	return p.RequireAttestation || len(p.Allow) > 0
+}
+
+// Check returns an error if the authenticator may not be registered. Attested should be
+// true only if the attestation statement of the authenticator was verified against a
+// metadata root certificate.
+func (p *Policy) Check(aaguid uuid.UUID, attested bool) error {
+	if _, ok := p.deny[aaguid]; ok {
+		return ErrDenied
+	}
+
+	if len(p.allow) > 0 {
+		if _, ok := p.allow[aaguid]; !ok {
+			return ErrNotAllowed
+		}
+	}
+
+	if p.RequireAttestation && !attested {
+		return ErrAttestationRequired
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var (
+	yubikey  = uuid.MustParse("cb69481e-8ff7-4039-93ec-0a2729a154a8")
+	solokey  = uuid.MustParse("8876631b-d4a0-427f-5773-0ec71c9e0279")
+	passkey  = uuid.MustParse("ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4")
+	unlisted = uuid.MustParse("00000000-0000-0000-0000-000000000000")
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *Policy
+		aaguid   uuid.UUID
+		attested bool
+		err      error
+	}{
+		{"empty policy", &Policy{}, passkey, false, nil},
+		{"denied", &Policy{Deny: []uuid.UUID{passkey}}, passkey, true, ErrDenied},
+		{"not denied", &Policy{Deny: []uuid.UUID{passkey}}, yubikey, false, nil},
+		{"allowed", &Policy{Allow: []uuid.UUID{yubikey, solokey}}, solokey, false, nil},
+		{"not allowed", &Policy{Allow: []uuid.UUID{yubikey, solokey}}, unlisted, true, ErrNotAllowed},
+		{"deny overrides allow", &Policy{Allow: []uuid.UUID{yubikey}, Deny: []uuid.UUID{yubikey}}, yubikey, true, ErrDenied},
+		{"attested", &Policy{RequireAttestation: true}, yubikey, true, nil},
+		{"not attested", &Policy{RequireAttestation: true}, yubikey, false, ErrAttestationRequired},
+		{"allowed not attested", &Policy{RequireAttestation: true, Allow: []uuid.UUID{yubikey}}, yubikey, false, ErrAttestationRequired},
+		{"attested not allowed", &Policy{RequireAttestation: true, Allow: []uuid.UUID{yubikey}}, solokey, true, ErrNotAllowed},
+	}
+
+	for _, tc := range tests {
+		tc.policy.index()
+		if err := tc.policy.Check(tc.aaguid, tc.attested); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		metadata bool
+		err      bool
+	}{
+		{"no path", "", false, false},
+		{"empty", `{}`, false, false},
+		{"deny only", `{"deny": ["ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4"]}`, false, false},
+		{"allow list", `{"allow": ["cb69481e-8ff7-4039-93ec-0a2729a154a8"]}`, true, false},
+		{"require attestation", `{"require_attestation": true}`, true, false},
+		{"invalid json", `{"allow": [`, false, true},
+		{"invalid aaguid", `{"allow": ["yubikey"]}`, false, true},
+	}
+
+	for _, tc := range tests {
+		var path string
+		if tc.data != "" {
+			path = filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		policy, err := Load(path)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+
+		if policy.RequiresMetadata() != tc.metadata {
+			t.Errorf("%s: expected requires metadata %t, got %t", tc.name, tc.metadata, policy.RequiresMetadata())
+		}
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing policy file")
+	}
+}
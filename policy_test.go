@@ -0,0 +1,106 @@
+package yubikey
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/mds"
+	"github.com/bbengfort/yubikey/policy"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		metadata bool
+		err      error
+	}{
+		{"deny list without metadata", `{"deny": ["ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4"]}`, false, nil},
+		{"allow list without metadata", `{"allow": ["cb69481e-8ff7-4039-93ec-0a2729a154a8"]}`, false, policy.ErrMetadataRequired},
+		{"attestation without metadata", `{"require_attestation": true}`, false, policy.ErrMetadataRequired},
+		{"allow list with metadata", `{"allow": ["cb69481e-8ff7-4039-93ec-0a2729a154a8"]}`, true, nil},
+		{"attestation with metadata", `{"require_attestation": true}`, true, nil},
+	}
+
+	for _, tc := range tests {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(path, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newTestServer(t, config.Config{Policy: config.PolicyConfig{Path: path}})
+		if tc.metadata {
+			s.mds = &mds.Metadata{}
+		}
+
+		previous, _ := policy.Load("")
+		s.policy = previous
+
+		err := s.ReloadPolicy()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		// If the policy is rejected the previous policy must remain in effect.
+		if replaced := s.registrationPolicy() != previous; replaced != (tc.err == nil) {
+			t.Errorf("%s: expected policy replaced %t, got %t", tc.name, tc.err == nil, replaced)
+		}
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	// Without metadata an attestation with a certificate chain may be self-signed, so
+	// only attestations verified against the metadata satisfy the policy.
+	yubikey := uuid.MustParse("cb69481e-8ff7-4039-93ec-0a2729a154a8")
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"require_attestation": true, "allow": ["cb69481e-8ff7-4039-93ec-0a2729a154a8"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	registration, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verified bool
+		format   string
+		err      error
+	}{
+		{"verified", true, "packed", nil},
+		{"self attested", false, "packed", ErrPolicyRejected},
+		{"no attestation", false, "none", ErrPolicyRejected},
+	}
+
+	for _, tc := range tests {
+		s := newTestServer(t, config.Config{})
+		s.policy = registration
+
+		user, err := s.users.NewUser("Jane Doe", "jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		credential := &webauthn.Credential{ID: []byte{0xc0, 0xde}, Authenticator: webauthn.Authenticator{AAGUID: yubikey[:]}}
+		meta := store.AuthenticatorMetadata{Format: tc.format, Verified: tc.verified}
+
+		c, w := newTestContext(http.MethodPost, "/v1/register/finish")
+		if err = s.checkPolicy(c, user, credential, meta); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		if tc.err != nil && w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status %d, got %d", tc.name, http.StatusForbidden, w.Code)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package yubikey
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+// Reauthenticated is middleware for sensitive operations on the user in the URL (e.g.
+// deleting credentials or changing the email address) that requires the user to have
+// performed a WebAuthn assertion within the configured window, so that a stolen session
+// cookie cannot be used to remove a user's keys. If the user has not reauthenticated, a
+// structured reauth required response is returned that the client can satisfy inline.
+func (s *Server) Reauthenticated() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := s.lookupUser(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+
+		reauth, err := s.sessions.GetReauthentication(c.Request)
+		if err != nil {
+			log.Warn().Err(err).Msg("could not get reauthentication from session")
+		}
+
+		if !reauth.Valid(user.WebAuthnID(), s.conf.Reauth.UserVerification) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, &v1.ReauthRequired{
+				Error:  ErrReauthRequired.Error(),
+				Reauth: s.reauthReply(user),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// BeginReauth issues a login challenge scoped to the credentials of the user in the URL.
+func (s *Server) BeginReauth(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+
+	options := make([]webauthn.LoginOption, 0, 1)
+	if s.conf.Reauth.UserVerification {
+		options = append(options, webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+
+	opts, session, err := s.authn.BeginLogin(user, options...)
+	if err != nil {
+		log.Error().Err(err).Msg("could not begin webauthn reauthentication")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Session values must be stored
+	if err := s.sessions.SaveWebauthnSession("reauthentication", session, c.Request, c.Writer); err != nil {
+		log.Error().Err(err).Msg("could not save session data")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, opts)
+}
+
+// FinishReauth validates the assertion of the user in the URL and records the time of
+// the reauthentication in the session so that sensitive operations can proceed.
+func (s *Server) FinishReauth(c *gin.Context) {
+	var (
+		user        *store.User
+		sessionData webauthn.SessionData
+		err         error
+		ok          bool
+	)
+
+	if sessionData, err = s.sessions.GetWebauthnSession("reauthentication", c.Request, c.Writer); err != nil {
+		log.Warn().Err(err).Msg("could not get session data from request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user, ok = s.lookupUser(c); !ok {
+		return
+	}
+
+	// The challenge must have been issued for the user in the URL
+	if !bytes.Equal(sessionData.UserID, user.WebAuthnID()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reauthentication challenge was not issued for this user"})
+		return
+	}
+
+	var parsed *protocol.ParsedCredentialAssertionData
+	if parsed, err = protocol.ParseCredentialRequestResponse(c.Request); err != nil {
+		log.Warn().Err(err).Msg("could not parse reauthentication response")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var credential *webauthn.Credential
+	if credential, err = s.authn.ValidateLogin(user, sessionData, parsed); err != nil {
+		log.Warn().Err(err).Msg("could not finish reauthentication")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err = s.updateCredential(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	reauth := &session.Reauthentication{
+		UserID:       user.WebAuthnID(),
+		UserVerified: parsed.Response.AuthenticatorData.Flags.HasUserVerified(),
+		Expires:      time.Now().Add(s.conf.Reauth.Window),
+	}
+
+	if err = s.sessions.SaveReauthentication(reauth, c.Request, c.Writer); err != nil {
+		log.Error().Err(err).Msg("could not save reauthentication")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not finish reauthentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, &v1.ReauthReply{
+		Message:      "reauthentication successful",
+		UserVerified: reauth.UserVerified,
+		Expires:      reauth.Expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// Describe how the user can reauthenticate to satisfy the Reauthenticated middleware.
+func (s *Server) reauthReply(user *store.User) *v1.Reauth {
+	out := &v1.Reauth{
+		UserID:           user.ID.String(),
+		UserVerification: string(protocol.VerificationPreferred),
+		Window:           s.conf.Reauth.Window.String(),
+		Begin:            fmt.Sprintf("/v1/users/%s/reauth/begin", user.ID),
+		Finish:           fmt.Sprintf("/v1/users/%s/reauth/finish", user.ID),
+	}
+
+	if s.conf.Reauth.UserVerification {
+		out.UserVerification = string(protocol.VerificationRequired)
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package yubikey
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/gin-gonic/gin"
+)
+
+func TestReauthenticated(t *testing.T) {
+	tests := []struct {
+		name      string
+		reauth    *session.Reauthentication
+		requireUV bool
+		status    int
+	}{
+		{"no reauthentication", nil, false, http.StatusUnauthorized},
+		{"other user", &session.Reauthentication{UserID: []byte("other user"), UserVerified: true, Expires: time.Now().Add(time.Minute)}, false, http.StatusUnauthorized},
+		{"expired", &session.Reauthentication{UserVerified: true, Expires: time.Now().Add(-time.Second)}, false, http.StatusUnauthorized},
+		{"not verified", &session.Reauthentication{Expires: time.Now().Add(time.Minute)}, true, http.StatusUnauthorized},
+		{"not verified optional", &session.Reauthentication{Expires: time.Now().Add(time.Minute)}, false, http.StatusOK},
+		{"verified", &session.Reauthentication{UserVerified: true, Expires: time.Now().Add(time.Minute)}, true, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		s := newTestServer(t, config.Config{Reauth: config.ReauthConfig{Window: 5 * time.Minute, UserVerification: tc.requireUV}})
+		user, err := s.users.NewUser("Jane Doe", "jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(http.MethodDelete, "/v1/users/"+user.ID.String(), nil)
+		if tc.reauth != nil {
+			if tc.reauth.UserID == nil {
+				tc.reauth.UserID = user.WebAuthnID()
+			}
+
+			w := httptest.NewRecorder()
+			if err = s.sessions.SaveReauthentication(tc.reauth, httptest.NewRequest(http.MethodPost, "/", nil), w); err != nil {
+				t.Fatal(err)
+			}
+			for _, cookie := range w.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+		}
+
+		c, w := newTestContext(http.MethodDelete, "/")
+		c.Request = r
+		c.Params = gin.Params{{Key: "userID", Value: user.ID.String()}}
+		s.Reauthenticated()(c)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+			continue
+		}
+
+		if tc.status == http.StatusUnauthorized {
+			reply := &v1.ReauthRequired{}
+			if err = json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+				t.Fatalf("%s: could not parse reauth required reply: %s", tc.name, err)
+			}
+
+			if reply.Reauth == nil || reply.Reauth.UserID != user.ID.String() || reply.Reauth.Begin != fmt.Sprintf("/v1/users/%s/reauth/begin", user.ID) {
+				t.Errorf("%s: unexpected reauth reply %+v", tc.name, reply.Reauth)
+			}
+		}
+	}
+}
+
+func TestReauthRoutesAuthorized(t *testing.T) {
+	s := newDefaultServer(t)
+	owner, ownerCookie := testLogin(t, s, "jane@example.com")
+	_, otherCookie := testLogin(t, s, "john@example.com")
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"anonymous begin", "/v1/users/%s/reauth/begin", nil, http.StatusUnauthorized},
+		{"anonymous finish", "/v1/users/%s/reauth/finish", nil, http.StatusUnauthorized},
+		{"other user begin", "/v1/users/%s/reauth/begin", otherCookie, http.StatusForbidden},
+		{"other user finish", "/v1/users/%s/reauth/finish", otherCookie, http.StatusForbidden},
+		{"owner begin", "/v1/users/%s/reauth/begin", ownerCookie, http.StatusOK},
+		{"owner finish without challenge", "/v1/users/%s/reauth/finish", ownerCookie, http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf(tc.path, owner.ID), nil)
+		if tc.cookie != nil {
+			r.AddCookie(tc.cookie)
+		}
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
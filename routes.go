@@ -47,6 +47,9 @@ func (s *Server) setupRoutes() (err error) {
 
 		// Mainenance mode handling
 		s.Available(),
+
+		// Load the logged in user from the session, if any
+		s.Authenticate(),
 	}
 
 	// Add the middleware to the router
@@ -61,6 +64,9 @@ func (s *Server) setupRoutes() (err error) {
 	s.router.GET("/livez", s.Healthz)
 	s.router.GET("/readyz", s.Readyz)
 
+	// Public keys that verify issued access tokens
+	s.router.GET("/.well-known/jwks.json", s.JWKS)
+
 	// NotFound and NotAllowed routes
 	s.router.NoRoute(s.NotFound)
 	s.router.NoMethod(s.NotAllowed)
@@ -69,18 +75,62 @@ func (s *Server) setupRoutes() (err error) {
 	s.router.GET("/", s.Index)
 	s.router.GET("/register", s.Register)
 	s.router.GET("/login", s.Login)
+	s.router.GET("/diagnostics", s.Diagnostics)
+	s.router.GET("/account", s.Account)
 
 	// Yubikey registration
 	s.router.POST("/register/begin", s.BeginRegistration)
 	s.router.POST("/register/finish", s.FinishRegistration)
 	s.router.POST("/login/begin", s.BeginLogin)
 	s.router.POST("/login/finish", s.FinishLogin)
+	s.router.POST("/login/discoverable/begin", s.BeginDiscoverableLogin)
+	s.router.POST("/login/discoverable/finish", s.FinishDiscoverableLogin)
+	s.router.POST("/login/conditional/begin", s.BeginConditionalLogin)
+	s.router.POST("/login/conditional/finish", s.FinishConditionalLogin)
+	s.router.POST("/logout", s.Logout)
 
 	// Add the v1 API routes (currently the only version)
 	v1 := s.router.Group("/v1")
 	{
 		// Heartbeat route
 		v1.GET("/status", s.Status)
+
+		// Session of the logged in user
+		v1.GET("/session", s.BearerToken(), s.Authenticated(), s.CurrentSession)
+		v1.GET("/sessions", s.Authenticated(), s.ListSessions)
+		v1.DELETE("/sessions/:sessionID", s.Authenticated(), s.RevokeSession)
+
+		// Access and refresh tokens
+		v1.POST("/token/refresh", s.RefreshToken)
+		v1.POST("/token/revoke", s.RevokeToken)
+
+		// Users and credentials
+		v1.GET("/users", s.Authenticated(), s.ListUsers)
+		v1.GET("/users/:userID", s.Authorized(), s.UserDetail)
+		v1.PUT("/users/:userID", s.Authorized(), s.Reauthenticated(), s.UpdateUser)
+		v1.DELETE("/users/:userID", s.Authorized(), s.Reauthenticated(), s.DeleteUser)
+		v1.GET("/users/:userID/credentials", s.Authorized(), s.ListCredentials)
+		v1.PUT("/users/:userID/credentials/:credentialID", s.Authorized(), s.UpdateCredential)
+		v1.DELETE("/users/:userID/credentials/:credentialID", s.Authorized(), s.Reauthenticated(), s.DeleteCredential)
+		v1.POST("/users/:userID/credentials/:credentialID/revoke", s.Authorized(), s.Reauthenticated(), s.RevokeCredential)
+		v1.GET("/users/:userID/events", s.Authorized(), s.ListUserEvents)
+		v1.GET("/users/:userID/sessions", s.Authorized(), s.ListUserSessions)
+		v1.DELETE("/users/:userID/sessions", s.Authorized(), s.Reauthenticated(), s.RevokeUserSessions)
+
+		// Transaction confirmation
+		v1.POST("/users/:userID/transactions/begin", s.Authorized(), s.BeginTransaction)
+		v1.POST("/users/:userID/transactions/finish", s.Authorized(), s.FinishTransaction)
+		v1.POST("/transactions/verify", s.VerifyTransaction)
+
+		// Step-up reauthentication required by sensitive operations
+		v1.POST("/users/:userID/reauth/begin", s.Authorized(), s.BeginReauth)
+		v1.POST("/users/:userID/reauth/finish", s.Authorized(), s.FinishReauth)
+
+		// Diagnostics
+		v1.GET("/diagnostics/algorithms", s.AlgorithmDiagnostics)
+
+		// Registration policy
+		v1.GET("/policy", s.GetPolicy)
 	}
 
 	return nil
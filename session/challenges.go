@@ -0,0 +1,177 @@
+package session
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	ChallengeIDLength    = 32
+	DefaultChallengeTTL  = 5 * time.Minute
+	DefaultMaxChallenges = 10000
+	challengeKeyPrefix   = "challenge:"
+)
+
+// Challenges is a server-side registry of the webauthn session data of ceremonies that
+// are in progress. The session cookie only holds the ID of the challenge; the session
+// data is removed from the registry when the ceremony is finished so that a replayed
+// cookie or finish request cannot use the same challenge again. Challenges that are
+// never finished are removed by the session store sweeper once they expire.
+//
+// The registry is held in memory and limited to a maximum number of outstanding
+// challenges, evicting the oldest challenges when it is full, unless it is backed by the
+// persistence backend, in which case challenges survive restarts and can be finished on
+// any replica that shares the backend.
+type Challenges struct {
+	sync.Mutex
+	ttl        time.Duration
+	max        int
+	db         store.SessionStore
+	challenges map[string]*list.Element
+	order      *list.List // challenges in the order they were registered
+}
+
+type challenge struct {
+	id      string
+	data    webauthn.SessionData
+	expires time.Time
+}
+
+// NewChallenges creates an in-memory registry that holds at most max challenges, after
+// which the oldest challenges are evicted; challenges whose session data does not
+// specify an expiration expire after the ttl.
+func NewChallenges(ttl time.Duration, max int) *Challenges {
+	if ttl <= 0 {
+		ttl = DefaultChallengeTTL
+	}
+
+	if max <= 0 {
+		max = DefaultMaxChallenges
+	}
+
+	return &Challenges{
+		ttl:        ttl,
+		max:        max,
+		challenges: make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// NewStoredChallenges creates a registry that keeps the challenges in the persistence
+// backend until they expire, after which they are removed with other expired sessions.
+func NewStoredChallenges(db store.SessionStore, ttl time.Duration) *Challenges {
+	if ttl <= 0 {
+		ttl = DefaultChallengeTTL
+	}
+	return &Challenges{ttl: ttl, db: db}
+}
+
+// Register the session data and return a random challenge ID along with the time that
+// the challenge expires. If the in-memory registry is full the oldest challenge is
+// evicted, so that clients that begin ceremonies without finishing them cannot prevent
+// other clients from beginning new ceremonies.
+func (c *Challenges) Register(data *webauthn.SessionData) (id string, expires time.Time, err error) {
+	var key []byte
+	if key, err = GenerateSecureKey(ChallengeIDLength); err != nil {
+		return "", expires, err
+	}
+	id = base64.RawURLEncoding.EncodeToString(key)
+
+	expires = data.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(c.ttl)
+	}
+
+	if c.db != nil {
+		session := &store.Session{ID: challengeKeyPrefix + id, Expires: expires}
+		if session.Data, err = json.Marshal(data); err != nil {
+			return "", expires, err
+		}
+
+		if err = c.db.SaveSession(session); err != nil {
+			return "", expires, err
+		}
+		return id, expires, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for c.order.Len() >= c.max {
+		c.remove(c.order.Front())
+	}
+
+	c.challenges[id] = c.order.PushBack(&challenge{id: id, data: *data, expires: expires})
+	return id, expires, nil
+}
+
+// Consume returns the session data of the challenge and removes it from the registry in
+// a single operation, so that only one request can ever finish a ceremony.
+func (c *Challenges) Consume(id string) (data webauthn.SessionData, err error) {
+	if c.db != nil {
+		var session *store.Session
+		if session, err = c.db.ConsumeSession(challengeKeyPrefix + id); err != nil {
+			if errors.Is(err, store.ErrSessionNotFound) {
+				return data, ErrChallengeNotFound
+			}
+			return data, err
+		}
+
+		if err = json.Unmarshal(session.Data, &data); err != nil {
+			return webauthn.SessionData{}, errors.Join(ErrMarshal, err)
+		}
+		return data, nil
+	}
+
+	c.Lock()
+	elem, ok := c.challenges[id]
+	if !ok {
+		c.Unlock()
+		return data, ErrChallengeNotFound
+	}
+	entry := c.remove(elem)
+	c.Unlock()
+
+	if entry.expires.Before(time.Now()) {
+		return data, ErrChallengeExpired
+	}
+	return entry.data, nil
+}
+
+// Sweep removes all expired challenges from the in-memory registry and returns the
+// number of challenges removed. Challenges in the persistence backend are removed when
+// the expired sessions are deleted.
+func (c *Challenges) Sweep() (removed int) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for _, elem := range c.challenges {
+		if elem.Value.(*challenge).expires.Before(now) {
+			c.remove(elem)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Remove the challenge from the in-memory registry; the caller must hold the lock.
+func (c *Challenges) remove(elem *list.Element) *challenge {
+	entry := c.order.Remove(elem).(*challenge)
+	delete(c.challenges, entry.id)
+	return entry
+}
+
+// Len returns the number of challenges in the in-memory registry, including expired
+// challenges that have not been swept yet.
+func (c *Challenges) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.challenges)
+}
@@ -0,0 +1,200 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestChallengesConsume(t *testing.T) {
+	registries := []struct {
+		name       string
+		challenges *Challenges
+		expired    error
+	}{
+		{"memory", NewChallenges(time.Minute, 10), ErrChallengeExpired},
+		{"stored", NewStoredChallenges(store.NewMemory(), time.Minute), ErrChallengeNotFound},
+	}
+
+	for _, reg := range registries {
+		tests := []struct {
+			name    string
+			expires time.Time
+			err     error
+		}{
+			{"default ttl", time.Time{}, nil},
+			{"not expired", time.Now().Add(time.Minute), nil},
+			{"expired", time.Now().Add(-time.Second), reg.expired},
+		}
+
+		for _, tc := range tests {
+			data := &webauthn.SessionData{Challenge: tc.name, Expires: tc.expires}
+			id, _, err := reg.challenges.Register(data)
+			if err != nil {
+				t.Fatalf("%s %s: %s", reg.name, tc.name, err)
+			}
+
+			consumed, err := reg.challenges.Consume(id)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s %s: expected error %v, got %v", reg.name, tc.name, tc.err, err)
+				continue
+			}
+
+			if tc.err == nil && consumed.Challenge != data.Challenge {
+				t.Errorf("%s %s: expected challenge %q, got %q", reg.name, tc.name, data.Challenge, consumed.Challenge)
+			}
+
+			// A challenge can only be consumed once.
+			if _, err = reg.challenges.Consume(id); !errors.Is(err, ErrChallengeNotFound) {
+				t.Errorf("%s %s: expected a consumed challenge to be not found, got %v", reg.name, tc.name, err)
+			}
+		}
+
+		if _, err := reg.challenges.Consume("unknown"); !errors.Is(err, ErrChallengeNotFound) {
+			t.Errorf("%s: expected an unknown challenge to be not found, got %v", reg.name, err)
+		}
+	}
+}
+
+func TestChallengesConcurrentConsume(t *testing.T) {
+	registries := []struct {
+		name       string
+		challenges *Challenges
+	}{
+		{"memory", NewChallenges(time.Minute, 10)},
+		{"stored", NewStoredChallenges(store.NewMemory(), time.Minute)},
+	}
+
+	for _, reg := range registries {
+		id, _, err := reg.challenges.Register(&webauthn.SessionData{Challenge: "concurrent"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			consumed int
+		)
+
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := reg.challenges.Consume(id); err == nil {
+					mu.Lock()
+					consumed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if consumed != 1 {
+			t.Errorf("%s: expected the challenge to be consumed once, got %d", reg.name, consumed)
+		}
+	}
+}
+
+func TestChallengesLimit(t *testing.T) {
+	challenges := NewChallenges(time.Minute, 3)
+	ids := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		id, _, err := challenges.Register(&webauthn.SessionData{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if n := challenges.Len(); n != 3 {
+		t.Errorf("expected 3 challenges in the registry, got %d", n)
+	}
+
+	// The oldest challenge is evicted to make room for the new challenge.
+	if _, err := challenges.Consume(ids[0]); !errors.Is(err, ErrChallengeNotFound) {
+		t.Errorf("expected the oldest challenge to be evicted, got %v", err)
+	}
+
+	for _, id := range ids[1:] {
+		if _, err := challenges.Consume(id); err != nil {
+			t.Errorf("expected challenge to be kept, got %v", err)
+		}
+	}
+}
+
+func TestChallengesFull(t *testing.T) {
+	// Filling the registry with ceremonies that are never finished must not prevent a
+	// new ceremony from beginning and finishing.
+	challenges := NewChallenges(time.Minute, 0)
+	for i := 0; i < DefaultMaxChallenges*2; i++ {
+		if _, _, err := challenges.Register(&webauthn.SessionData{Challenge: "abandoned"}); err != nil {
+			t.Fatalf("could not register abandoned challenge %d: %s", i, err)
+		}
+	}
+
+	id, _, err := challenges.Register(&webauthn.SessionData{Challenge: "fresh"})
+	if err != nil {
+		t.Fatalf("could not register a fresh challenge: %s", err)
+	}
+
+	data, err := challenges.Consume(id)
+	if err != nil {
+		t.Fatalf("could not consume a fresh challenge: %s", err)
+	}
+
+	if data.Challenge != "fresh" {
+		t.Errorf("expected challenge %q, got %q", "fresh", data.Challenge)
+	}
+
+	if n := challenges.Len(); n != DefaultMaxChallenges-1 {
+		t.Errorf("expected %d challenges in the registry, got %d", DefaultMaxChallenges-1, n)
+	}
+}
+
+func TestChallengesSweep(t *testing.T) {
+	challenges := NewChallenges(time.Minute, 10)
+	expired, _, err := challenges.Register(&webauthn.SessionData{Expires: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, _, err := challenges.Register(&webauthn.SessionData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := challenges.Sweep(); removed != 1 {
+		t.Errorf("expected 1 expired challenge to be removed, got %d", removed)
+	}
+
+	if _, err = challenges.Consume(expired); !errors.Is(err, ErrChallengeNotFound) {
+		t.Errorf("expected the expired challenge to be removed, got %v", err)
+	}
+
+	if _, err = challenges.Consume(active); err != nil {
+		t.Errorf("expected the active challenge to be kept, got %v", err)
+	}
+}
+
+func TestStoredChallengesShared(t *testing.T) {
+	// Challenges stored in a shared backend can be finished by another replica.
+	db := store.NewMemory()
+	id, _, err := NewStoredChallenges(db, time.Minute).Register(&webauthn.SessionData{Challenge: "replica"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := NewStoredChallenges(db, time.Minute).Consume(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.Challenge != "replica" {
+		t.Errorf("expected challenge %q, got %q", "replica", data.Challenge)
+	}
+}
@@ -5,4 +5,7 @@ import "errors"
 var (
 	ErrInsufficientBytesRead = errors.New("insufficient bytes read")
 	ErrMarshal               = errors.New("error unmarshaling data")
+	ErrChallengeNotFound     = errors.New("challenge not found or already used")
+	ErrChallengeExpired      = errors.New("challenge has expired")
+	ErrNoUser                = errors.New("login session must have a user")
 )
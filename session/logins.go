@@ -0,0 +1,159 @@
+package session
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/google/uuid"
+)
+
+// LastSeenInterval limits how often the last seen time of a login session is written to
+// the persistence backend, so that every request does not cause a write.
+const LastSeenInterval = time.Minute
+
+// LoginSession describes the login of a user on a device. Login sessions are tracked in
+// the persistence backend, independently of where the session values are stored, so
+// that users can list their active sessions and revoke them remotely; the
+// authentication record in the session only refers to the login session by its ID.
+type LoginSession struct {
+	ID           string    `json:"-"`
+	UserID       uuid.UUID `json:"-"`
+	CredentialID []byte    `json:"credential_id"`
+	UserVerified bool      `json:"user_verified"`
+	ClientIP     string    `json:"client_ip"`
+	UserAgent    string    `json:"user_agent"`
+	LastSeen     time.Time `json:"last_seen"`
+	Created      time.Time `json:"-"`
+	Expires      time.Time `json:"-"`
+}
+
+// Logins tracks the login sessions of users in the persistence backend.
+type Logins struct {
+	db store.SessionStore
+}
+
+// NewLogins creates a login session tracker backed by the persistence backend.
+func NewLogins(db store.SessionStore) *Logins {
+	return &Logins{db: db}
+}
+
+// Track a new login session, assigning it a random ID.
+func (l *Logins) Track(login *LoginSession) (err error) {
+	var key []byte
+	if key, err = GenerateSecureKey(SessionIDLength); err != nil {
+		return err
+	}
+
+	login.ID = base64.RawURLEncoding.EncodeToString(key)
+	if login.LastSeen.IsZero() {
+		login.LastSeen = time.Now().UTC()
+	}
+	return l.save(login)
+}
+
+// Get the login session with the ID; returns store.ErrSessionNotFound if the session
+// has expired or has been revoked.
+func (l *Logins) Get(id string) (_ *LoginSession, err error) {
+	var session *store.Session
+	if session, err = l.db.GetSession(id); err != nil {
+		return nil, err
+	}
+
+	// Server-side sessions that do not track a login are not login sessions.
+	if session.UserID == uuid.Nil {
+		return nil, store.ErrSessionNotFound
+	}
+	return loginSession(session)
+}
+
+// List the active login sessions of the user, ordered by the time they were created.
+func (l *Logins) List(userID uuid.UUID) (_ []*LoginSession, err error) {
+	var sessions []*store.Session
+	if sessions, err = l.db.ListSessions(userID); err != nil {
+		return nil, err
+	}
+
+	logins := make([]*LoginSession, 0, len(sessions))
+	for _, session := range sessions {
+		var login *LoginSession
+		if login, err = loginSession(session); err != nil {
+			return nil, err
+		}
+		logins = append(logins, login)
+	}
+	return logins, nil
+}
+
+// Seen records that the login session was used from the client IP address. The last
+// seen time is only written if it is older than the LastSeenInterval or if the client
+// IP address has changed. Returns store.ErrSessionNotFound if the login session has been
+// revoked.
+func (l *Logins) Seen(login *LoginSession, clientIP string) error {
+	now := time.Now().UTC()
+	if now.Sub(login.LastSeen) < LastSeenInterval && login.ClientIP == clientIP {
+		return nil
+	}
+
+	login.LastSeen = now
+	login.ClientIP = clientIP
+	return l.update(login)
+}
+
+// Revoke the login session with the ID so that it can no longer be used.
+func (l *Logins) Revoke(id string) error {
+	return l.db.DeleteSession(id)
+}
+
+// RevokeAll revokes every login session of the user, returning the number of sessions
+// that were revoked.
+func (l *Logins) RevokeAll(userID uuid.UUID) (int, error) {
+	return l.db.DeleteUserSessions(userID)
+}
+
+func (l *Logins) save(login *LoginSession) error {
+	return l.write(login, l.db.SaveSession)
+}
+
+// Only update login sessions that are still stored so that a request that overlaps a
+// revocation cannot write the revoked login session back.
+func (l *Logins) update(login *LoginSession) error {
+	return l.write(login, l.db.UpdateSession)
+}
+
+func (l *Logins) write(login *LoginSession, write func(*store.Session) error) (err error) {
+	if login.UserID == uuid.Nil {
+		return ErrNoUser
+	}
+
+	session := &store.Session{
+		ID:      login.ID,
+		UserID:  login.UserID,
+		Expires: login.Expires,
+	}
+
+	if session.Data, err = json.Marshal(login); err != nil {
+		return err
+	}
+
+	if err = write(session); err != nil {
+		return err
+	}
+	login.Created = session.Created
+	return nil
+}
+
+func loginSession(session *store.Session) (*LoginSession, error) {
+	login := &LoginSession{}
+	if err := json.Unmarshal(session.Data, login); err != nil {
+		return nil, errors.Join(ErrMarshal, err)
+	}
+
+	login.ID = session.ID
+	login.UserID = session.UserID
+	login.Created = session.Created
+	login.Expires = session.Expires
+	return login, nil
+}
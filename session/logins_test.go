@@ -0,0 +1,70 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/google/uuid"
+)
+
+func TestLoginsSeen(t *testing.T) {
+	tests := []struct {
+		name     string
+		lastSeen time.Duration
+		clientIP string
+		revoke   bool
+		err      error
+		written  bool
+	}{
+		{"recently seen", -LastSeenInterval / 2, "127.0.0.1", false, nil, false},
+		{"interval elapsed", -2 * LastSeenInterval, "127.0.0.1", false, nil, true},
+		{"client ip changed", -LastSeenInterval / 2, "192.0.2.1", false, nil, true},
+		{"revoked", -2 * LastSeenInterval, "127.0.0.1", true, store.ErrSessionNotFound, false},
+		{"revoked recently seen", -LastSeenInterval / 2, "127.0.0.1", true, nil, false},
+	}
+
+	for _, tc := range tests {
+		logins := NewLogins(store.NewMemory())
+		login := &LoginSession{
+			UserID:   uuid.New(),
+			ClientIP: "127.0.0.1",
+			LastSeen: time.Now().UTC().Add(tc.lastSeen),
+			Expires:  time.Now().Add(time.Hour),
+		}
+
+		if err := logins.Track(login); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		// A request that loaded the login session before it was revoked must not write
+		// the revoked login session back to the store.
+		if tc.revoke {
+			if err := logins.Revoke(login.ID); err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+		}
+
+		if err := logins.Seen(login, tc.clientIP); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		stored, err := logins.Get(login.ID)
+		if tc.revoke {
+			if !errors.Is(err, store.ErrSessionNotFound) {
+				t.Errorf("%s: expected revoked login session to stay revoked, got %v", tc.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		if written := stored.ClientIP == tc.clientIP && time.Since(stored.LastSeen) < time.Second; written != tc.written {
+			t.Errorf("%s: expected last seen written %t, got %t", tc.name, tc.written, written)
+		}
+	}
+}
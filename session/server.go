@@ -0,0 +1,166 @@
+package session
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	SessionIDLength   = 32
+	DefaultSessionTTL = 24 * time.Hour
+)
+
+// ServerStore implements the sessions.Store interface by keeping the session values in
+// a store.SessionStore so that the cookie only holds an opaque session ID, signed and
+// encrypted with the same key pairs as the cookie store. Sessions expire after the TTL
+// if they are not saved again; expired sessions are removed by the sweeper.
+type ServerStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	TTL     time.Duration
+	db      store.SessionStore
+	encoder securecookie.GobEncoder
+}
+
+var _ sessions.Store = &ServerStore{}
+
+// NewServerSide creates a session store that keeps the session values and the challenges
+// of ceremonies in progress in the persistence backend for the TTL; the cookie only
+// holds the session ID, which is signed and encrypted with the key pairs as described
+// by New.
+func NewServerSide(db store.SessionStore, ttl time.Duration, options *sessions.Options, keyPairs ...[]byte) (_ *Store, err error) {
+	if keyPairs, err = defaultKeyPairs(keyPairs); err != nil {
+		return nil, err
+	}
+
+	server := NewServerStore(db, ttl, keyPairs...)
+	if options != nil {
+		server.Options = options
+		server.MaxAge(options.MaxAge)
+	}
+
+	return &Store{
+		Store:      server,
+		Challenges: NewStoredChallenges(db, DefaultChallengeTTL),
+		Logins:     NewLogins(db),
+		db:         db,
+	}, nil
+}
+
+// NewServerStore creates a server-side session store backed by the persistence backend.
+func NewServerStore(db store.SessionStore, ttl time.Duration, keyPairs ...[]byte) *ServerStore {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+
+	return &ServerStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		TTL: ttl,
+		db:  db,
+	}
+}
+
+// Get returns the session for the given name after adding it to the registry so that
+// the session is only loaded once per request.
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session referenced by the cookie of the request; a new session is
+// returned if there is no cookie or if the session has expired or been deleted.
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err = securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	var stored *store.Session
+	if stored, err = s.db.GetSession(id); err != nil {
+		if errors.Is(err, store.ErrSessionNotFound) {
+			return session, nil
+		}
+		return session, err
+	}
+
+	if err = s.encoder.Deserialize(stored.Data, &session.Values); err != nil {
+		return session, err
+	}
+
+	session.ID = stored.ID
+	session.IsNew = false
+	return session, nil
+}
+
+// Save the session values in the backend and write the session ID to the cookie. If
+// the max age of the session is negative, the session is deleted along with the cookie.
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) (err error) {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err = s.db.DeleteSession(session.ID); err != nil {
+				return err
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		var key []byte
+		if key, err = GenerateSecureKey(SessionIDLength); err != nil {
+			return err
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(key)
+	}
+
+	stored := &store.Session{
+		ID:      session.ID,
+		Expires: time.Now().Add(s.TTL).UTC(),
+	}
+
+	if stored.Data, err = s.encoder.Serialize(session.Values); err != nil {
+		return err
+	}
+
+	if err = s.db.SaveSession(stored); err != nil {
+		return err
+	}
+
+	var encoded string
+	if encoded, err = securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// MaxAge sets the maximum age of the session cookie and of the signed session ID.
+func (s *ServerStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
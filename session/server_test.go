@@ -0,0 +1,94 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/securecookie"
+)
+
+func TestSaveAuthenticationRenewsID(t *testing.T) {
+	db := store.NewMemory()
+	sessions, err := NewServerSide(db, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Begin a login so that the anonymous session is saved with an ID.
+	w := httptest.NewRecorder()
+	if err = sessions.SaveWebauthnSession("authentication", &webauthn.SessionData{Challenge: "login"}, httptest.NewRequest(http.MethodPost, "/", nil), w); err != nil {
+		t.Fatal(err)
+	}
+	anonymous := sessionCookie(t, w)
+	anonymousID := sessionID(t, sessions, anonymous)
+
+	// Finish the login with the cookie of the anonymous session.
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.AddCookie(anonymous)
+	if _, err = sessions.GetWebauthnSession("authentication", r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	auth := &Authentication{SessionID: "login", UserID: []byte("user"), Expires: time.Now().Add(time.Hour)}
+	if err = sessions.SaveAuthentication(auth, r, w); err != nil {
+		t.Fatal(err)
+	}
+	authenticated := sessionCookie(t, w)
+	authenticatedID := sessionID(t, sessions, authenticated)
+
+	if authenticatedID == anonymousID {
+		t.Fatal("expected the session to be given a new id on login")
+	}
+
+	if _, err = db.GetSession(anonymousID); err != store.ErrSessionNotFound {
+		t.Errorf("expected the anonymous session to be deleted, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		authed bool
+	}{
+		{"anonymous cookie", anonymous, false},
+		{"authenticated cookie", authenticated, true},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(tc.cookie)
+
+		found, err := sessions.GetAuthentication(r)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		if (found != nil) != tc.authed {
+			t.Errorf("%s: expected authenticated %t, got %+v", tc.name, tc.authed, found)
+		}
+	}
+}
+
+// Returns the session cookie written to the response.
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == WebauthnSession {
+			return cookie
+		}
+	}
+	t.Fatal("no session cookie in response")
+	return nil
+}
+
+// Decodes the server-side session ID from the cookie.
+func sessionID(t *testing.T, sessions *Store, cookie *http.Cookie) (id string) {
+	server := sessions.Store.(*ServerStore)
+	if err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &id, server.Codecs...); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -1,65 +1,287 @@
 package session
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/bbengfort/yubikey/store"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	DefaultEncryptionKeyLength = 32
+	HashKeyLength              = 64
+	BlockKeyLength             = DefaultEncryptionKeyLength
+	DefaultSweepInterval       = time.Minute
 	WebauthnSession            = "webauthn-session"
+	ReauthenticationKey        = "reauthenticated"
+	AuthenticationKey          = "authenticated"
 )
 
-// Store is a wrapper around sessions.CookieStore which provides some helper methods
-// related to webauthn operations and encrypted cookies.
+// Authentication records a successful login by the user: the credential that was used,
+// whether the user was verified, and when the user authenticated, along with the ID of
+// the login session that is tracked server-side so that it can be revoked. The JSON
+// fields match webauthn.SessionData so that the record is pruned from the cookie once it
+// expires.
+type Authentication struct {
+	SessionID    string    `json:"session_id"`
+	UserID       []byte    `json:"user_id"`
+	CredentialID []byte    `json:"credential_id"`
+	UserVerified bool      `json:"user_verified"`
+	AuthTime     time.Time `json:"auth_time"`
+	Expires      time.Time `json:"expires"`
+}
+
+// Valid returns true if the authentication refers to a login session and has not
+// expired; the caller must also ensure that the login session has not been revoked.
+func (a *Authentication) Valid() bool {
+	return a != nil && a.SessionID != "" && len(a.UserID) > 0 && a.Expires.After(time.Now())
+}
+
+// Reauthentication records a fresh assertion by the user so that sensitive operations
+// can proceed until it expires. The JSON fields match webauthn.SessionData so that the
+// record is pruned from the cookie once it expires.
+type Reauthentication struct {
+	UserID       []byte    `json:"user_id"`
+	UserVerified bool      `json:"user_verified"`
+	Expires      time.Time `json:"expires"`
+}
+
+// Valid returns true if the reauthentication was performed by the user, has not expired,
+// and was user verified if verification is required.
+func (r *Reauthentication) Valid(userID []byte, requireUV bool) bool {
+	if r == nil || !bytes.Equal(r.UserID, userID) || !r.Expires.After(time.Now()) {
+		return false
+	}
+	return r.UserVerified || !requireUV
+}
+
+// ChallengeRef is stored in the session cookie in place of the webauthn session data,
+// which is held server-side in the challenge registry. The expires field matches
+// webauthn.SessionData so that the reference is pruned from the cookie once it expires.
+type ChallengeRef struct {
+	ID      string    `json:"challenge_id"`
+	Expires time.Time `json:"expires"`
+}
+
+// Store is a wrapper around a sessions.Store, either a sessions.CookieStore that keeps
+// the session values in encrypted cookies or a ServerStore that keeps them in the
+// persistence backend, which provides some helper methods related to webauthn
+// operations and sweeps expired challenges and sessions.
 type Store struct {
-	*sessions.CookieStore
+	sessions.Store
+	Challenges *Challenges
+	Logins     *Logins
+	db         store.SessionStore
+	mu         sync.Mutex
+	done       chan struct{}
 }
 
-func New(keyPairs ...[]byte) (*Store, error) {
-	if len(keyPairs) == 0 {
-		key, err := GenerateSecureKey(DefaultEncryptionKeyLength)
-		if err != nil {
-			return nil, err
-		}
-		keyPairs = append(keyPairs, key)
+// New creates a session store whose cookies are signed and encrypted with the hash and
+// block key pairs; the first pair is used to encode cookies and any others are used to
+// decode cookies encoded with previous keys. If no key pairs are given, a random pair is
+// generated and cookies cannot be decoded after the process restarts. If options is nil
+// the default cookie options of the store are used. Login sessions are tracked in the
+// persistence backend.
+func New(db store.SessionStore, options *sessions.Options, keyPairs ...[]byte) (_ *Store, err error) {
+	if keyPairs, err = defaultKeyPairs(keyPairs); err != nil {
+		return nil, err
+	}
+
+	cookies := sessions.NewCookieStore(keyPairs...)
+	if options != nil {
+		cookies.Options = options
+		cookies.MaxAge(options.MaxAge)
+	}
+
+	return &Store{
+		Store:      cookies,
+		Challenges: NewChallenges(DefaultChallengeTTL, DefaultMaxChallenges),
+		Logins:     NewLogins(db),
+		db:         db,
+	}, nil
+}
+
+// Returns a random hash and block key pair if no key pairs are specified.
+func defaultKeyPairs(keyPairs [][]byte) ([][]byte, error) {
+	if len(keyPairs) > 0 {
+		return keyPairs, nil
+	}
+
+	hashKey, err := GenerateSecureKey(HashKeyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	blockKey, err := GenerateSecureKey(BlockKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{hashKey, blockKey}, nil
+}
+
+// GenerateKeyPair returns a new random hash:block key pair encoded as base64 for use in
+// the configuration.
+func GenerateKeyPair() (string, error) {
+	hashKey, err := GenerateSecureKey(HashKeyLength)
+	if err != nil {
+		return "", err
 	}
 
-	store := &Store{
-		sessions.NewCookieStore(keyPairs...),
+	blockKey, err := GenerateSecureKey(BlockKeyLength)
+	if err != nil {
+		return "", err
 	}
-	return store, nil
+	return base64.StdEncoding.EncodeToString(hashKey) + ":" + base64.StdEncoding.EncodeToString(blockKey), nil
 }
 
+// SaveWebauthnSession registers the webauthn session data in the challenge registry and
+// stores a reference to the challenge in the session cookie with the key.
 func (store *Store) SaveWebauthnSession(key string, data *webauthn.SessionData, r *http.Request, w http.ResponseWriter) error {
-	marshaledData, err := json.Marshal(data)
+	id, expires, err := store.Challenges.Register(data)
+	if err != nil {
+		return err
+	}
+
+	marshaledData, err := json.Marshal(&ChallengeRef{ID: id, Expires: expires})
 	if err != nil {
 		return err
 	}
 	return store.Set(key, marshaledData, r, w)
 }
 
-func (store *Store) GetWebauthnSession(key string, r *http.Request) (webauthn.SessionData, error) {
-	sessionData := webauthn.SessionData{}
+// GetWebauthnSession returns the webauthn session data referenced by the key and
+// consumes it from the challenge registry so that a challenge cannot be used more than
+// once, even if the session cookie or the finish request is replayed. The reference is
+// also removed from the session cookie.
+func (store *Store) GetWebauthnSession(key string, r *http.Request, w http.ResponseWriter) (webauthn.SessionData, error) {
 	session, err := store.Get(r, WebauthnSession)
 	if err != nil {
-		return sessionData, err
+		return webauthn.SessionData{}, err
 	}
-	assertion, ok := session.Values[key].([]byte)
+	data, ok := session.Values[key].([]byte)
 	if !ok {
-		return sessionData, ErrMarshal
+		return webauthn.SessionData{}, ErrMarshal
 	}
-	err = json.Unmarshal(assertion, &sessionData)
-	if err != nil {
-		return sessionData, err
+
+	ref := &ChallengeRef{}
+	if err = json.Unmarshal(data, ref); err != nil {
+		return webauthn.SessionData{}, err
 	}
+
 	// Delete the value from the session now that it's been read
 	delete(session.Values, key)
-	return sessionData, nil
+	if err = session.Save(r, w); err != nil {
+		return webauthn.SessionData{}, err
+	}
+	return store.Challenges.Consume(ref.ID)
+}
+
+// SaveReauthentication stores a reauthentication record, replacing any previous record.
+func (store *Store) SaveReauthentication(data *Reauthentication, r *http.Request, w http.ResponseWriter) error {
+	marshaledData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return store.Set(ReauthenticationKey, marshaledData, r, w)
+}
+
+// GetReauthentication returns the reauthentication record of the session or nil if the
+// user has not reauthenticated. The record is not removed so that it can be used for
+// more than one operation until it expires.
+func (store *Store) GetReauthentication(r *http.Request) (*Reauthentication, error) {
+	session, err := store.Get(r, WebauthnSession)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := session.Values[ReauthenticationKey].([]byte)
+	if !ok {
+		return nil, nil
+	}
+
+	reauth := &Reauthentication{}
+	if err = json.Unmarshal(data, reauth); err != nil {
+		return nil, err
+	}
+	return reauth, nil
+}
+
+// SaveAuthentication stores the authentication record of a login, replacing the record
+// of any user that was previously logged in. Server-side sessions are given a new ID so
+// that a session ID planted before the login cannot be used to hijack the login.
+func (store *Store) SaveAuthentication(data *Authentication, r *http.Request, w http.ResponseWriter) error {
+	marshaledData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	session, err := store.Get(r, WebauthnSession)
+	if err != nil {
+		return err
+	}
+
+	if err = store.renew(session); err != nil {
+		return err
+	}
+
+	pruneExpired(session)
+	session.Values[AuthenticationKey] = marshaledData
+	return session.Save(r, w)
+}
+
+// Delete the server-side record of the session and clear its ID so that the session
+// values are saved with a new ID. Cookie sessions do not have an ID to renew.
+func (store *Store) renew(session *sessions.Session) error {
+	if _, ok := store.Store.(*ServerStore); !ok || session.ID == "" {
+		return nil
+	}
+
+	if err := store.db.DeleteSession(session.ID); err != nil {
+		return err
+	}
+	session.ID = ""
+	return nil
+}
+
+// GetAuthentication returns the authentication record of the session or nil if no user
+// is logged in.
+func (store *Store) GetAuthentication(r *http.Request) (*Authentication, error) {
+	session, err := store.Get(r, WebauthnSession)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := session.Values[AuthenticationKey].([]byte)
+	if !ok {
+		return nil, nil
+	}
+
+	auth := &Authentication{}
+	if err = json.Unmarshal(data, auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// ClearAuthentication logs the user out by removing the authentication record and any
+// reauthentication record from the session.
+func (store *Store) ClearAuthentication(r *http.Request, w http.ResponseWriter) error {
+	session, err := store.Get(r, WebauthnSession)
+	if err != nil {
+		return err
+	}
+
+	delete(session.Values, AuthenticationKey)
+	delete(session.Values, ReauthenticationKey)
+	return session.Save(r, w)
 }
 
 func (store *Store) Set(key string, value interface{}, r *http.Request, w http.ResponseWriter) error {
@@ -68,9 +290,97 @@ func (store *Store) Set(key string, value interface{}, r *http.Request, w http.R
 		return err
 	}
 
+	pruneExpired(session)
 	session.Values[key] = value
-	session.Save(r, w)
-	return nil
+	return session.Save(r, w)
+}
+
+// Delete the value stored with the key from the session cookie.
+func (store *Store) Delete(key string, r *http.Request, w http.ResponseWriter) error {
+	session, err := store.Get(r, WebauthnSession)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := session.Values[key]; !ok {
+		return nil
+	}
+
+	delete(session.Values, key)
+	return session.Save(r, w)
+}
+
+// Remove challenge references and other records that have expired, e.g. from ceremonies
+// that were abandoned by the user such as conditional mediation requests that were never
+// completed, so that stale challenges do not accumulate in the session cookie.
+func pruneExpired(session *sessions.Session) {
+	now := time.Now()
+	for key, value := range session.Values {
+		data, ok := value.([]byte)
+		if !ok {
+			continue
+		}
+
+		sessionData := webauthn.SessionData{}
+		if err := json.Unmarshal(data, &sessionData); err != nil {
+			continue
+		}
+
+		if !sessionData.Expires.IsZero() && sessionData.Expires.Before(now) {
+			delete(session.Values, key)
+		}
+	}
+}
+
+// Sweep removes expired challenges from the registry and expired server-side and login
+// sessions from the persistence backend.
+func (store *Store) Sweep() error {
+	store.Challenges.Sweep()
+	_, err := store.db.DeleteExpiredSessions()
+	return err
+}
+
+// Start the background sweeper, removing expired challenges and sessions at the
+// specified interval until Stop is called. Calling Start on a running sweeper has no
+// effect.
+func (store *Store) Start(interval time.Duration) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.done != nil {
+		return
+	}
+
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+
+	done := make(chan struct{})
+	store.done = done
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := store.Sweep(); err != nil {
+					log.Warn().Err(err).Msg("could not remove expired sessions")
+				}
+			}
+		}
+	}()
+}
+
+// Stop the background sweeper if it is running.
+func (store *Store) Stop() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.done != nil {
+		close(store.done)
+		store.done = nil
+	}
 }
 
 func GenerateSecureKey(n int) ([]byte, error) {
@@ -0,0 +1,360 @@
+package yubikey
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/bbengfort/yubikey/token"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+// Keys used to store the logged in user and their session on the gin context.
+const (
+	ctxUserKey    = "current_user"
+	ctxSessionKey = "current_session"
+	ctxLoginKey   = "current_login"
+)
+
+// Authenticate is middleware that loads the user who is logged in with the session
+// cookie, if any, so that handlers and templates can use CurrentUser. Requests without a
+// valid session proceed anonymously; use Authenticated to require a login. A session is
+// no longer valid if it has expired or been revoked, if the user has been deleted, or if
+// the credential used to login has been revoked or deleted.
+func (s *Server) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth, err := s.sessions.GetAuthentication(c.Request)
+		if err != nil {
+			log.Debug().Err(err).Msg("could not get authentication from session")
+		}
+
+		s.authenticate(c, auth)
+		c.Next()
+	}
+}
+
+// Load the user and login session of the authentication record into the context,
+// returning false if the record is not valid or the login session has been revoked.
+func (s *Server) authenticate(c *gin.Context, auth *session.Authentication) bool {
+	if !auth.Valid() {
+		return false
+	}
+
+	user, err := s.users.Lookup(auth.UserID)
+	if err != nil {
+		return false
+	}
+
+	var cred store.Credential
+	if cred, err = user.Credential(auth.CredentialID); err != nil || cred.IsRevoked() {
+		return false
+	}
+
+	// The login session must not have been revoked
+	var login *session.LoginSession
+	if login, err = s.sessions.Logins.Get(auth.SessionID); err != nil || login.UserID != user.ID {
+		return false
+	}
+
+	// The login session may be revoked while the request is being authenticated
+	if err = s.sessions.Logins.Seen(login, c.ClientIP()); err != nil {
+		if errors.Is(err, store.ErrSessionNotFound) {
+			return false
+		}
+		log.Warn().Err(err).Msg("could not update login session last seen")
+	}
+
+	c.Set(ctxUserKey, user)
+	c.Set(ctxSessionKey, auth)
+	c.Set(ctxLoginKey, login)
+	return true
+}
+
+// Authenticated is middleware that requires the user to be logged in; it must be used
+// after the Authenticate middleware has loaded the session.
+func (s *Server) Authenticated() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentUser(c) == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrNotAuthenticated.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authorized is middleware that requires the logged in user to be the user in the URL
+// so that users can only view and modify their own account and credentials; it must be
+// used after the Authenticate middleware has loaded the session.
+func (s *Server) Authorized() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := CurrentUser(c)
+		if user == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrNotAuthenticated.Error()})
+			return
+		}
+
+		if c.Param("userID") != user.ID.String() {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ErrNotAuthorized.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the user who is logged in or nil if the request is anonymous.
+func CurrentUser(c *gin.Context) *store.User {
+	if user, ok := c.Get(ctxUserKey); ok {
+		return user.(*store.User)
+	}
+	return nil
+}
+
+// Returns the authentication record of the logged in user or nil if the request is
+// anonymous.
+func currentSession(c *gin.Context) *session.Authentication {
+	if auth, ok := c.Get(ctxSessionKey); ok {
+		return auth.(*session.Authentication)
+	}
+	return nil
+}
+
+// Returns the tracked login session of the logged in user or nil if the request is
+// anonymous.
+func currentLogin(c *gin.Context) *session.LoginSession {
+	if login, ok := c.Get(ctxLoginKey); ok {
+		return login.(*session.LoginSession)
+	}
+	return nil
+}
+
+// CurrentSession returns the login session of the current user.
+func (s *Server) CurrentSession(c *gin.Context) {
+	c.JSON(http.StatusOK, sessionReply(CurrentUser(c), currentSession(c)))
+}
+
+// Logout removes the authenticated session. Browsers are redirected to the login page,
+// API clients receive a JSON response.
+func (s *Server) Logout(c *gin.Context) {
+	if login := currentLogin(c); login != nil {
+		if err := s.sessions.Logins.Revoke(login.ID); err != nil {
+			log.Error().Err(err).Msg("could not revoke login session")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not logout"})
+			return
+		}
+	}
+
+	if err := s.sessions.ClearAuthentication(c.Request, c.Writer); err != nil {
+		log.Error().Err(err).Msg("could not clear authenticated session")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not logout"})
+		return
+	}
+
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) {
+	case gin.MIMEHTML:
+		c.Redirect(http.StatusSeeOther, "/login")
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": "logout successful"})
+	}
+}
+
+// Issue an authenticated session after a successful login with the credential, tracking
+// the login session so that it can be listed and revoked; the login session of any user
+// that was previously logged in with the session is revoked. If token issuance is
+// enabled, access and refresh tokens bound to the login session are also returned. An
+// error is returned if the session could not be saved, in which case the error response
+// has already been written.
+func (s *Server) startSession(c *gin.Context, user *store.User, credential *webauthn.Credential, parsed *protocol.ParsedCredentialAssertionData) (tokens *v1.Tokens, err error) {
+	now := time.Now()
+	auth := &session.Authentication{
+		UserID:       user.WebAuthnID(),
+		CredentialID: credential.ID,
+		UserVerified: parsed.Response.AuthenticatorData.Flags.HasUserVerified(),
+		AuthTime:     now.UTC(),
+		Expires:      now.Add(s.conf.Session.Lifetime).UTC(),
+	}
+
+	login := &session.LoginSession{
+		UserID:       user.ID,
+		CredentialID: credential.ID,
+		UserVerified: auth.UserVerified,
+		ClientIP:     c.ClientIP(),
+		UserAgent:    c.Request.UserAgent(),
+		LastSeen:     auth.AuthTime,
+		Expires:      auth.Expires,
+	}
+
+	if err = s.sessions.Logins.Track(login); err != nil {
+		log.Error().Err(err).Msg("could not track login session")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not finish login"})
+		return nil, err
+	}
+	auth.SessionID = login.ID
+
+	if prev, _ := s.sessions.GetAuthentication(c.Request); prev != nil && prev.SessionID != "" {
+		if err = s.sessions.Logins.Revoke(prev.SessionID); err != nil {
+			log.Warn().Err(err).Msg("could not revoke previous login session")
+		}
+	}
+
+	if err = s.sessions.SaveAuthentication(auth, c.Request, c.Writer); err != nil {
+		log.Error().Err(err).Msg("could not save authenticated session")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not finish login"})
+		return nil, err
+	}
+
+	if s.tokens == nil {
+		return nil, nil
+	}
+
+	grant := &token.Grant{
+		UserID:       user.ID,
+		CredentialID: credential.ID,
+		UserVerified: auth.UserVerified,
+		SessionID:    login.ID,
+		AuthTime:     auth.AuthTime,
+		Expires:      auth.Expires,
+	}
+
+	var issued *token.Tokens
+	if issued, err = s.tokens.Issue(grant, user.WebAuthnName()); err != nil {
+		log.Error().Err(err).Msg("could not issue tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not finish login"})
+		return nil, err
+	}
+	return tokensReply(issued), nil
+}
+
+// ListSessions returns the active login sessions of the logged in user.
+func (s *Server) ListSessions(c *gin.Context) {
+	s.listSessions(c, CurrentUser(c))
+}
+
+// ListUserSessions returns the active login sessions of the user in the URL.
+func (s *Server) ListUserSessions(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+	s.listSessions(c, user)
+}
+
+func (s *Server) listSessions(c *gin.Context, user *store.User) {
+	sessions, err := s.activeSessions(user, currentLogin(c))
+	if err != nil {
+		log.Error().Err(err).Msg("could not list login sessions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not list sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, &v1.ActiveSessionList{Sessions: sessions})
+}
+
+// RevokeSession revokes one of the login sessions of the logged in user, e.g. on a
+// device that was lost. If the current session is revoked the user is logged out.
+func (s *Server) RevokeSession(c *gin.Context) {
+	user := CurrentUser(c)
+	login, err := s.sessions.Logins.Get(c.Param("sessionID"))
+	if err != nil || login.UserID != user.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": store.ErrSessionNotFound.Error()})
+		return
+	}
+
+	if err = s.sessions.Logins.Revoke(login.ID); err != nil {
+		log.Error().Err(err).Msg("could not revoke login session")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke session"})
+		return
+	}
+
+	if current := currentLogin(c); current != nil && current.ID == login.ID {
+		if err = s.sessions.ClearAuthentication(c.Request, c.Writer); err != nil {
+			log.Warn().Err(err).Msg("could not clear authenticated session")
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// RevokeUserSessions revokes all login sessions of the user in the URL, e.g. when the
+// account of the user has been compromised.
+func (s *Server) RevokeUserSessions(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+
+	revoked, err := s.revokeSessions(c, user, "revoked by user")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "sessions revoked", "revoked": revoked})
+}
+
+// Revoke all login sessions of the user, recording a security event if any sessions
+// were revoked. Errors are logged so that callers revoking sessions as a side effect
+// (e.g. when a credential is revoked) can ignore them.
+func (s *Server) revokeSessions(c *gin.Context, user *store.User, reason string) (revoked int, err error) {
+	if revoked, err = s.sessions.Logins.RevokeAll(user.ID); err != nil {
+		log.Error().Err(err).Str("user_id", user.ID.String()).Msg("could not revoke login sessions")
+		return 0, err
+	}
+
+	if revoked > 0 {
+		s.securityEvent(c, store.EventSessionsRevoked, user, nil, fmt.Sprintf("%d sessions revoked: %s", revoked, reason))
+	}
+	return revoked, nil
+}
+
+// Returns the active login sessions of the user, marking the current login session.
+func (s *Server) activeSessions(user *store.User, current *session.LoginSession) (_ []*v1.ActiveSession, err error) {
+	var logins []*session.LoginSession
+	if logins, err = s.sessions.Logins.List(user.ID); err != nil {
+		return nil, err
+	}
+
+	out := make([]*v1.ActiveSession, 0, len(logins))
+	for _, login := range logins {
+		reply := &v1.ActiveSession{
+			ID:           login.ID,
+			CredentialID: store.EncodeKeyID(login.CredentialID),
+			UserVerified: login.UserVerified,
+			ClientIP:     login.ClientIP,
+			UserAgent:    login.UserAgent,
+			Created:      login.Created.Format(time.RFC3339),
+			LastSeen:     login.LastSeen.Format(time.RFC3339),
+			Expires:      login.Expires.Format(time.RFC3339),
+			Current:      current != nil && current.ID == login.ID,
+		}
+
+		if cred, err := user.Credential(login.CredentialID); err == nil {
+			reply.Nickname = cred.Nickname
+		}
+		out = append(out, reply)
+	}
+	return out, nil
+}
+
+// sessionReply converts the logged in user and their session into its API
+// representation; nil is returned if the request is anonymous.
+func sessionReply(user *store.User, auth *session.Authentication) *v1.Session {
+	if user == nil || auth == nil {
+		return nil
+	}
+
+	user.RLock()
+	defer user.RUnlock()
+	return &v1.Session{
+		UserID:       user.ID.String(),
+		Name:         user.Name,
+		Email:        user.Email,
+		CredentialID: store.EncodeKeyID(auth.CredentialID),
+		UserVerified: auth.UserVerified,
+		AuthTime:     auth.AuthTime.Format(time.RFC3339),
+		Expires:      auth.Expires.Format(time.RFC3339),
+	}
+}
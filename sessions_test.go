@@ -0,0 +1,213 @@
+package yubikey
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestUserRoutesAuthorized(t *testing.T) {
+	s := newTestServer(t, config.Config{AllowOrigins: []string{"https://yubikey.local"}})
+	s.router = gin.New()
+	if err := s.setupRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	s.SetStatus(true, true)
+
+	owner, ownerCookie := testLogin(t, s, "jane@example.com")
+	_, otherCookie := testLogin(t, s, "john@example.com")
+
+	routes := []struct {
+		method string
+		path   string
+		owner  int // status for the owner, who has not reauthenticated
+	}{
+		{http.MethodGet, "/v1/users/%s", http.StatusOK},
+		{http.MethodDelete, "/v1/users/%s", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/users/%s/credentials", http.StatusOK},
+		{http.MethodGet, "/v1/users/%s/events", http.StatusOK},
+		{http.MethodGet, "/v1/users/%s/sessions", http.StatusOK},
+		{http.MethodDelete, "/v1/users/%s/sessions", http.StatusUnauthorized},
+	}
+
+	for _, route := range routes {
+		path := fmt.Sprintf(route.path, owner.ID)
+		tests := []struct {
+			name   string
+			cookie *http.Cookie
+			status int
+		}{
+			{"anonymous", nil, http.StatusUnauthorized},
+			{"other user", otherCookie, http.StatusForbidden},
+			{"owner", ownerCookie, route.owner},
+		}
+
+		for _, tc := range tests {
+			r := httptest.NewRequest(route.method, path, nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("%s %s as %s: expected status %d, got %d", route.method, path, tc.name, tc.status, w.Code)
+			}
+		}
+	}
+}
+
+// Creates a user with a credential and logs them in, returning the session cookie.
+func testLogin(t *testing.T, s *Server, email string) (*store.User, *http.Cookie) {
+	user, err := s.users.NewUser("Test User", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred := store.Credential{Credential: webauthn.Credential{ID: []byte(email)}}
+	if err = s.users.AddCredential(user, cred); err != nil {
+		t.Fatal(err)
+	}
+
+	login := &session.LoginSession{UserID: user.ID, CredentialID: cred.ID, Expires: time.Now().Add(time.Hour)}
+	if err = s.sessions.Logins.Track(login); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := &session.Authentication{
+		SessionID:    login.ID,
+		UserID:       user.WebAuthnID(),
+		CredentialID: cred.ID,
+		AuthTime:     time.Now(),
+		Expires:      login.Expires,
+	}
+
+	w := httptest.NewRecorder()
+	if err = s.sessions.SaveAuthentication(auth, httptest.NewRequest(http.MethodPost, "/", nil), w); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == session.WebauthnSession {
+			return user, cookie
+		}
+	}
+	t.Fatal("no session cookie set on login")
+	return nil, nil
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxies  []string
+		clientIP string
+	}{
+		{"no trusted proxies", nil, "192.0.2.1"},
+		{"untrusted proxy", []string{"198.51.100.0/24"}, "192.0.2.1"},
+		{"trusted proxy", []string{"192.0.2.0/24"}, "203.0.113.7"},
+	}
+
+	for _, tc := range tests {
+		conf, err := config.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.TrustedProxies = tc.proxies
+
+		s, err := New(conf)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		s.SetStatus(true, true)
+
+		user, cookie := testLogin(t, s, "jane@example.com")
+		r := httptest.NewRequest(http.MethodGet, "/v1/sessions", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		r.Header.Set("X-Forwarded-For", "203.0.113.7")
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", tc.name, http.StatusOK, w.Code)
+		}
+
+		logins, err := s.sessions.Logins.List(user.ID)
+		if err != nil || len(logins) != 1 {
+			t.Fatalf("%s: expected one login session, got %d (%v)", tc.name, len(logins), err)
+		}
+		if logins[0].ClientIP != tc.clientIP {
+			t.Errorf("%s: expected client ip %s, got %s", tc.name, tc.clientIP, logins[0].ClientIP)
+		}
+		s.users.Close()
+	}
+}
+
+func TestLogout(t *testing.T) {
+	tests := []struct {
+		name     string
+		loggedIn bool
+		accept   string
+		status   int
+	}{
+		{"api", true, "application/json", http.StatusOK},
+		{"browser", true, "text/html", http.StatusSeeOther},
+		{"anonymous", false, "application/json", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		s := newTestServer(t, config.Config{AllowOrigins: []string{"https://yubikey.local"}})
+		s.router = gin.New()
+		if err := s.setupRoutes(); err != nil {
+			t.Fatal(err)
+		}
+		s.SetStatus(true, true)
+
+		user, cookie := testLogin(t, s, "jane@example.com")
+		r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+		r.Header.Set("Accept", tc.accept)
+		if tc.loggedIn {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+			continue
+		}
+
+		if tc.status == http.StatusSeeOther && w.Header().Get("Location") != "/login" {
+			t.Errorf("%s: expected redirect to the login page, got %q", tc.name, w.Header().Get("Location"))
+		}
+
+		// Logging out revokes the login session so the session cookie can no longer be
+		// used, even if it was captured before the logout.
+		logins, _ := s.sessions.Logins.List(user.ID)
+		if revoked := len(logins) == 0; revoked != tc.loggedIn {
+			t.Errorf("%s: expected login session revoked %t, got %d sessions", tc.name, tc.loggedIn, len(logins))
+		}
+
+		r = httptest.NewRequest(http.MethodGet, "/v1/session", nil)
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+
+		expected := http.StatusOK
+		if tc.loggedIn {
+			expected = http.StatusUnauthorized
+		}
+
+		if w.Code != expected {
+			t.Errorf("%s: expected the previous session cookie to return %d, got %d", tc.name, expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import "github.com/google/uuid"
+
+// UnknownAuthenticator is returned when the AAGUID of an authenticator is not known.
+const UnknownAuthenticator = "Unknown Authenticator"
+
+// Well known authenticator AAGUIDs and their human-readable names. This list is not
+// exhaustive and primarily covers Yubico security keys and common platform passkeys.
+var authenticators = map[uuid.UUID]string{
+	uuid.MustParse("cb69481e-8ff7-4039-93ec-0a2729a154a8"): "YubiKey 5 Series",
+	uuid.MustParse("ee882879-721c-4913-9775-3dfcce97072a"): "YubiKey 5 Series",
+	uuid.MustParse("fa2b99dc-9e39-4257-8f92-4a30d23c4118"): "YubiKey 5 Series with NFC",
+	uuid.MustParse("2fc0579f-8113-47ea-b116-bb5a8db9202a"): "YubiKey 5 Series with NFC",
+	uuid.MustParse("c5ef55ff-ad9a-4b9f-b580-adebafe026d0"): "YubiKey 5Ci",
+	uuid.MustParse("73bb0cd4-e502-49b8-9c6f-b59445bf720b"): "YubiKey 5 FIPS Series",
+	uuid.MustParse("c1f9a0bc-1dd2-404a-b27f-8e29047a43fd"): "YubiKey 5 FIPS Series with NFC",
+	uuid.MustParse("85203421-48f9-4355-9bc8-8a53846e5083"): "YubiKey 5Ci FIPS",
+	uuid.MustParse("d8522d9f-575b-4866-88a9-ba99fa02f35b"): "YubiKey Bio Series",
+	uuid.MustParse("f8a011f3-8c0a-4d15-8006-17111f9edc7d"): "Security Key by Yubico",
+	uuid.MustParse("b92c3f9a-c014-4056-887f-140a2501163b"): "Security Key by Yubico",
+	uuid.MustParse("6d44ba9b-f6ec-2e49-b930-0c8fe920cb73"): "Security Key by Yubico with NFC",
+	uuid.MustParse("149a2021-8ef6-4133-96b8-81f8d5b7f1f5"): "Security Key by Yubico with NFC",
+	uuid.MustParse("a4e9fc6d-4cbe-4758-b8ba-37598bb5bbaa"): "Security Key NFC by Yubico",
+	uuid.MustParse("0bb43545-fd2c-4185-87dd-feb0b2916ace"): "Security Key NFC by Yubico - Enterprise Edition",
+	uuid.MustParse("ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4"): "Google Password Manager",
+	uuid.MustParse("adce0002-35bc-c60a-648b-0b25f1f05503"): "Chrome on Mac",
+	uuid.MustParse("fbfc3007-154e-4ecc-8c0b-6e020557d7bd"): "iCloud Keychain",
+	uuid.MustParse("08987058-cadc-4b81-b6e1-30de50dcbe96"): "Windows Hello",
+	uuid.MustParse("9ddd1817-af5a-4672-a2b9-3e3dd95000a9"): "Windows Hello",
+	uuid.MustParse("6028b017-b1d4-4c02-b4b3-afcdafc96bb2"): "Windows Hello",
+	uuid.MustParse("bada5566-a7aa-401f-bd96-45619a55120d"): "1Password",
+	uuid.MustParse("d548826e-79b4-db40-a3d8-11116f7e8349"): "Bitwarden",
+	uuid.MustParse("531126d6-e717-415c-9320-3d9aa6981239"): "Dashlane",
+}
+
+// AuthenticatorName returns the human-readable name of the authenticator model with
+// the specified AAGUID or UnknownAuthenticator if it is not recognized.
+func AuthenticatorName(aaguid uuid.UUID) string {
+	if name, ok := authenticators[aaguid]; ok {
+		return name
+	}
+	return UnknownAuthenticator
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Credential wraps a webauthn credential with metadata that helps users identify which
+// of their authenticators is which and supports auditing of how the credential is used.
+type Credential struct {
+	webauthn.Credential
+	Nickname   string    // user-editable name of the credential
+	Created    time.Time // timestamp the credential was registered
+	LastUsed   time.Time // timestamp of the last successful assertion with the credential
+	ClientIP   string    // client IP address at registration
+	UserAgent  string    // client user agent at registration
+	Revoked    time.Time // timestamp the credential was disabled; zero if active
+	Reason     string    // the reason the credential was disabled
+	Algorithm  int64     // COSE algorithm identifier of the public key chosen by the authenticator
+	Metadata   AuthenticatorMetadata
+	Extensions CredentialExtensions
+}
+
+// AuthenticatorMetadata is the metadata of the authenticator model resolved from the FIDO
+// Metadata Service when the credential was registered, along with the result of
+// verifying the attestation statement against it.
+type AuthenticatorMetadata struct {
+	Format      string `json:"format,omitempty"`      // attestation statement format, e.g. packed
+	Verified    bool   `json:"verified"`              // attestation chains to a metadata root certificate
+	Description string `json:"description,omitempty"` // authenticator model description from the metadata
+	Status      string `json:"status,omitempty"`      // most recent status report of the model
+	StatusDate  string `json:"status_date,omitempty"` // effective date of the status report
+	Serial      int    `json:"serial,omitempty"`      // serial number of the metadata blob used
+}
+
+// CredentialExtensions are the results of the webauthn extensions returned by the client
+// and authenticator during registration and updated when the credential is used.
+type CredentialExtensions struct {
+	ResidentKey *bool `json:"rk,omitempty"`           // credProps: the credential is discoverable, nil if unknown
+	CredProtect int   `json:"cred_protect,omitempty"` // credProtect: the protection level set by the authenticator
+	PRF         bool  `json:"prf,omitempty"`          // prf: the credential supports the pseudo-random function
+	LargeBlob   bool  `json:"large_blob,omitempty"`   // largeBlob: the credential supports storing large blobs
+}
+
+// IsRevoked returns true if the credential has been disabled and can no longer be used.
+func (c Credential) IsRevoked() bool {
+	return !c.Revoked.IsZero()
+}
+
+// Revoke marks the credential as revoked with the reason if it is not already revoked.
+func (c *Credential) Revoke(reason string) {
+	if c.IsRevoked() {
+		return
+	}
+	c.Revoked = time.Now().UTC()
+	c.Reason = reason
+}
+
+// KeyID returns the URL-safe base64 encoded credential ID, e.g. for use in URLs.
+func (c Credential) KeyID() string {
+	return credentialKey(c.ID)
+}
+
+// AAGUID returns the authenticator attestation GUID as a UUID or uuid.Nil if the
+// authenticator did not provide one (e.g. with none attestation or U2F).
+func (c Credential) AAGUID() uuid.UUID {
+	if aaguid, err := uuid.FromBytes(c.Authenticator.AAGUID); err == nil {
+		return aaguid
+	}
+	return uuid.Nil
+}
+
+// AuthenticatorName returns a human-readable name for the authenticator model from its
+// metadata or based on its AAGUID, or "Unknown Authenticator" if it is not recognized.
+func (c Credential) AuthenticatorName() string {
+	if c.Metadata.Description != "" {
+		return c.Metadata.Description
+	}
+	return AuthenticatorName(c.AAGUID())
+}
+
+// KeyAlgorithm returns the COSE algorithm identifier of the credential public key. For
+// credentials registered before the algorithm was recorded, it is parsed from the key.
+func (c Credential) KeyAlgorithm() int64 {
+	if c.Algorithm != 0 {
+		return c.Algorithm
+	}
+	return PublicKeyAlgorithm(c.PublicKey)
+}
+
+// PublicKeyAlgorithm returns the COSE algorithm identifier of a COSE encoded public key
+// or 0 if the key cannot be parsed.
+func PublicKeyAlgorithm(publicKey []byte) int64 {
+	key, err := webauthncose.ParsePublicKey(publicKey)
+	if err != nil {
+		return 0
+	}
+
+	switch key := key.(type) {
+	case webauthncose.EC2PublicKeyData:
+		return key.Algorithm
+	case webauthncose.OKPPublicKeyData:
+		return key.Algorithm
+	case webauthncose.RSAPublicKeyData:
+		return key.Algorithm
+	default:
+		return 0
+	}
+}
+
+// TransportNames returns the transports supported by the authenticator as strings.
+func (c Credential) TransportNames() []string {
+	transports := make([]string, 0, len(c.Transport))
+	for _, transport := range c.Transport {
+		transports = append(transports, string(transport))
+	}
+	return transports
+}
+
+// EncodeKeyID returns the URL-safe base64 encoding of a credential ID.
+func EncodeKeyID(credentialID []byte) string {
+	return credentialKey(credentialID)
+}
+
+// DecodeKeyID parses a URL-safe base64 encoded credential ID as returned by KeyID.
+func DecodeKeyID(keyID string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(keyID, "="))
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	dataKeyLength    = 32
+	masterKeyLength  = 32
+	ciphertextPrefix = 0x01
+	blindIndexInfo   = "yubikey blind index v1"
+)
+
+// MasterKey encrypts (wraps) the data key that is used to encrypt the fields of the
+// store. Master keys are supplied by the configuration and are never persisted.
+type MasterKey struct {
+	ID  string
+	key []byte
+}
+
+// NewMasterKey creates a master key from 32 bytes of key material; the ID of the key
+// is derived from the key material so that the key used to wrap a data key is known.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != masterKeyLength {
+		return nil, fmt.Errorf("master key must be %d bytes", masterKeyLength)
+	}
+
+	sum := sha256.Sum256(key)
+	return &MasterKey{ID: hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+// GenerateMasterKey returns a new random master key encoded as base64 for use in the
+// configuration.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, masterKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// WrappedKey is a data key encrypted by a master key that is persisted by the store.
+type WrappedKey struct {
+	Key         []byte    `json:"key"`
+	MasterKeyID string    `json:"master_key_id"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+}
+
+// Keyring performs envelope encryption of the fields in the store with a data key that
+// is wrapped by a master key. The blind index key is derived from the data key so that
+// rotating the master key (which only re-wraps the data key) does not change the blind
+// index. A nil Keyring performs no encryption so that stores without master keys
+// continue to store plaintext.
+type Keyring struct {
+	aead     cipher.AEAD
+	index    []byte
+	unlocked string // ID of the master key that wrapped the stored data key, empty if new
+	wrapped  string // ID of the master key that wraps the data key after unlocking
+}
+
+// Encrypted is implemented by stores that can encrypt data at rest so that master key
+// rotation can be verified by the command line.
+type Encrypted interface {
+	// Returns the ID of the master key that wrapped the data key when the store was
+	// opened (empty if the data key was generated when opened) and the ID of the master
+	// key that wraps the data key now; both are empty if the store is not encrypted.
+	MasterKeyIDs() (opened, current string)
+}
+
+// UnlockKeyring unwraps the data key with the master key that wrapped it. The first
+// master key is the active key; if the data key was wrapped by a previous master key it
+// is re-wrapped with the active key and the new wrapped key is returned so that the
+// store can persist it. If there is no wrapped key, a new data key is generated. The
+// IDs of the master keys that wrapped the data key before and after unlocking are
+// returned by the MasterKeyIDs method of the keyring.
+func UnlockKeyring(stored *WrappedKey, masterKeys []*MasterKey) (ring *Keyring, wrapped *WrappedKey, err error) {
+	if len(masterKeys) == 0 {
+		if stored != nil {
+			return nil, nil, ErrMissingMasterKey
+		}
+		return nil, nil, nil
+	}
+
+	active := masterKeys[0]
+	now := time.Now().UTC()
+
+	var dek []byte
+	if stored == nil {
+		dek = make([]byte, dataKeyLength)
+		if _, err = rand.Read(dek); err != nil {
+			return nil, nil, err
+		}
+		wrapped = &WrappedKey{MasterKeyID: active.ID, Created: now}
+	} else {
+		var master *MasterKey
+		for _, key := range masterKeys {
+			if key.ID == stored.MasterKeyID {
+				master = key
+				break
+			}
+		}
+
+		if master == nil {
+			return nil, nil, fmt.Errorf("%w: data key is wrapped by master key %s", ErrMissingMasterKey, stored.MasterKeyID)
+		}
+
+		if dek, err = open(master.key, stored.Key); err != nil {
+			return nil, nil, fmt.Errorf("could not unwrap data key: %w", err)
+		}
+
+		// Re-wrap the data key if the active master key has been rotated.
+		if master.ID != active.ID {
+			wrapped = &WrappedKey{MasterKeyID: active.ID, Created: stored.Created}
+		}
+	}
+
+	if wrapped != nil {
+		if wrapped.Key, err = seal(active.key, dek); err != nil {
+			return nil, nil, err
+		}
+		wrapped.Modified = now
+	}
+
+	if ring, err = newKeyring(dek); err != nil {
+		return nil, nil, err
+	}
+
+	if stored != nil {
+		ring.unlocked = stored.MasterKeyID
+		ring.wrapped = stored.MasterKeyID
+	}
+
+	if wrapped != nil {
+		ring.wrapped = wrapped.MasterKeyID
+	}
+	return ring, wrapped, nil
+}
+
+// MasterKeyIDs returns the IDs of the master keys that wrapped the data key before and
+// after the keyring was unlocked; both are empty if the keyring is nil.
+func (k *Keyring) MasterKeyIDs() (opened, current string) {
+	if k == nil {
+		return "", ""
+	}
+	return k.unlocked, k.wrapped
+}
+
+func newKeyring(dek []byte) (_ *Keyring, err error) {
+	ring := &Keyring{}
+	if ring.aead, err = newAEAD(dek); err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, dek)
+	mac.Write([]byte(blindIndexInfo))
+	ring.index = mac.Sum(nil)
+	return ring, nil
+}
+
+// Encrypt the plaintext with the data key; returns the plaintext if the keyring is nil.
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+	return sealAEAD(k.aead, plaintext)
+}
+
+// Decrypt the ciphertext with the data key; returns the ciphertext if the keyring is nil.
+func (k *Keyring) Decrypt(ciphertext []byte) ([]byte, error) {
+	if k == nil {
+		return ciphertext, nil
+	}
+	return openAEAD(k.aead, ciphertext)
+}
+
+// BlindIndex returns a keyed hash of the value so that encrypted fields can be looked
+// up by equality without decrypting them; returns the value if the keyring is nil.
+func (k *Keyring) BlindIndex(value string) string {
+	if k == nil {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if the data appears to have been encrypted by a keyring.
+func isCiphertext(data []byte) bool {
+	return len(data) > 0 && data[0] == ciphertextPrefix
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return sealAEAD(aead, plaintext)
+}
+
+func open(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, ciphertext)
+}
+
+// Ciphertexts are formatted as prefix || nonce || sealed data.
+func sealAEAD(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = ciphertextPrefix
+	if _, err := io.ReadFull(rand.Reader, out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plaintext, nil), nil
+}
+
+func openAEAD(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if !isCiphertext(ciphertext) || len(ciphertext) < 1+aead.NonceSize() {
+		return nil, ErrNotEncrypted
+	}
+
+	nonce := ciphertext[1 : 1+aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[1+aead.NonceSize():], nil)
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	ring, wrapped, err := UnlockKeyring(nil, []*MasterKey{testMasterKey(t, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wrapped == nil {
+		t.Fatal("expected a new wrapped data key")
+	}
+
+	tests := [][]byte{
+		[]byte("jane@example.com"),
+		{},
+		bytes.Repeat([]byte{0x42}, 4096),
+	}
+
+	for _, plaintext := range tests {
+		ciphertext, err := ring.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !isCiphertext(ciphertext) || (len(plaintext) > 0 && bytes.Contains(ciphertext, plaintext)) {
+			t.Errorf("expected %d bytes to be encrypted", len(plaintext))
+		}
+
+		decrypted, err := ring.Decrypt(ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("expected %d bytes to be decrypted", len(plaintext))
+		}
+
+		// Tampering with the ciphertext must be detected.
+		ciphertext[len(ciphertext)-1] ^= 0xff
+		if _, err = ring.Decrypt(ciphertext); err == nil {
+			t.Error("expected tampered ciphertext to fail to decrypt")
+		}
+	}
+
+	if _, err = ring.Decrypt([]byte("plaintext")); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("expected plaintext to be rejected, got %v", err)
+	}
+
+	if ring.BlindIndex("jane@example.com") != ring.BlindIndex("jane@example.com") {
+		t.Error("expected the blind index to be deterministic")
+	}
+
+	if ring.BlindIndex("jane@example.com") == ring.BlindIndex("john@example.com") {
+		t.Error("expected different values to have different blind indices")
+	}
+
+	// A nil keyring stores plaintext.
+	var none *Keyring
+	if data, err := none.Encrypt([]byte("plaintext")); err != nil || string(data) != "plaintext" {
+		t.Errorf("expected a nil keyring to return the plaintext, got %q %v", data, err)
+	}
+
+	if none.BlindIndex("jane@example.com") != "jane@example.com" {
+		t.Error("expected a nil keyring to return the value as its index")
+	}
+}
+
+func TestUnlockKeyring(t *testing.T) {
+	k1, k2, k3 := testMasterKey(t, 1), testMasterKey(t, 2), testMasterKey(t, 3)
+
+	// Create a data key wrapped by the first master key.
+	original, stored, err := UnlockKeyring(nil, []*MasterKey{k1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := original.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stored  *WrappedKey
+		keys    []*MasterKey
+		err     error
+		rewrap  bool
+		opened  string
+		current string
+	}{
+		{"unencrypted", nil, nil, nil, false, "", ""},
+		{"missing master key", stored, nil, ErrMissingMasterKey, false, "", ""},
+		{"unknown master key", stored, []*MasterKey{k2, k3}, ErrMissingMasterKey, false, "", ""},
+		{"same master key", stored, []*MasterKey{k1}, nil, false, k1.ID, k1.ID},
+		{"previous key retained", stored, []*MasterKey{k1, k2}, nil, false, k1.ID, k1.ID},
+		{"rotated", stored, []*MasterKey{k2, k1}, nil, true, k1.ID, k2.ID},
+		{"rotated with older keys", stored, []*MasterKey{k3, k2, k1}, nil, true, k1.ID, k3.ID},
+	}
+
+	for _, tc := range tests {
+		ring, wrapped, err := UnlockKeyring(tc.stored, tc.keys)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		if err != nil || tc.stored == nil {
+			continue
+		}
+
+		if (wrapped != nil) != tc.rewrap {
+			t.Errorf("%s: expected rewrap %t", tc.name, tc.rewrap)
+		}
+
+		if wrapped != nil && (wrapped.MasterKeyID != tc.keys[0].ID || wrapped.Created != stored.Created) {
+			t.Errorf("%s: expected the data key to be wrapped by the active master key", tc.name)
+		}
+
+		if opened, current := ring.MasterKeyIDs(); opened != tc.opened || current != tc.current {
+			t.Errorf("%s: expected master keys %q -> %q, got %q -> %q", tc.name, tc.opened, tc.current, opened, current)
+		}
+
+		// The data key, and therefore the data and blind index, must not change.
+		if plaintext, err := ring.Decrypt(ciphertext); err != nil || string(plaintext) != "secret" {
+			t.Errorf("%s: could not decrypt data encrypted before the rotation: %v", tc.name, err)
+		}
+
+		if ring.BlindIndex("jane@example.com") != original.BlindIndex("jane@example.com") {
+			t.Errorf("%s: expected the blind index to be unchanged", tc.name)
+		}
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	k1, k2 := testMasterKey(t, 1), testMasterKey(t, 2)
+	tests := []struct {
+		name string
+		open func(path string, keys ...*MasterKey) (Store, error)
+	}{
+		{"sqlite", func(path string, keys ...*MasterKey) (Store, error) {
+			return OpenSQLite(filepath.Join(path, "yubikey.db"), keys...)
+		}},
+		{"wal", func(path string, keys ...*MasterKey) (Store, error) {
+			return OpenWAL(path, keys...)
+		}},
+	}
+
+	for _, tc := range tests {
+		dir := t.TempDir()
+		steps := []struct {
+			keys    []*MasterKey
+			err     error
+			opened  string
+			current string
+		}{
+			{[]*MasterKey{k1}, nil, "", k1.ID},
+			{[]*MasterKey{k1}, nil, k1.ID, k1.ID},
+			{[]*MasterKey{k2, k1}, nil, k1.ID, k2.ID},
+			{[]*MasterKey{k2}, nil, k2.ID, k2.ID},
+			{[]*MasterKey{k1}, ErrMissingMasterKey, "", ""},
+			{nil, ErrMissingMasterKey, "", ""},
+		}
+
+		for i, step := range steps {
+			db, err := tc.open(dir, step.keys...)
+			if !errors.Is(err, step.err) {
+				t.Fatalf("%s step %d: expected error %v, got %v", tc.name, i, step.err, err)
+			}
+
+			if err != nil {
+				continue
+			}
+
+			if i == 0 {
+				if _, err = db.NewUser("Jane Doe", "jane@example.com"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if opened, current := db.(Encrypted).MasterKeyIDs(); opened != step.opened || current != step.current {
+				t.Errorf("%s step %d: expected master keys %q -> %q, got %q -> %q", tc.name, i, step.opened, step.current, opened, current)
+			}
+
+			if _, err = db.GetUser("jane@example.com"); err != nil {
+				t.Errorf("%s step %d: could not read user after rotation: %s", tc.name, i, err)
+			}
+			db.Close()
+		}
+	}
+}
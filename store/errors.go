@@ -0,0 +1,18 @@
+package store
+
+import "errors"
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserAlreadyExists  = errors.New("user already exists")
+	ErrUnknownIDType      = errors.New("unknown user ID type must be uuid")
+	ErrCredentialNotFound = errors.New("credential not found")
+	ErrCredentialExists   = errors.New("credential already assigned")
+	ErrInvalidDSN         = errors.New("could not parse database dsn")
+	ErrStoreLocked        = errors.New("store is locked by another process")
+	ErrInvalidExport      = errors.New("invalid export")
+	ErrMissingMasterKey   = errors.New("store is encrypted but the master key is not configured")
+	ErrNotEncrypted       = errors.New("data is not encrypted")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrCorruptLog         = errors.New("write-ahead log is corrupt")
+)
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Security event types recorded by the server.
+const (
+	EventCloneWarning         = "clone_warning"
+	EventCredentialRevoked    = "credential_revoked"
+	EventCredentialDeleted    = "credential_deleted"
+	EventEmailChanged         = "email_changed"
+	EventUserDeleted          = "user_deleted"
+	EventAttestationRejected  = "attestation_rejected"
+	EventPolicyRejected       = "policy_rejected"
+	EventTransactionConfirmed = "transaction_confirmed"
+	EventSessionsRevoked      = "sessions_revoked"
+	EventRefreshTokenReused   = "refresh_token_reused"
+)
+
+// SecurityEvent is an audit record of a security-relevant occurrence such as a sign
+// counter regression. Events are kept even if the user or credential is deleted.
+type SecurityEvent struct {
+	ID           uuid.UUID
+	Type         string
+	UserID       uuid.UUID
+	CredentialID []byte
+	ClientIP     string
+	Detail       string
+	Created      time.Time
+}
+
+// EventStore records and lists security events.
+type EventStore interface {
+	// Record a security event; the ID and Created timestamp are set if they are zero.
+	RecordEvent(event *SecurityEvent) error
+
+	// List security events for the specified user, or all events if the user ID is
+	// uuid.Nil, ordered by the time they were created.
+	ListEvents(userID uuid.UUID) ([]*SecurityEvent, error)
+}
+
+// Sets the ID and timestamp of the event if they have not already been set.
+func (e *SecurityEvent) init() {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+
+	if e.Created.IsZero() {
+		e.Created = time.Now().UTC()
+	}
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// ExportVersion is the current version of the export format; exports with a newer
+// version cannot be imported.
+const ExportVersion = 1
+
+// Export formats that can be written and read.
+const (
+	FormatJSON = "json"
+	FormatCBOR = "cbor"
+)
+
+// Export is a versioned snapshot of all users and their credentials, including public
+// keys, that can be imported into another store (e.g. to move registrations between
+// staging and production).
+type Export struct {
+	Version  int           `json:"version"`
+	Exported time.Time     `json:"exported"`
+	Users    []*ExportUser `json:"users"`
+}
+
+// ExportUser is a user and their credentials in the export format.
+type ExportUser struct {
+	ID          uuid.UUID           `json:"id"`
+	Name        string              `json:"name"`
+	Email       string              `json:"email"`
+	Credentials []*ExportCredential `json:"credentials"`
+}
+
+// ExportCredential is a credential in the export format. Byte fields are base64
+// encoded in JSON and stored as byte strings in CBOR.
+type ExportCredential struct {
+	ID              []byte     `json:"id"`
+	PublicKey       []byte     `json:"public_key"`
+	AttestationType string     `json:"attestation_type"`
+	Transports      []string   `json:"transports"`
+	UserPresent     bool       `json:"user_present"`
+	UserVerified    bool       `json:"user_verified"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	AAGUID          []byte     `json:"aaguid"`
+	SignCount       uint32     `json:"sign_count"`
+	CloneWarning    bool       `json:"clone_warning"`
+	Attachment      string     `json:"attachment,omitempty"`
+	Nickname        string     `json:"nickname"`
+	Created         time.Time  `json:"created"`
+	LastUsed        *time.Time `json:"last_used,omitempty"`
+	ClientIP        string     `json:"client_ip,omitempty"`
+	UserAgent       string     `json:"user_agent,omitempty"`
+	Revoked         *time.Time `json:"revoked,omitempty"`
+	Reason          string     `json:"reason,omitempty"`
+	Algorithm       int64      `json:"algorithm,omitempty"`
+
+	Metadata   *AuthenticatorMetadata `json:"metadata,omitempty"`
+	Extensions *CredentialExtensions  `json:"extensions,omitempty"`
+}
+
+// ExportUsers creates an export of all users and credentials in the store.
+func ExportUsers(db UserStore) (_ *Export, err error) {
+	var users []*User
+	if users, err = db.ListUsers(); err != nil {
+		return nil, err
+	}
+
+	out := &Export{
+		Version:  ExportVersion,
+		Exported: time.Now().UTC(),
+		Users:    make([]*ExportUser, 0, len(users)),
+	}
+
+	for _, user := range users {
+		user.RLock()
+		rec := user.record()
+		user.RUnlock()
+
+		xu := &ExportUser{
+			ID:          rec.ID,
+			Name:        rec.Name,
+			Email:       rec.Email,
+			Credentials: make([]*ExportCredential, 0, len(rec.Credentials)),
+		}
+
+		for _, cred := range rec.Credentials {
+			xu.Credentials = append(xu.Credentials, exportCredential(cred))
+		}
+		out.Users = append(out.Users, xu)
+	}
+	return out, nil
+}
+
+// ImportUsers validates the export against the store then inserts all of its users and
+// credentials, preserving user IDs so that discoverable credentials remain valid. The
+// import is rejected before any changes are made if a user ID or email address already
+// exists or if any credential ID is already assigned, either in the store or within
+// the export itself. If an insert fails, the users that were already imported are
+// deleted so that the import can be retried.
+func ImportUsers(db UserStore, data *Export) (err error) {
+	if err = data.Validate(db); err != nil {
+		return err
+	}
+
+	imported := make([]uuid.UUID, 0, len(data.Users))
+	defer func() {
+		if err != nil {
+			for _, id := range imported {
+				if rerr := db.DeleteUser(id); rerr != nil {
+					err = errors.Join(err, fmt.Errorf("could not roll back import of user %s: %w", id, rerr))
+				}
+			}
+		}
+	}()
+
+	for _, xu := range data.Users {
+		var user *User
+		if user, err = db.InsertUser(xu.ID, xu.Name, xu.Email); err != nil {
+			return fmt.Errorf("could not import user %s: %w", xu.Email, err)
+		}
+		imported = append(imported, user.ID)
+
+		for _, xc := range xu.Credentials {
+			if err = db.AddCredential(user, xc.credential()); err != nil {
+				return fmt.Errorf("could not import credential %s: %w", EncodeKeyID(xc.ID), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate that the export can be imported into the store without conflicts.
+func (e *Export) Validate(db UserStore) error {
+	if e.Version < 1 || e.Version > ExportVersion {
+		return fmt.Errorf("%w: unsupported export version %d", ErrInvalidExport, e.Version)
+	}
+
+	var (
+		errs   []error
+		ids    = make(map[uuid.UUID]struct{})
+		emails = make(map[string]struct{})
+		creds  = make(map[string]struct{})
+	)
+
+	for _, xu := range e.Users {
+		if xu.ID == uuid.Nil || xu.Email == "" {
+			errs = append(errs, fmt.Errorf("user %q is missing an id or email", xu.Email))
+			continue
+		}
+
+		if _, ok := ids[xu.ID]; ok {
+			errs = append(errs, fmt.Errorf("user id %s is duplicated in export", xu.ID))
+		} else if _, err := db.Lookup(xu.ID); err == nil {
+			errs = append(errs, fmt.Errorf("user id %s already exists", xu.ID))
+		}
+		ids[xu.ID] = struct{}{}
+
+		if _, ok := emails[xu.Email]; ok {
+			errs = append(errs, fmt.Errorf("email %s is duplicated in export", xu.Email))
+		} else if _, err := db.GetUser(xu.Email); err == nil {
+			errs = append(errs, fmt.Errorf("email %s already exists", xu.Email))
+		}
+		emails[xu.Email] = struct{}{}
+
+		for _, xc := range xu.Credentials {
+			key := EncodeKeyID(xc.ID)
+			if len(xc.ID) == 0 || len(xc.PublicKey) == 0 {
+				errs = append(errs, fmt.Errorf("credential %q of user %s is missing an id or public key", key, xu.Email))
+				continue
+			}
+
+			cred := xc.credential()
+			if _, ok := creds[key]; ok {
+				errs = append(errs, fmt.Errorf("credential %s is duplicated in export", key))
+			} else if db.CredentialExists(&cred.Credential) {
+				errs = append(errs, fmt.Errorf("credential %s is already assigned", key))
+			}
+			creds[key] = struct{}{}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidExport, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Write the export to the writer in the specified format.
+func (e *Export) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(e)
+	case FormatCBOR:
+		return cbor.NewEncoder(w).Encode(e)
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// ReadExport reads an export in the specified format from the reader.
+func ReadExport(r io.Reader, format string) (data *Export, err error) {
+	data = &Export{}
+	switch format {
+	case FormatJSON:
+		err = json.NewDecoder(r).Decode(data)
+	case FormatCBOR:
+		err = cbor.NewDecoder(r).Decode(data)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidExport, err)
+	}
+	return data, nil
+}
+
+func exportCredential(cred Credential) *ExportCredential {
+	xc := &ExportCredential{
+		ID:              cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		Transports:      cred.TransportNames(),
+		UserPresent:     cred.Flags.UserPresent,
+		UserVerified:    cred.Flags.UserVerified,
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		AAGUID:          cred.Authenticator.AAGUID,
+		SignCount:       cred.Authenticator.SignCount,
+		CloneWarning:    cred.Authenticator.CloneWarning,
+		Attachment:      string(cred.Authenticator.Attachment),
+		Nickname:        cred.Nickname,
+		Created:         cred.Created,
+		LastUsed:        timePtr(cred.LastUsed),
+		ClientIP:        cred.ClientIP,
+		UserAgent:       cred.UserAgent,
+		Revoked:         timePtr(cred.Revoked),
+		Reason:          cred.Reason,
+		Algorithm:       cred.Algorithm,
+	}
+
+	if cred.Metadata != (AuthenticatorMetadata{}) {
+		metadata := cred.Metadata
+		xc.Metadata = &metadata
+	}
+
+	if cred.Extensions != (CredentialExtensions{}) {
+		extensions := cred.Extensions
+		xc.Extensions = &extensions
+	}
+	return xc
+}
+
+func (xc *ExportCredential) credential() Credential {
+	cred := Credential{
+		Credential: webauthn.Credential{
+			ID:              xc.ID,
+			PublicKey:       xc.PublicKey,
+			AttestationType: xc.AttestationType,
+			Transport:       make([]protocol.AuthenticatorTransport, 0, len(xc.Transports)),
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    xc.UserPresent,
+				UserVerified:   xc.UserVerified,
+				BackupEligible: xc.BackupEligible,
+				BackupState:    xc.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       xc.AAGUID,
+				SignCount:    xc.SignCount,
+				CloneWarning: xc.CloneWarning,
+				Attachment:   protocol.AuthenticatorAttachment(xc.Attachment),
+			},
+		},
+		Nickname:  xc.Nickname,
+		Created:   xc.Created,
+		ClientIP:  xc.ClientIP,
+		UserAgent: xc.UserAgent,
+		Reason:    xc.Reason,
+		Algorithm: xc.Algorithm,
+	}
+
+	if xc.LastUsed != nil {
+		cred.LastUsed = *xc.LastUsed
+	}
+
+	if xc.Revoked != nil {
+		cred.Revoked = *xc.Revoked
+	}
+
+	if xc.Metadata != nil {
+		cred.Metadata = *xc.Metadata
+	}
+
+	if xc.Extensions != nil {
+		cred.Extensions = *xc.Extensions
+	}
+
+	for _, transport := range xc.Transports {
+		cred.Transport = append(cred.Transport, protocol.AuthenticatorTransport(transport))
+	}
+	return cred
+}
+
+// Returns nil for zero-valued timestamps so that they are omitted from the export.
+func timePtr(ts time.Time) *time.Time {
+	if ts.IsZero() {
+		return nil
+	}
+	return &ts
+}
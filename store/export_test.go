@@ -0,0 +1,223 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestExportImport(t *testing.T) {
+	tests := []struct {
+		format string
+		dst    func(t *testing.T) Store
+	}{
+		{FormatJSON, func(*testing.T) Store { return NewMemory() }},
+		{FormatCBOR, func(*testing.T) Store { return NewMemory() }},
+		{FormatJSON, func(t *testing.T) Store { return openTestSQLite(t, testMasterKey(t, 2)) }},
+		{FormatCBOR, func(t *testing.T) Store { return openTestSQLite(t) }},
+	}
+
+	src := NewMemory()
+	users := populate(t, src, 3, 2)
+
+	for _, tc := range tests {
+		export, err := ExportUsers(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err = export.Write(buf, tc.format); err != nil {
+			t.Fatalf("%s: could not write export: %s", tc.format, err)
+		}
+
+		var data *Export
+		if data, err = ReadExport(buf, tc.format); err != nil {
+			t.Fatalf("%s: could not read export: %s", tc.format, err)
+		}
+
+		dst := tc.dst(t)
+		if err = ImportUsers(dst, data); err != nil {
+			t.Fatalf("%s: could not import: %s", tc.format, err)
+		}
+
+		for _, user := range users {
+			imported, err := dst.GetUser(user.Email)
+			if err != nil {
+				t.Fatalf("%s: user %s was not imported: %s", tc.format, user.Email, err)
+			}
+
+			if imported.ID != user.ID || imported.Name != user.Name {
+				t.Errorf("%s: expected user %s %q, got %s %q", tc.format, user.ID, user.Name, imported.ID, imported.Name)
+			}
+
+			expected, actual := user.Credentials(), imported.Credentials()
+			if len(actual) != len(expected) {
+				t.Fatalf("%s: expected %d credentials, got %d", tc.format, len(expected), len(actual))
+			}
+
+			for i := range expected {
+				if !bytes.Equal(actual[i].ID, expected[i].ID) || !bytes.Equal(actual[i].PublicKey, expected[i].PublicKey) {
+					t.Errorf("%s: credential %d was not imported correctly", tc.format, i)
+				}
+
+				if actual[i].Nickname != expected[i].Nickname || actual[i].Authenticator.SignCount != expected[i].Authenticator.SignCount {
+					t.Errorf("%s: credential %d metadata was not imported correctly", tc.format, i)
+				}
+
+				if actual[i].IsRevoked() != expected[i].IsRevoked() || actual[i].Reason != expected[i].Reason {
+					t.Errorf("%s: credential %d revocation was not imported correctly", tc.format, i)
+				}
+			}
+
+			if found, _, err := dst.LookupByCredentialID(expected[0].ID); err != nil || found.ID != user.ID {
+				t.Errorf("%s: credential index was not updated: %v", tc.format, err)
+			}
+		}
+
+		// Importing the same export again must be rejected without changes.
+		if err = ImportUsers(dst, data); !errors.Is(err, ErrInvalidExport) {
+			t.Errorf("%s: expected reimport to be rejected, got %v", tc.format, err)
+		}
+		dst.Close()
+	}
+}
+
+func TestExportValidate(t *testing.T) {
+	db := NewMemory()
+	existing := populate(t, db, 1, 1)[0]
+
+	newUser := func(email string, creds ...byte) *ExportUser {
+		xu := &ExportUser{ID: uuid.New(), Name: "Imported", Email: email}
+		for _, n := range creds {
+			xu.Credentials = append(xu.Credentials, exportCredential(testCredential(n)))
+		}
+		return xu
+	}
+
+	duplicateID := newUser("b@example.com")
+	duplicateID.ID = existing.ID
+
+	missingKey := newUser("c@example.com", 21)
+	missingKey.Credentials[0].PublicKey = nil
+
+	tests := []struct {
+		name  string
+		data  *Export
+		valid bool
+	}{
+		{"valid", &Export{Version: ExportVersion, Users: []*ExportUser{newUser("a@example.com", 10, 11)}}, true},
+		{"empty", &Export{Version: ExportVersion}, true},
+		{"unsupported version", &Export{Version: ExportVersion + 1}, false},
+		{"zero version", &Export{}, false},
+		{"existing email", &Export{Version: ExportVersion, Users: []*ExportUser{newUser(existing.Email)}}, false},
+		{"existing id", &Export{Version: ExportVersion, Users: []*ExportUser{duplicateID}}, false},
+		{"duplicate email", &Export{Version: ExportVersion, Users: []*ExportUser{newUser("a@example.com"), newUser("a@example.com")}}, false},
+		{"existing credential", &Export{Version: ExportVersion, Users: []*ExportUser{newUser("a@example.com", 100)}}, false},
+		{"duplicate credential", &Export{Version: ExportVersion, Users: []*ExportUser{newUser("a@example.com", 12), newUser("b@example.com", 12)}}, false},
+		{"missing email", &Export{Version: ExportVersion, Users: []*ExportUser{newUser("")}}, false},
+		{"missing public key", &Export{Version: ExportVersion, Users: []*ExportUser{missingKey}}, false},
+	}
+
+	for _, tc := range tests {
+		err := tc.data.Validate(db)
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected export to be valid, got %s", tc.name, err)
+		} else if !tc.valid && !errors.Is(err, ErrInvalidExport) {
+			t.Errorf("%s: expected invalid export error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestImportRollback(t *testing.T) {
+	src := NewMemory()
+	populate(t, src, 3, 2)
+
+	data, err := ExportUsers(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the fourth credential insert, i.e. the second credential of the second user.
+	dst := &failingStore{Memory: NewMemory(), failAfter: 3}
+	if err = ImportUsers(dst, data); !errors.Is(err, errInsertFailed) {
+		t.Fatalf("expected the import to fail, got %v", err)
+	}
+
+	if users, _ := dst.ListUsers(); len(users) != 0 {
+		t.Fatalf("expected the partial import to be rolled back, %d users remain", len(users))
+	}
+
+	for _, xu := range data.Users {
+		for _, xc := range xu.Credentials {
+			if _, _, err = dst.LookupByCredentialID(xc.ID); !errors.Is(err, ErrCredentialNotFound) {
+				t.Errorf("expected credential %s to be rolled back", EncodeKeyID(xc.ID))
+			}
+		}
+	}
+
+	// Once the cause of the failure is resolved the import can be retried.
+	dst.failAfter = -1
+	if err = ImportUsers(dst, data); err != nil {
+		t.Fatalf("could not retry import: %s", err)
+	}
+
+	if users, _ := dst.ListUsers(); len(users) != 3 {
+		t.Errorf("expected 3 users after retry, got %d", len(users))
+	}
+}
+
+var errInsertFailed = errors.New("insert failed")
+
+// failingStore fails to add credentials once failAfter credentials have been added.
+type failingStore struct {
+	*Memory
+	failAfter int
+	added     int
+}
+
+func (s *failingStore) AddCredential(user *User, cred Credential) error {
+	if s.failAfter >= 0 && s.added >= s.failAfter {
+		return errInsertFailed
+	}
+	s.added++
+	return s.Memory.AddCredential(user, cred)
+}
+
+// Creates users with credentials in the store; the last credential of every user is
+// revoked so that revocations are also covered.
+func populate(t *testing.T, db Store, users, creds int) []*User {
+	out := make([]*User, 0, users)
+	for i := 0; i < users; i++ {
+		user, err := db.NewUser("User "+string(rune('A'+i)), "user"+string(rune('a'+i))+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < creds; j++ {
+			cred := testCredential(byte(100 + i*creds + j))
+			cred.Created = time.Now().UTC().Truncate(time.Second)
+			if j == creds-1 {
+				cred.Revoke("lost")
+			}
+
+			if err = db.AddCredential(user, cred); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out = append(out, user)
+	}
+	return out
+}
+
+func openTestSQLite(t *testing.T, keys ...*MasterKey) *SQLite {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "yubikey.db"), keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
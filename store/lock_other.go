@@ -0,0 +1,15 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// File locking is not supported on this platform, so the caller must ensure that only
+// one process opens the store at a time.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
+
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Acquire an exclusive advisory lock on the file so that only one process can open the
+// store at a time; the lock is released by the OS if the process exits.
+func lockFile(path string) (_ *os.File, err error) {
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrStoreLocked, err)
+	}
+	return f, nil
+}
+
+func unlockFile(f *os.File) error {
+	defer f.Close()
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
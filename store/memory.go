@@ -0,0 +1,429 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// NewMemory returns an in-memory store that is useful for testing and debugging; all
+// users, credentials, and sessions are lost when the server is restarted.
+func NewMemory() *Memory {
+	return &Memory{
+		users:    make(map[uuid.UUID]*User),
+		emails:   make(map[string]uuid.UUID),
+		creds:    make(map[string]uuid.UUID),
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Memory is a map-backed implementation of the Store interface. Users are indexed by
+// email address and by the IDs of their credentials so that the owner of a credential
+// can be found without scanning every user.
+type Memory struct {
+	sync.RWMutex
+	users    map[uuid.UUID]*User
+	emails   map[string]uuid.UUID
+	creds    map[string]uuid.UUID // credential ID to user ID
+	events   []*SecurityEvent
+	sessions map[string]*Session
+}
+
+var _ Store = &Memory{}
+
+func (db *Memory) Close() error {
+	return nil
+}
+
+func (db *Memory) NewUser(name, email string) (*User, error) {
+	return db.InsertUser(uuid.New(), name, email)
+}
+
+func (db *Memory) InsertUser(id uuid.UUID, name, email string) (*User, error) {
+	user := &User{
+		ID:          id,
+		Name:        name,
+		Email:       email,
+		credentials: make([]Credential, 0, 1),
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.emails[email]; ok {
+		return nil, ErrUserAlreadyExists
+	}
+
+	if _, ok := db.users[id]; ok {
+		return nil, ErrUserAlreadyExists
+	}
+
+	db.emails[email] = user.ID
+	db.users[user.ID] = user
+	return user, nil
+}
+
+func (db *Memory) GetUser(email string) (*User, error) {
+	db.RLock()
+	defer db.RUnlock()
+	id := db.emails[email]
+	if user, ok := db.users[id]; ok {
+		return user, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+func (db *Memory) Lookup(id interface{}) (_ *User, err error) {
+	var userID uuid.UUID
+	if userID, err = ParseUserID(id); err != nil {
+		return nil, err
+	}
+
+	db.RLock()
+	defer db.RUnlock()
+	if user, ok := db.users[userID]; ok {
+		return user, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+func (db *Memory) ListUsers() ([]*User, error) {
+	db.RLock()
+	defer db.RUnlock()
+	users := make([]*User, 0, len(db.users))
+	for _, user := range db.users {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (db *Memory) DeleteUser(id uuid.UUID) error {
+	db.Lock()
+	defer db.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	user.RLock()
+	defer user.RUnlock()
+	for _, cred := range user.credentials {
+		delete(db.creds, credentialKey(cred.ID))
+	}
+
+	delete(db.emails, user.Email)
+	delete(db.users, id)
+	return nil
+}
+
+func (db *Memory) UpdateEmail(user *User, email string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.users[user.ID]; !ok {
+		return ErrUserNotFound
+	}
+
+	if id, ok := db.emails[email]; ok {
+		if id == user.ID {
+			return nil
+		}
+		return ErrUserAlreadyExists
+	}
+
+	user.Lock()
+	defer user.Unlock()
+	delete(db.emails, user.Email)
+	db.emails[email] = user.ID
+	user.Email = email
+	return nil
+}
+
+func (db *Memory) UpdateName(user *User, name string) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	if _, ok := db.users[user.ID]; !ok {
+		return ErrUserNotFound
+	}
+
+	user.Lock()
+	defer user.Unlock()
+	user.Name = name
+	return nil
+}
+
+func (db *Memory) AddCredential(user *User, cred Credential) error {
+	db.Lock()
+	defer db.Unlock()
+
+	key := credentialKey(cred.ID)
+	if _, ok := db.creds[key]; ok {
+		return ErrCredentialExists
+	}
+
+	if cred.Created.IsZero() {
+		cred.Created = time.Now().UTC()
+	}
+
+	user.Lock()
+	defer user.Unlock()
+	user.addCredential(cred)
+	db.creds[key] = user.ID
+	return nil
+}
+
+func (db *Memory) UpdateCredential(user *User, cred Credential) error {
+	user.Lock()
+	defer user.Unlock()
+	if !user.updateCredential(cred) {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+func (db *Memory) RevokeCredential(user *User, credentialID []byte, reason string) (err error) {
+	var cred Credential
+	if cred, err = user.Credential(credentialID); err != nil {
+		return err
+	}
+
+	if cred.IsRevoked() {
+		return nil
+	}
+
+	cred.Revoke(reason)
+	return db.UpdateCredential(user, cred)
+}
+
+func (db *Memory) RemoveCredential(user *User, credentialID []byte) error {
+	db.Lock()
+	defer db.Unlock()
+
+	user.Lock()
+	defer user.Unlock()
+	if !user.removeCredential(credentialID) {
+		return ErrCredentialNotFound
+	}
+
+	delete(db.creds, credentialKey(credentialID))
+	return nil
+}
+
+func (db *Memory) LookupByCredentialID(credentialID []byte) (_ *User, _ Credential, err error) {
+	db.RLock()
+	user, ok := db.users[db.creds[credentialKey(credentialID)]]
+	db.RUnlock()
+
+	if !ok {
+		return nil, Credential{}, ErrCredentialNotFound
+	}
+
+	var cred Credential
+	if cred, err = user.Credential(credentialID); err != nil {
+		return nil, Credential{}, err
+	}
+	return user, cred, nil
+}
+
+func (db *Memory) CredentialExists(cred *webauthn.Credential) bool {
+	db.RLock()
+	_, ok := db.creds[credentialKey(cred.ID)]
+	db.RUnlock()
+	return ok
+}
+
+func (db *Memory) RecordEvent(event *SecurityEvent) error {
+	event.init()
+	db.Lock()
+	defer db.Unlock()
+	db.events = append(db.events, event)
+	return nil
+}
+
+func (db *Memory) ListEvents(userID uuid.UUID) ([]*SecurityEvent, error) {
+	db.RLock()
+	defer db.RUnlock()
+	events := make([]*SecurityEvent, 0, len(db.events))
+	for _, event := range db.events {
+		if userID == uuid.Nil || event.UserID == userID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (db *Memory) GetSession(id string) (*Session, error) {
+	db.RLock()
+	defer db.RUnlock()
+	session, ok := db.sessions[id]
+	if !ok || session.Expired() {
+		return nil, ErrSessionNotFound
+	}
+	return session.copy(), nil
+}
+
+func (db *Memory) SaveSession(session *Session) error {
+	db.touchSession(session)
+	db.putSession(session)
+	return nil
+}
+
+func (db *Memory) UpdateSession(session *Session) error {
+	db.Lock()
+	defer db.Unlock()
+	stored, ok := db.sessions[session.ID]
+	if !ok || stored.Expired() {
+		return ErrSessionNotFound
+	}
+
+	session.Created = stored.Created
+	session.Modified = time.Now().UTC()
+	db.sessions[session.ID] = session.copy()
+	return nil
+}
+
+func (db *Memory) DeleteSession(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.sessions, id)
+	return nil
+}
+
+func (db *Memory) ConsumeSession(id string) (*Session, error) {
+	db.Lock()
+	defer db.Unlock()
+	session, ok := db.sessions[id]
+	delete(db.sessions, id)
+	if !ok || session.Expired() {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (db *Memory) DeleteExpiredSessions() (removed int, _ error) {
+	db.Lock()
+	defer db.Unlock()
+	for id, session := range db.sessions {
+		if session.Expired() {
+			delete(db.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (db *Memory) ListSessions(userID uuid.UUID) ([]*Session, error) {
+	db.RLock()
+	defer db.RUnlock()
+	sessions := make([]*Session, 0)
+	for _, session := range db.sessions {
+		if session.UserID == userID && !session.Expired() {
+			sessions = append(sessions, session.copy())
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+func (db *Memory) DeleteUserSessions(userID uuid.UUID) (removed int, _ error) {
+	db.Lock()
+	defer db.Unlock()
+	for id, session := range db.sessions {
+		if session.UserID == userID {
+			delete(db.sessions, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Set the created and modified timestamps of a session that is about to be saved,
+// keeping the created timestamp of the stored session if it is being replaced.
+func (db *Memory) touchSession(session *Session) {
+	db.RLock()
+	defer db.RUnlock()
+	session.Modified = time.Now().UTC()
+	if stored, ok := db.sessions[session.ID]; ok {
+		session.Created = stored.Created
+	} else {
+		session.Created = session.Modified
+	}
+}
+
+// Store a copy of the session as is (e.g. from a snapshot or the write-ahead log).
+func (db *Memory) putSession(session *Session) {
+	db.Lock()
+	defer db.Unlock()
+	db.sessions[session.ID] = session.copy()
+}
+
+// List all sessions that have not expired.
+func (db *Memory) listSessions() []*Session {
+	db.RLock()
+	defer db.RUnlock()
+	sessions := make([]*Session, 0, len(db.sessions))
+	for _, session := range db.sessions {
+		if !session.Expired() {
+			sessions = append(sessions, session.copy())
+		}
+	}
+	return sessions
+}
+
+// Insert a user with an existing ID and credentials (e.g. from a snapshot), updating
+// the email and credential indices.
+func (db *Memory) putUser(rec *userRecord) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.users[rec.ID]; ok {
+		return ErrUserAlreadyExists
+	}
+
+	if _, ok := db.emails[rec.Email]; ok {
+		return ErrUserAlreadyExists
+	}
+
+	for _, cred := range rec.Credentials {
+		if _, ok := db.creds[credentialKey(cred.ID)]; ok {
+			return ErrCredentialExists
+		}
+	}
+
+	user := &User{
+		ID:          rec.ID,
+		Name:        rec.Name,
+		Email:       rec.Email,
+		credentials: make([]Credential, 0, len(rec.Credentials)),
+	}
+
+	for _, cred := range rec.Credentials {
+		user.addCredential(cred)
+		db.creds[credentialKey(cred.ID)] = user.ID
+	}
+
+	db.emails[user.Email] = user.ID
+	db.users[user.ID] = user
+	return nil
+}
+
+// Returns serializable copies of all users in the store.
+func (db *Memory) records() ([]*userRecord, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	recs := make([]*userRecord, 0, len(db.users))
+	for _, user := range db.users {
+		user.RLock()
+		recs = append(recs, user.record())
+		user.RUnlock()
+	}
+	return recs, nil
+}
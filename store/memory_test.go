@@ -0,0 +1,213 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	db := NewMemory()
+	jane, err := db.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.NewUser("Janet Doe", "jane@example.com"); !errors.Is(err, ErrUserAlreadyExists) {
+		t.Errorf("expected duplicate email to be rejected, got %v", err)
+	}
+
+	if _, err = db.NewUser("John Doe", "john@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   interface{}
+		err  error
+	}{
+		{"uuid", jane.ID, nil},
+		{"string", jane.ID.String(), nil},
+		{"user handle", jane.WebAuthnID(), nil},
+		{"unknown user", uuid.New(), ErrUserNotFound},
+		{"unknown type", 42, ErrUnknownIDType},
+	}
+
+	for _, tc := range tests {
+		user, err := db.Lookup(tc.id)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		if tc.err == nil && user.ID != jane.ID {
+			t.Errorf("%s: expected user %s, got %s", tc.name, jane.ID, user.ID)
+		}
+	}
+
+	for _, invalid := range []interface{}{"jane", []byte("jane")} {
+		if _, err = db.Lookup(invalid); err == nil {
+			t.Errorf("expected an error parsing user id %v", invalid)
+		}
+	}
+
+	if user, err := db.GetUser("jane@example.com"); err != nil || user.ID != jane.ID {
+		t.Errorf("expected to get user by email, got %v", err)
+	}
+
+	if _, err = db.GetUser("unknown@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected unknown email to be not found, got %v", err)
+	}
+
+	if users, _ := db.ListUsers(); len(users) != 2 {
+		t.Errorf("expected 2 users, got %d", len(users))
+	}
+
+	if err = db.DeleteUser(jane.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.DeleteUser(jane.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected deleting a deleted user to return not found, got %v", err)
+	}
+
+	if _, err = db.GetUser("jane@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected the email of a deleted user to be released, got %v", err)
+	}
+
+	if _, err = db.NewUser("Jane Doe", "jane@example.com"); err != nil {
+		t.Errorf("expected the email of a deleted user to be registered again, got %v", err)
+	}
+}
+
+func TestMemoryCredentials(t *testing.T) {
+	db := NewMemory()
+	jane, err := db.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	john, err := db.NewUser("John Doe", "john@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := byte(1); i <= 2; i++ {
+		if err = db.AddCredential(jane, testCredential(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.AddCredential(john, testCredential(1)); !errors.Is(err, ErrCredentialExists) {
+		t.Errorf("expected a credential of another user to be rejected, got %v", err)
+	}
+
+	tests := []struct {
+		cred   webauthn.Credential
+		exists bool
+	}{
+		{testCredential(1).Credential, true},
+		{testCredential(2).Credential, true},
+		{testCredential(3).Credential, false},
+	}
+
+	for i, tc := range tests {
+		if exists := db.CredentialExists(&tc.cred); exists != tc.exists {
+			t.Errorf("test %d: expected credential exists %t, got %t", i, tc.exists, exists)
+		}
+	}
+
+	if creds := jane.WebAuthnCredentials(); len(creds) != 2 || !bytes.Equal(creds[0].ID, testCredential(1).ID) {
+		t.Errorf("expected 2 credentials in the order they were added, got %d", len(creds))
+	}
+
+	if cred, err := jane.Credential(testCredential(2).ID); err != nil || cred.Nickname != "test key" || cred.Created.IsZero() {
+		t.Errorf("expected the credential record to be stored, got %+v (%v)", cred, err)
+	}
+
+	if err = db.RemoveCredential(jane, testCredential(1).ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RemoveCredential(jane, testCredential(1).ID); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("expected removing a removed credential to return not found, got %v", err)
+	}
+
+	if cred := testCredential(1).Credential; db.CredentialExists(&cred) {
+		t.Error("expected a removed credential to no longer exist")
+	}
+
+	if err = db.AddCredential(john, testCredential(1)); err != nil {
+		t.Errorf("expected a removed credential to be registered again, got %v", err)
+	}
+
+	if creds := jane.Credentials(); len(creds) != 1 {
+		t.Errorf("expected 1 credential after removal, got %d", len(creds))
+	}
+
+	// Deleting a user removes their credentials
+	if err = db.DeleteUser(jane.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if cred := testCredential(2).Credential; db.CredentialExists(&cred) {
+		t.Error("expected the credentials of a deleted user to no longer exist")
+	}
+}
+
+func TestMemoryRevokeCredential(t *testing.T) {
+	db := NewMemory()
+	user, err := db.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := byte(1); i <= 2; i++ {
+		if err = db.AddCredential(user, testCredential(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.RevokeCredential(user, testCredential(1).ID, "lost"); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := user.Credential(testCredential(1).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cred.IsRevoked() || cred.Reason != "lost" {
+		t.Errorf("expected credential to be revoked because it was lost, got %+v", cred)
+	}
+
+	// Revoking a revoked credential keeps the original time and reason
+	revoked := cred.Revoked
+	if err = db.RevokeCredential(user, testCredential(1).ID, "stolen"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cred, _ = user.Credential(testCredential(1).ID); !cred.Revoked.Equal(revoked) || cred.Reason != "lost" {
+		t.Errorf("expected the original revocation to be kept, got %s %q", cred.Revoked, cred.Reason)
+	}
+
+	if err = db.RevokeCredential(user, testCredential(3).ID, "lost"); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("expected revoking an unknown credential to return not found, got %v", err)
+	}
+
+	// Revoked credentials cannot be used to login but are still excluded from registration
+	if creds := user.WebAuthnCredentials(); len(creds) != 1 || !bytes.Equal(creds[0].ID, testCredential(2).ID) {
+		t.Errorf("expected only the active credential to be used for login, got %d", len(creds))
+	}
+
+	if exclude := user.CredentialExcludeList(); len(exclude) != 2 {
+		t.Errorf("expected revoked credentials to be excluded from registration, got %d", len(exclude))
+	}
+
+	if cred := testCredential(1).Credential; !db.CredentialExists(&cred) {
+		t.Error("expected a revoked credential to still exist")
+	}
+}
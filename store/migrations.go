@@ -0,0 +1,113 @@
+package store
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// migrations holds the sql schema files that are applied to sqlite databases in order.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migration is a single schema change parsed from a file named NNNN_description.sql
+type Migration struct {
+	ID   int
+	Name string
+	Path string
+}
+
+// Migrations returns all migrations embedded in the binary, sorted by ID.
+func Migrations() (_ []Migration, err error) {
+	var paths []string
+	if paths, err = fs.Glob(migrations, "migrations/*.sql"); err != nil {
+		return nil, err
+	}
+
+	out := make([]Migration, 0, len(paths))
+	for _, path := range paths {
+		base := strings.TrimSuffix(filepath.Base(path), ".sql")
+		prefix, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("could not parse migration name %q", path)
+		}
+
+		var id int
+		if id, err = strconv.Atoi(prefix); err != nil {
+			return nil, fmt.Errorf("could not parse migration id %q: %w", path, err)
+		}
+
+		out = append(out, Migration{ID: id, Name: name, Path: path})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+const createMigrationsSQL = `CREATE TABLE IF NOT EXISTS migrations (
+	id      INTEGER PRIMARY KEY,
+	name    TEXT NOT NULL,
+	applied DATETIME NOT NULL
+)`
+
+// Migrate applies any migrations that have not yet been applied to the database, each
+// in its own transaction so that a failed migration does not leave a partial schema.
+func Migrate(db *sql.DB) (err error) {
+	if _, err = db.Exec(createMigrationsSQL); err != nil {
+		return fmt.Errorf("could not create migrations table: %w", err)
+	}
+
+	var all []Migration
+	if all, err = Migrations(); err != nil {
+		return err
+	}
+
+	for _, m := range all {
+		if err = m.apply(db); err != nil {
+			return fmt.Errorf("could not apply migration %04d %s: %w", m.ID, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m Migration) apply(db *sql.DB) (err error) {
+	var tx *sql.Tx
+	if tx, err = db.Begin(); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied bool
+	if err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM migrations WHERE id=$1)", m.ID).Scan(&applied); err != nil {
+		return err
+	}
+
+	if applied {
+		return nil
+	}
+
+	var query []byte
+	if query, err = migrations.ReadFile(m.Path); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(string(query)); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("INSERT INTO migrations (id, name, applied) VALUES ($1, $2, $3)", m.ID, m.Name, time.Now()); err != nil {
+		return err
+	}
+
+	log.Info().Int("id", m.ID).Str("name", m.Name).Msg("applied database migration")
+	return tx.Commit()
+}
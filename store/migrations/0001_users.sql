@@ -0,0 +1,29 @@
+-- Initial schema for users and their registered webauthn credentials
+CREATE TABLE IF NOT EXISTS users (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    email       TEXT NOT NULL UNIQUE,
+    created     DATETIME NOT NULL,
+    modified    DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS credentials (
+    id                  BLOB PRIMARY KEY,
+    user_id             TEXT NOT NULL,
+    public_key          BLOB NOT NULL,
+    attestation_type    TEXT NOT NULL DEFAULT '',
+    transports          TEXT NOT NULL DEFAULT '[]',
+    user_present        BOOLEAN NOT NULL DEFAULT false,
+    user_verified       BOOLEAN NOT NULL DEFAULT false,
+    backup_eligible     BOOLEAN NOT NULL DEFAULT false,
+    backup_state        BOOLEAN NOT NULL DEFAULT false,
+    aaguid              BLOB,
+    sign_count          INTEGER NOT NULL DEFAULT 0,
+    clone_warning       BOOLEAN NOT NULL DEFAULT false,
+    attachment          TEXT NOT NULL DEFAULT '',
+    created             DATETIME NOT NULL,
+    modified            DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_credentials_user_id ON credentials (user_id);
@@ -0,0 +1,5 @@
+-- Adds user-editable and audit metadata to registered credentials
+ALTER TABLE credentials ADD COLUMN nickname TEXT NOT NULL DEFAULT '';
+ALTER TABLE credentials ADD COLUMN last_used DATETIME;
+ALTER TABLE credentials ADD COLUMN client_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE credentials ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
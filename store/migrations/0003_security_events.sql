@@ -0,0 +1,15 @@
+-- Adds credential revocation and an audit log of security events
+ALTER TABLE credentials ADD COLUMN revoked DATETIME;
+ALTER TABLE credentials ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS security_events (
+    id              TEXT PRIMARY KEY,
+    type            TEXT NOT NULL,
+    user_id         TEXT NOT NULL,
+    credential_id   BLOB,
+    client_ip       TEXT NOT NULL DEFAULT '',
+    detail          TEXT NOT NULL DEFAULT '',
+    created         DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_security_events_user_id ON security_events (user_id);
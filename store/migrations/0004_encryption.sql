@@ -0,0 +1,12 @@
+-- Adds a blind index for email lookups and the wrapped data key used for encryption at rest
+ALTER TABLE users ADD COLUMN email_index TEXT;
+UPDATE users SET email_index = email;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_index ON users (email_index);
+
+CREATE TABLE IF NOT EXISTS data_keys (
+    id              INTEGER PRIMARY KEY,
+    wrapped_key     BLOB NOT NULL,
+    master_key_id   TEXT NOT NULL,
+    created         DATETIME NOT NULL,
+    modified        DATETIME NOT NULL
+);
@@ -0,0 +1,2 @@
+-- Adds the authenticator metadata resolved from the FIDO Metadata Service at registration
+ALTER TABLE credentials ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
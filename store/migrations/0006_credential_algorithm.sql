@@ -0,0 +1,2 @@
+-- Adds the COSE algorithm of the credential public key chosen by the authenticator
+ALTER TABLE credentials ADD COLUMN algorithm INTEGER NOT NULL DEFAULT 0;
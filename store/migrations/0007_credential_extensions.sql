@@ -0,0 +1,2 @@
+-- Adds the results of the webauthn extensions processed by the client and authenticator
+ALTER TABLE credentials ADD COLUMN extensions TEXT NOT NULL DEFAULT '{}';
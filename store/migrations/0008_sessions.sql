@@ -0,0 +1,10 @@
+-- Adds server-side sessions whose IDs are stored in the session cookie
+CREATE TABLE IF NOT EXISTS sessions (
+    id              TEXT PRIMARY KEY,
+    data            BLOB NOT NULL,
+    created         DATETIME NOT NULL,
+    modified        DATETIME NOT NULL,
+    expires         DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions (expires);
@@ -0,0 +1,3 @@
+-- Adds the user of sessions that track logins so that they can be listed and revoked
+ALTER TABLE sessions ADD COLUMN user_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
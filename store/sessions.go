@@ -0,0 +1,68 @@
+package store
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is the state of a server-side session; the session cookie only holds its ID.
+// The data is opaque to the store and is encrypted at rest if the store is encrypted.
+// Sessions that track the login of a user are indexed by the user ID so that they can
+// be listed and revoked.
+type Session struct {
+	ID       string    `json:"id"`
+	UserID   uuid.UUID `json:"user_id,omitempty"`
+	Data     []byte    `json:"data"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	Expires  time.Time `json:"expires"`
+}
+
+// SessionStore persists server-side sessions so that large session data does not have
+// to be stored in cookies and sessions can be shared between replicas.
+type SessionStore interface {
+	// Get the session with the specified ID; returns ErrSessionNotFound if the session
+	// does not exist or has expired.
+	GetSession(id string) (*Session, error)
+
+	// Create or replace the session with the same ID; the Created and Modified
+	// timestamps are set by the store.
+	SaveSession(session *Session) error
+
+	// Replace the data and expiration of an existing session; returns
+	// ErrSessionNotFound if the session does not exist or has expired so that a session
+	// that was deleted concurrently is not recreated.
+	UpdateSession(session *Session) error
+
+	// Delete the session with the specified ID; deleting a session that does not exist
+	// has no effect.
+	DeleteSession(id string) error
+
+	// Get and delete the session with the specified ID in a single operation so that
+	// only one caller can consume the session, even if the store is shared between
+	// replicas; returns ErrSessionNotFound if the session does not exist, has expired,
+	// or has already been consumed.
+	ConsumeSession(id string) (*Session, error)
+
+	// Remove all sessions that have expired, returning the number of sessions removed.
+	DeleteExpiredSessions() (int, error)
+
+	// List the sessions of the user that have not expired, ordered by creation time.
+	ListSessions(userID uuid.UUID) ([]*Session, error)
+
+	// Delete all sessions of the user, returning the number of sessions removed.
+	DeleteUserSessions(userID uuid.UUID) (int, error)
+}
+
+// Returns true if the session has expired.
+func (s *Session) Expired() bool {
+	return !s.Expires.After(time.Now())
+}
+
+// Returns a copy of the session so that the stored data cannot be modified by callers.
+func (s *Session) copy() *Session {
+	out := *s
+	out.Data = append([]byte(nil), s.Data...)
+	return &out
+}
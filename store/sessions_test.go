@@ -0,0 +1,153 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConsumeSession(t *testing.T) {
+	wal, err := OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	sqlite := openTestSQLite(t, testMasterKey(t, 1))
+	defer sqlite.Close()
+
+	backends := []struct {
+		name string
+		db   Store
+	}{
+		{"memory", NewMemory()},
+		{"sqlite", sqlite},
+		{"wal", wal},
+	}
+
+	for _, backend := range backends {
+		user, err := backend.db.NewUser("Jane Doe", "jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = backend.db.SaveSession(testSession("active", user)); err != nil {
+			t.Fatal(err)
+		}
+
+		expired := testSession("expired", user)
+		expired.Expires = time.Now().Add(-time.Second)
+		if err = backend.db.SaveSession(expired); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			id  string
+			err error
+		}{
+			{"active", nil},
+			{"active", ErrSessionNotFound},
+			{"expired", ErrSessionNotFound},
+			{"unknown", ErrSessionNotFound},
+		}
+
+		for i, tc := range tests {
+			session, err := backend.db.ConsumeSession(tc.id)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s test %d: expected error %v, got %v", backend.name, i, tc.err, err)
+				continue
+			}
+
+			if tc.err == nil && (session.ID != tc.id || session.UserID != user.ID || string(session.Data) != `{"client_ip":"127.0.0.1"}`) {
+				t.Errorf("%s test %d: unexpected session %+v", backend.name, i, session)
+			}
+		}
+
+		if _, err = backend.db.GetSession("active"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("%s: expected a consumed session to be deleted, got %v", backend.name, err)
+		}
+	}
+}
+
+func TestUpdateSession(t *testing.T) {
+	wal, err := OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	sqlite := openTestSQLite(t, testMasterKey(t, 1))
+	defer sqlite.Close()
+
+	backends := []struct {
+		name string
+		db   Store
+	}{
+		{"memory", NewMemory()},
+		{"sqlite", sqlite},
+		{"wal", wal},
+	}
+
+	for _, backend := range backends {
+		user, err := backend.db.NewUser("Jane Doe", "jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		active := testSession("active", user)
+		if err = backend.db.SaveSession(active); err != nil {
+			t.Fatal(err)
+		}
+
+		expired := testSession("expired", user)
+		expired.Expires = time.Now().Add(-time.Second)
+		if err = backend.db.SaveSession(expired); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = backend.db.SaveSession(testSession("deleted", user)); err != nil {
+			t.Fatal(err)
+		}
+		if err = backend.db.DeleteSession("deleted"); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			id  string
+			err error
+		}{
+			{"active", nil},
+			{"expired", ErrSessionNotFound},
+			{"deleted", ErrSessionNotFound},
+			{"unknown", ErrSessionNotFound},
+		}
+
+		for _, tc := range tests {
+			update := testSession(tc.id, user)
+			update.Data = []byte(`{"client_ip":"192.0.2.1"}`)
+			if err = backend.db.UpdateSession(update); !errors.Is(err, tc.err) {
+				t.Errorf("%s %s: expected error %v, got %v", backend.name, tc.id, tc.err, err)
+				continue
+			}
+
+			session, err := backend.db.GetSession(tc.id)
+			if tc.err != nil {
+				// Updating a session that does not exist must not create it.
+				if !errors.Is(err, ErrSessionNotFound) {
+					t.Errorf("%s %s: expected session not to be created, got %v", backend.name, tc.id, err)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%s %s: %s", backend.name, tc.id, err)
+			}
+			if string(session.Data) != `{"client_ip":"192.0.2.1"}` {
+				t.Errorf("%s %s: expected session data to be updated, got %s", backend.name, tc.id, session.Data)
+			}
+			if !session.Created.Equal(active.Created) {
+				t.Errorf("%s %s: expected created timestamp %s to be kept, got %s", backend.name, tc.id, active.Created, session.Created)
+			}
+		}
+	}
+}
@@ -0,0 +1,931 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// OpenSQLite opens (creating if necessary) the sqlite3 database at the specified path
+// and applies any outstanding schema migrations before returning the store. If master
+// keys are specified, names, email addresses, public keys, and client metadata are
+// encrypted at rest and email addresses are looked up using a keyed blind index.
+func OpenSQLite(path string, masterKeys ...*MasterKey) (_ *SQLite, err error) {
+	if path == "" {
+		return nil, ErrInvalidDSN
+	}
+
+	var dsn string
+	if dsn, err = sqliteDSN(path); err != nil {
+		return nil, err
+	}
+
+	store := &SQLite{}
+	if store.db, err = sql.Open("sqlite3", dsn); err != nil {
+		return nil, err
+	}
+
+	// SQLite only supports a single writer so serialize access through one connection.
+	store.db.SetMaxOpenConns(1)
+
+	if err = Migrate(store.db); err != nil {
+		store.db.Close()
+		return nil, err
+	}
+
+	if err = store.unlock(masterKeys); err != nil {
+		store.db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Returns the DSN of the database at the path, enabling foreign keys and a busy timeout
+// unless they are already specified by the query string of the path.
+func sqliteDSN(path string) (_ string, err error) {
+	path, rawQuery, _ := strings.Cut(path, "?")
+	if path == "" {
+		return "", ErrInvalidDSN
+	}
+
+	var query url.Values
+	if query, err = url.ParseQuery(rawQuery); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidDSN, err)
+	}
+
+	if !query.Has("_foreign_keys") && !query.Has("_fk") {
+		query.Set("_foreign_keys", "on")
+	}
+
+	if !query.Has("_busy_timeout") && !query.Has("_timeout") {
+		query.Set("_busy_timeout", "5000")
+	}
+	return path + "?" + query.Encode(), nil
+}
+
+// SQLite is a durable implementation of the Store interface that persists users and
+// credentials in a sqlite3 database so that registrations survive restarts.
+type SQLite struct {
+	db   *sql.DB
+	keys *Keyring
+}
+
+var (
+	_ Store     = &SQLite{}
+	_ Encrypted = &SQLite{}
+)
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+const insertUserSQL = "INSERT INTO users (id, name, email, email_index, created, modified) VALUES ($1, $2, $3, $4, $5, $5)"
+
+func (s *SQLite) NewUser(name, email string) (_ *User, err error) {
+	return s.InsertUser(uuid.New(), name, email)
+}
+
+func (s *SQLite) InsertUser(id uuid.UUID, name, email string) (_ *User, err error) {
+	user := &User{
+		ID:          id,
+		Name:        name,
+		Email:       email,
+		credentials: make([]Credential, 0, 1),
+	}
+
+	var sealedName, sealedEmail interface{}
+	if sealedName, err = s.seal(user.Name); err != nil {
+		return nil, err
+	}
+
+	if sealedEmail, err = s.seal(user.Email); err != nil {
+		return nil, err
+	}
+
+	if _, err = s.db.Exec(insertUserSQL, user.ID.String(), sealedName, sealedEmail, s.keys.BlindIndex(user.Email), time.Now().UTC()); err != nil {
+		if isConstraintViolation(err) {
+			return nil, ErrUserAlreadyExists
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *SQLite) GetUser(email string) (*User, error) {
+	return s.fetchUser("SELECT id, name, email FROM users WHERE email_index=$1", s.keys.BlindIndex(email))
+}
+
+func (s *SQLite) Lookup(id interface{}) (_ *User, err error) {
+	var userID uuid.UUID
+	if userID, err = ParseUserID(id); err != nil {
+		return nil, err
+	}
+	return s.fetchUser("SELECT id, name, email FROM users WHERE id=$1", userID.String())
+}
+
+func (s *SQLite) ListUsers() (_ []*User, err error) {
+	var tx *sql.Tx
+	if tx, err = s.db.Begin(); err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rows *sql.Rows
+	if rows, err = tx.Query("SELECT id, name, email FROM users ORDER BY created"); err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		var user *User
+		if user, err = s.scanUser(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.credentials, err = s.loadCredentials(tx, user.ID); err != nil {
+			return nil, err
+		}
+	}
+	return users, tx.Commit()
+}
+
+func (s *SQLite) DeleteUser(id uuid.UUID) (err error) {
+	var result sql.Result
+	if result, err = s.db.Exec("DELETE FROM users WHERE id=$1", id.String()); err != nil {
+		return err
+	}
+
+	if nrows, _ := result.RowsAffected(); nrows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *SQLite) UpdateEmail(user *User, email string) (err error) {
+	var sealed interface{}
+	if sealed, err = s.seal(email); err != nil {
+		return err
+	}
+
+	user.Lock()
+	defer user.Unlock()
+
+	var result sql.Result
+	if result, err = s.db.Exec("UPDATE users SET email=$1, email_index=$2, modified=$3 WHERE id=$4", sealed, s.keys.BlindIndex(email), time.Now().UTC(), user.ID.String()); err != nil {
+		if isConstraintViolation(err) {
+			return ErrUserAlreadyExists
+		}
+		return err
+	}
+
+	if nrows, _ := result.RowsAffected(); nrows == 0 {
+		return ErrUserNotFound
+	}
+
+	user.Email = email
+	return nil
+}
+
+func (s *SQLite) UpdateName(user *User, name string) (err error) {
+	var sealed interface{}
+	if sealed, err = s.seal(name); err != nil {
+		return err
+	}
+
+	user.Lock()
+	defer user.Unlock()
+
+	var result sql.Result
+	if result, err = s.db.Exec("UPDATE users SET name=$1, modified=$2 WHERE id=$3", sealed, time.Now().UTC(), user.ID.String()); err != nil {
+		return err
+	}
+
+	if nrows, _ := result.RowsAffected(); nrows == 0 {
+		return ErrUserNotFound
+	}
+
+	user.Name = name
+	return nil
+}
+
+const insertCredentialSQL = `INSERT INTO credentials (
+	id, user_id, public_key, attestation_type, transports, user_present, user_verified,
+	backup_eligible, backup_state, aaguid, sign_count, clone_warning, attachment,
+	nickname, last_used, client_ip, user_agent, revoked, reason, metadata, algorithm, extensions, created,
+	modified
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)`
+
+func (s *SQLite) AddCredential(user *User, cred Credential) (err error) {
+	var transports, metadata, extensions []byte
+	if transports, err = json.Marshal(cred.Transport); err != nil {
+		return err
+	}
+
+	if metadata, err = json.Marshal(cred.Metadata); err != nil {
+		return err
+	}
+
+	if extensions, err = json.Marshal(cred.Extensions); err != nil {
+		return err
+	}
+
+	if cred.Created.IsZero() {
+		cred.Created = time.Now().UTC()
+	}
+
+	var (
+		publicKey           []byte
+		clientIP, userAgent interface{}
+	)
+
+	if publicKey, err = s.keys.Encrypt(cred.PublicKey); err != nil {
+		return err
+	}
+
+	if clientIP, err = s.seal(cred.ClientIP); err != nil {
+		return err
+	}
+
+	if userAgent, err = s.seal(cred.UserAgent); err != nil {
+		return err
+	}
+
+	user.Lock()
+	defer user.Unlock()
+
+	if _, err = s.db.Exec(insertCredentialSQL,
+		cred.ID, user.ID.String(), publicKey, cred.AttestationType, string(transports),
+		cred.Flags.UserPresent, cred.Flags.UserVerified, cred.Flags.BackupEligible, cred.Flags.BackupState,
+		cred.Authenticator.AAGUID, cred.Authenticator.SignCount, cred.Authenticator.CloneWarning,
+		string(cred.Authenticator.Attachment), cred.Nickname, nullTime(cred.LastUsed), clientIP,
+		userAgent, nullTime(cred.Revoked), cred.Reason, string(metadata), cred.Algorithm, string(extensions), cred.Created,
+		time.Now().UTC(),
+	); err != nil {
+		if isConstraintViolation(err) {
+			return ErrCredentialExists
+		}
+		return err
+	}
+
+	user.addCredential(cred)
+	return nil
+}
+
+const updateCredentialSQL = `UPDATE credentials SET
+	public_key=$1, attestation_type=$2, transports=$3, user_present=$4, user_verified=$5,
+	backup_eligible=$6, backup_state=$7, aaguid=$8, sign_count=$9, clone_warning=$10,
+	attachment=$11, nickname=$12, last_used=$13, revoked=$14, reason=$15, metadata=$16, algorithm=$17,
+	extensions=$18, modified=$19
+WHERE id=$20 AND user_id=$21`
+
+func (s *SQLite) UpdateCredential(user *User, cred Credential) (err error) {
+	var transports, metadata, extensions []byte
+	if transports, err = json.Marshal(cred.Transport); err != nil {
+		return err
+	}
+
+	if metadata, err = json.Marshal(cred.Metadata); err != nil {
+		return err
+	}
+
+	if extensions, err = json.Marshal(cred.Extensions); err != nil {
+		return err
+	}
+
+	var publicKey []byte
+	if publicKey, err = s.keys.Encrypt(cred.PublicKey); err != nil {
+		return err
+	}
+
+	user.Lock()
+	defer user.Unlock()
+
+	var result sql.Result
+	if result, err = s.db.Exec(updateCredentialSQL,
+		publicKey, cred.AttestationType, string(transports),
+		cred.Flags.UserPresent, cred.Flags.UserVerified, cred.Flags.BackupEligible, cred.Flags.BackupState,
+		cred.Authenticator.AAGUID, cred.Authenticator.SignCount, cred.Authenticator.CloneWarning,
+		string(cred.Authenticator.Attachment), cred.Nickname, nullTime(cred.LastUsed),
+		nullTime(cred.Revoked), cred.Reason, string(metadata), cred.Algorithm, string(extensions), time.Now().UTC(),
+		cred.ID, user.ID.String(),
+	); err != nil {
+		return err
+	}
+
+	if nrows, _ := result.RowsAffected(); nrows == 0 {
+		return ErrCredentialNotFound
+	}
+
+	user.updateCredential(cred)
+	return nil
+}
+
+func (s *SQLite) RevokeCredential(user *User, credentialID []byte, reason string) (err error) {
+	var cred Credential
+	if cred, err = user.Credential(credentialID); err != nil {
+		return err
+	}
+
+	if cred.IsRevoked() {
+		return nil
+	}
+
+	cred.Revoke(reason)
+	return s.UpdateCredential(user, cred)
+}
+
+func (s *SQLite) RemoveCredential(user *User, credentialID []byte) (err error) {
+	user.Lock()
+	defer user.Unlock()
+
+	var result sql.Result
+	if result, err = s.db.Exec("DELETE FROM credentials WHERE id=$1 AND user_id=$2", credentialID, user.ID.String()); err != nil {
+		return err
+	}
+
+	if nrows, _ := result.RowsAffected(); nrows == 0 {
+		return ErrCredentialNotFound
+	}
+
+	user.removeCredential(credentialID)
+	return nil
+}
+
+func (s *SQLite) LookupByCredentialID(credentialID []byte) (user *User, _ Credential, err error) {
+	const query = "SELECT u.id, u.name, u.email FROM users u JOIN credentials c ON c.user_id=u.id WHERE c.id=$1"
+	if user, err = s.fetchUser(query, credentialID); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, Credential{}, ErrCredentialNotFound
+		}
+		return nil, Credential{}, err
+	}
+
+	var cred Credential
+	if cred, err = user.Credential(credentialID); err != nil {
+		return nil, Credential{}, err
+	}
+	return user, cred, nil
+}
+
+func (s *SQLite) CredentialExists(cred *webauthn.Credential) bool {
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM credentials WHERE id=$1)", cred.ID).Scan(&exists); err != nil {
+		// NOTE: the primary key constraint on insert will still prevent duplicates.
+		log.Error().Err(err).Msg("could not check if credential exists")
+		return false
+	}
+	return exists
+}
+
+const insertEventSQL = `INSERT INTO security_events (
+	id, type, user_id, credential_id, client_ip, detail, created
+) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+func (s *SQLite) RecordEvent(event *SecurityEvent) (err error) {
+	event.init()
+
+	var clientIP, detail interface{}
+	if clientIP, err = s.seal(event.ClientIP); err != nil {
+		return err
+	}
+
+	if detail, err = s.seal(event.Detail); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(insertEventSQL,
+		event.ID.String(), event.Type, event.UserID.String(), event.CredentialID,
+		clientIP, detail, event.Created,
+	)
+	return err
+}
+
+func (s *SQLite) ListEvents(userID uuid.UUID) (_ []*SecurityEvent, err error) {
+	query := "SELECT id, type, user_id, credential_id, client_ip, detail, created FROM security_events"
+	args := make([]interface{}, 0, 1)
+	if userID != uuid.Nil {
+		query += " WHERE user_id=$1"
+		args = append(args, userID.String())
+	}
+	query += " ORDER BY created"
+
+	var rows *sql.Rows
+	if rows, err = s.db.Query(query, args...); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*SecurityEvent, 0)
+	for rows.Next() {
+		var (
+			event            = &SecurityEvent{}
+			id, eventUID     string
+			clientIP, detail []byte
+		)
+
+		if err = rows.Scan(&id, &event.Type, &eventUID, &event.CredentialID, &clientIP, &detail, &event.Created); err != nil {
+			return nil, err
+		}
+
+		if event.ClientIP, err = s.open(clientIP); err != nil {
+			return nil, err
+		}
+
+		if event.Detail, err = s.open(detail); err != nil {
+			return nil, err
+		}
+
+		if event.ID, err = uuid.Parse(id); err != nil {
+			return nil, err
+		}
+
+		if event.UserID, err = uuid.Parse(eventUID); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLite) GetSession(id string) (_ *Session, err error) {
+	row := s.db.QueryRow("SELECT id, user_id, data, created, modified, expires FROM sessions WHERE id=$1 AND expires > $2", id, time.Now().UTC())
+
+	var session *Session
+	if session, err = s.scanSession(row); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+const upsertSessionSQL = `INSERT INTO sessions (id, user_id, data, created, modified, expires)
+	VALUES ($1, $2, $3, $4, $4, $5) ON CONFLICT (id) DO UPDATE SET
+	user_id=excluded.user_id, data=excluded.data, modified=excluded.modified, expires=excluded.expires
+	RETURNING created`
+
+func (s *SQLite) SaveSession(session *Session) (err error) {
+	var data []byte
+	if data, err = s.keys.Encrypt(session.Data); err != nil {
+		return err
+	}
+
+	var userID interface{}
+	if session.UserID != uuid.Nil {
+		userID = session.UserID.String()
+	}
+
+	session.Modified = time.Now().UTC()
+	return s.db.QueryRow(upsertSessionSQL, session.ID, userID, data, session.Modified, session.Expires.UTC()).Scan(&session.Created)
+}
+
+const updateSessionSQL = `UPDATE sessions SET user_id=$1, data=$2, modified=$3, expires=$4
+	WHERE id=$5 AND expires > $3 RETURNING created`
+
+func (s *SQLite) UpdateSession(session *Session) (err error) {
+	var data []byte
+	if data, err = s.keys.Encrypt(session.Data); err != nil {
+		return err
+	}
+
+	var userID interface{}
+	if session.UserID != uuid.Nil {
+		userID = session.UserID.String()
+	}
+
+	session.Modified = time.Now().UTC()
+	if err = s.db.QueryRow(updateSessionSQL, userID, data, session.Modified, session.Expires.UTC(), session.ID).Scan(&session.Created); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SQLite) DeleteSession(id string) (err error) {
+	_, err = s.db.Exec("DELETE FROM sessions WHERE id=$1", id)
+	return err
+}
+
+func (s *SQLite) ConsumeSession(id string) (session *Session, err error) {
+	if session, err = s.GetSession(id); err != nil {
+		return nil, err
+	}
+
+	// Only the caller that deletes the row consumes the session.
+	var result sql.Result
+	if result, err = s.db.Exec("DELETE FROM sessions WHERE id=$1", id); err != nil {
+		return nil, err
+	}
+
+	var removed int64
+	if removed, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	if removed == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *SQLite) DeleteExpiredSessions() (_ int, err error) {
+	var result sql.Result
+	if result, err = s.db.Exec("DELETE FROM sessions WHERE expires <= $1", time.Now().UTC()); err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	if removed, err = result.RowsAffected(); err != nil {
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+func (s *SQLite) ListSessions(userID uuid.UUID) (_ []*Session, err error) {
+	var rows *sql.Rows
+	if rows, err = s.db.Query("SELECT id, user_id, data, created, modified, expires FROM sessions WHERE user_id=$1 AND expires > $2 ORDER BY created", userID.String(), time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		var session *Session
+		if session, err = s.scanSession(rows); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLite) DeleteUserSessions(userID uuid.UUID) (_ int, err error) {
+	var result sql.Result
+	if result, err = s.db.Exec("DELETE FROM sessions WHERE user_id=$1", userID.String()); err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	if removed, err = result.RowsAffected(); err != nil {
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+func (s *SQLite) scanSession(row scanner) (session *Session, err error) {
+	var userID sql.NullString
+	session = &Session{}
+	if err = row.Scan(&session.ID, &userID, &session.Data, &session.Created, &session.Modified, &session.Expires); err != nil {
+		return nil, err
+	}
+
+	if userID.Valid {
+		if session.UserID, err = uuid.Parse(userID.String); err != nil {
+			return nil, err
+		}
+	}
+
+	if session.Data, err = s.keys.Decrypt(session.Data); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Fetch a single user and all of their credentials in a single transaction.
+func (s *SQLite) fetchUser(query string, args ...interface{}) (user *User, err error) {
+	var tx *sql.Tx
+	if tx, err = s.db.Begin(); err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if user, err = s.scanUser(tx.QueryRow(query, args...)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	if user.credentials, err = s.loadCredentials(tx, user.ID); err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
+
+const selectCredentialsSQL = `SELECT
+	id, public_key, attestation_type, transports, user_present, user_verified,
+	backup_eligible, backup_state, aaguid, sign_count, clone_warning, attachment,
+	nickname, last_used, client_ip, user_agent, revoked, reason, metadata, algorithm, extensions, created
+FROM credentials WHERE user_id=$1 ORDER BY created`
+
+func (s *SQLite) loadCredentials(tx *sql.Tx, userID uuid.UUID) (_ []Credential, err error) {
+	var rows *sql.Rows
+	if rows, err = tx.Query(selectCredentialsSQL, userID.String()); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creds := make([]Credential, 0, 1)
+	for rows.Next() {
+		var (
+			cred                Credential
+			transports          string
+			metadata            string
+			extensions          string
+			attachment          string
+			lastUsed            sql.NullTime
+			revoked             sql.NullTime
+			publicKey           []byte
+			clientIP, userAgent []byte
+		)
+
+		if err = rows.Scan(
+			&cred.ID, &publicKey, &cred.AttestationType, &transports,
+			&cred.Flags.UserPresent, &cred.Flags.UserVerified, &cred.Flags.BackupEligible, &cred.Flags.BackupState,
+			&cred.Authenticator.AAGUID, &cred.Authenticator.SignCount, &cred.Authenticator.CloneWarning, &attachment,
+			&cred.Nickname, &lastUsed, &clientIP, &userAgent, &revoked, &cred.Reason, &metadata, &cred.Algorithm, &extensions,
+			&cred.Created,
+		); err != nil {
+			return nil, err
+		}
+
+		if cred.PublicKey, err = s.keys.Decrypt(publicKey); err != nil {
+			return nil, err
+		}
+
+		if cred.ClientIP, err = s.open(clientIP); err != nil {
+			return nil, err
+		}
+
+		if cred.UserAgent, err = s.open(userAgent); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(transports), &cred.Transport); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(metadata), &cred.Metadata); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(extensions), &cred.Extensions); err != nil {
+			return nil, err
+		}
+
+		cred.Authenticator.Attachment = protocol.AuthenticatorAttachment(attachment)
+		cred.LastUsed = lastUsed.Time
+		cred.Revoked = revoked.Time
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *SQLite) scanUser(row scanner) (user *User, err error) {
+	var (
+		id          string
+		name, email []byte
+	)
+
+	user = &User{}
+	if err = row.Scan(&id, &name, &email); err != nil {
+		return nil, err
+	}
+
+	if user.ID, err = uuid.Parse(id); err != nil {
+		return nil, err
+	}
+
+	if user.Name, err = s.open(name); err != nil {
+		return nil, err
+	}
+
+	if user.Email, err = s.open(email); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// MasterKeyIDs returns the IDs of the master keys that wrapped the data key when the
+// store was opened and after any rotation was applied.
+func (s *SQLite) MasterKeyIDs() (opened, current string) {
+	return s.keys.MasterKeyIDs()
+}
+
+// Encrypts a text field for storage; when the store is not encrypted the value is
+// stored as text rather than as a blob so that the database remains readable.
+func (s *SQLite) seal(value string) (interface{}, error) {
+	if s.keys == nil {
+		return value, nil
+	}
+	return s.keys.Encrypt([]byte(value))
+}
+
+// Decrypts a text field that was stored with seal.
+func (s *SQLite) open(value []byte) (_ string, err error) {
+	if value, err = s.keys.Decrypt(value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// Unwraps the data key stored in the database with the configured master keys. If the
+// database does not have a data key, one is generated and any existing plaintext rows
+// are encrypted; if the active master key has been rotated, the data key is re-wrapped.
+func (s *SQLite) unlock(masterKeys []*MasterKey) (err error) {
+	stored := &WrappedKey{}
+	row := s.db.QueryRow("SELECT wrapped_key, master_key_id, created, modified FROM data_keys WHERE id=1")
+	if err = row.Scan(&stored.Key, &stored.MasterKeyID, &stored.Created, &stored.Modified); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		stored = nil
+	}
+
+	var (
+		keys    *Keyring
+		wrapped *WrappedKey
+	)
+
+	if keys, wrapped, err = UnlockKeyring(stored, masterKeys); err != nil {
+		return err
+	}
+
+	if wrapped != nil {
+		var tx *sql.Tx
+		if tx, err = s.db.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if stored == nil {
+			if err = encryptExisting(tx, keys); err != nil {
+				return fmt.Errorf("could not encrypt existing data: %w", err)
+			}
+		}
+
+		const upsertKeySQL = `INSERT INTO data_keys (id, wrapped_key, master_key_id, created, modified)
+			VALUES (1, $1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET
+			wrapped_key=excluded.wrapped_key, master_key_id=excluded.master_key_id, modified=excluded.modified`
+
+		if _, err = tx.Exec(upsertKeySQL, wrapped.Key, wrapped.MasterKeyID, wrapped.Created, wrapped.Modified); err != nil {
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		if stored != nil {
+			log.Info().Str("from", stored.MasterKeyID).Str("to", wrapped.MasterKeyID).Msg("data key re-wrapped with rotated master key")
+		}
+	}
+
+	s.keys = keys
+	return nil
+}
+
+// Encrypts the sensitive columns of a database that was created without master keys.
+func encryptExisting(tx *sql.Tx, keys *Keyring) (err error) {
+	// The blind index must be computed before the email addresses are encrypted.
+	var rows *sql.Rows
+	if rows, err = tx.Query("SELECT rowid, email FROM users"); err != nil {
+		return err
+	}
+
+	indices := make(map[int64]string)
+	for rows.Next() {
+		var (
+			rowid int64
+			email string
+		)
+
+		if err = rows.Scan(&rowid, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		indices[rowid] = keys.BlindIndex(email)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for rowid, index := range indices {
+		if _, err = tx.Exec("UPDATE users SET email_index=$1 WHERE rowid=$2", index, rowid); err != nil {
+			return err
+		}
+	}
+
+	if err = encryptColumns(tx, keys, "users", "name", "email"); err != nil {
+		return err
+	}
+
+	if err = encryptColumns(tx, keys, "credentials", "public_key", "client_ip", "user_agent"); err != nil {
+		return err
+	}
+
+	if err = encryptColumns(tx, keys, "security_events", "client_ip", "detail"); err != nil {
+		return err
+	}
+
+	// Sessions are short-lived so they are removed rather than encrypted.
+	_, err = tx.Exec("DELETE FROM sessions")
+	return err
+}
+
+// Encrypts the specified columns of every row in the table.
+func encryptColumns(tx *sql.Tx, keys *Keyring, table string, columns ...string) (err error) {
+	var rows *sql.Rows
+	if rows, err = tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s", strings.Join(columns, ", "), table)); err != nil {
+		return err
+	}
+
+	// Collect all rows before updating since the transaction has a single connection.
+	updates := make([][]interface{}, 0)
+	for rows.Next() {
+		values := make([][]byte, len(columns))
+		dest := make([]interface{}, 0, len(columns)+1)
+
+		var rowid int64
+		dest = append(dest, &rowid)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+
+		args := make([]interface{}, 0, len(columns)+1)
+		for _, value := range values {
+			var ciphertext []byte
+			if ciphertext, err = keys.Encrypt(value); err != nil {
+				rows.Close()
+				return err
+			}
+			args = append(args, ciphertext)
+		}
+		updates = append(updates, append(args, rowid))
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	sets := make([]string, 0, len(columns))
+	for i, column := range columns {
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, i+1))
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE rowid=$%d", table, strings.Join(sets, ", "), len(columns)+1)
+
+	for _, args := range updates {
+		if _, err = tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Converts zero-valued timestamps to NULL for storage in the database.
+func nullTime(ts time.Time) sql.NullTime {
+	return sql.NullTime{Time: ts, Valid: !ts.IsZero()}
+}
+
+// Returns true if the error is caused by a unique or primary key constraint.
+func isConstraintViolation(err error) bool {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.ExtendedCode == sqlite3.ErrConstraintUnique || serr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
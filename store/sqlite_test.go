@@ -0,0 +1,223 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestSQLiteDSN(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		err      bool
+	}{
+		{"yubikey.db", "yubikey.db?_busy_timeout=5000&_foreign_keys=on", false},
+		{"/data/yubikey.db", "/data/yubikey.db?_busy_timeout=5000&_foreign_keys=on", false},
+		{"yubikey.db?cache=shared", "yubikey.db?_busy_timeout=5000&_foreign_keys=on&cache=shared", false},
+		{"yubikey.db?_busy_timeout=100", "yubikey.db?_busy_timeout=100&_foreign_keys=on", false},
+		{"yubikey.db?_fk=off&mode=ro", "yubikey.db?_busy_timeout=5000&_fk=off&mode=ro", false},
+		{"yubikey.db?", "yubikey.db?_busy_timeout=5000&_foreign_keys=on", false},
+		{"", "", true},
+		{"?cache=shared", "", true},
+		{"yubikey.db?cache=%zz", "", true},
+	}
+
+	for _, tc := range tests {
+		dsn, err := sqliteDSN(tc.path)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error for %q, got dsn %q", tc.path, dsn)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.path, err)
+			continue
+		}
+
+		if dsn != tc.expected {
+			t.Errorf("expected dsn %q for %q, got %q", tc.expected, tc.path, dsn)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yubikey.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	all, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range all {
+		if m.ID != i+1 {
+			t.Fatalf("expected migration %d to have id %d, got %d", i, i+1, m.ID)
+		}
+	}
+
+	// Migrating more than once must not reapply any migration.
+	for i := 0; i < 2; i++ {
+		if err = Migrate(db); err != nil {
+			t.Fatalf("could not apply migrations (pass %d): %s", i+1, err)
+		}
+
+		var applied int
+		if err = db.QueryRow("SELECT COUNT(*) FROM migrations").Scan(&applied); err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != len(all) {
+			t.Fatalf("expected %d applied migrations after pass %d, got %d", len(all), i+1, applied)
+		}
+	}
+}
+
+func TestSQLiteEncryptExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yubikey.db")
+
+	// Create a plaintext database with a user, a credential, an event, and a session.
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred := testCredential(1)
+	if err = db.AddCredential(user, cred); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RecordEvent(&SecurityEvent{Type: EventCloneWarning, UserID: user.ID, ClientIP: "127.0.0.1", Detail: "sign count did not increase"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.SaveSession(testSession("session", user)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Reopening with a master key must encrypt the existing rows.
+	key := testMasterKey(t, 1)
+	if db, err = OpenSQLite(path, key); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	columns := []struct {
+		query string
+	}{
+		{"SELECT name FROM users"},
+		{"SELECT email FROM users"},
+		{"SELECT public_key FROM credentials"},
+		{"SELECT client_ip FROM credentials"},
+		{"SELECT user_agent FROM credentials"},
+		{"SELECT client_ip FROM security_events"},
+		{"SELECT detail FROM security_events"},
+	}
+
+	for _, tc := range columns {
+		var value []byte
+		if err = db.db.QueryRow(tc.query).Scan(&value); err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+
+		if !isCiphertext(value) {
+			t.Errorf("%s: expected value to be encrypted", tc.query)
+		}
+	}
+
+	var index string
+	if err = db.db.QueryRow("SELECT email_index FROM users").Scan(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	if index == user.Email {
+		t.Error("expected the email index to be a blind index")
+	}
+
+	if _, err = db.GetSession("session"); err != ErrSessionNotFound {
+		t.Errorf("expected sessions to be removed when encrypting, got %v", err)
+	}
+
+	// The encrypted data must be readable through the store.
+	found, err := db.GetUser(user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.ID != user.ID || found.Name != user.Name {
+		t.Errorf("unexpected user %s %q", found.ID, found.Name)
+	}
+
+	creds := found.Credentials()
+	if len(creds) != 1 || !bytes.Equal(creds[0].PublicKey, cred.PublicKey) || creds[0].UserAgent != cred.UserAgent {
+		t.Errorf("credential was not decrypted correctly: %+v", creds)
+	}
+
+	events, err := db.ListEvents(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].ClientIP != "127.0.0.1" || events[0].Detail != "sign count did not increase" {
+		t.Errorf("event was not decrypted correctly: %+v", events)
+	}
+
+	// Reopening without the master key must fail rather than return ciphertext.
+	db.Close()
+	if _, err = OpenSQLite(path); err != ErrMissingMasterKey {
+		t.Errorf("expected missing master key error, got %v", err)
+	}
+}
+
+// Returns a credential whose ID and public key are derived from n.
+func testCredential(n byte) Credential {
+	return Credential{
+		Credential: webauthn.Credential{
+			ID:              []byte{0xc0, 0xde, n},
+			PublicKey:       bytes.Repeat([]byte{n}, 77),
+			AttestationType: "none",
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    make([]byte, 16),
+				SignCount: uint32(n),
+			},
+		},
+		Nickname:  "test key",
+		ClientIP:  "192.168.1.1",
+		UserAgent: "go test",
+	}
+}
+
+// Returns a master key whose key material is derived from n.
+func testMasterKey(t *testing.T, n byte) *MasterKey {
+	key, err := NewMasterKey(bytes.Repeat([]byte{n}, masterKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Returns a login session of the user that expires in an hour.
+func testSession(id string, user *User) *Session {
+	return &Session{
+		ID:      id,
+		UserID:  user.ID,
+		Data:    []byte(`{"client_ip":"127.0.0.1"}`),
+		Expires: time.Now().Add(time.Hour),
+	}
+}
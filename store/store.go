@@ -0,0 +1,132 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Open a store from the specified DSN; the scheme of the DSN selects the backend:
+//
+//	memory://                     in-memory store, data is lost on restart
+//	sqlite3://path/to/yubikey.db  sqlite3 database at a relative path
+//	sqlite3:///data/yubikey.db    sqlite3 database at an absolute path
+//	wal://path/to/dir?compact=N   append-only log and snapshot in a directory
+//
+// If master keys are specified, durable backends encrypt users and credentials at rest
+// with a data key wrapped by the first (active) master key; the remaining master keys
+// are previous keys that are used to unwrap the data key so it can be re-wrapped with
+// the active key when the master key is rotated.
+func Open(dsn string, masterKeys ...[]byte) (_ Store, err error) {
+	scheme, path, ok := strings.Cut(dsn, "://")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDSN, dsn)
+	}
+
+	keys := make([]*MasterKey, 0, len(masterKeys))
+	for _, key := range masterKeys {
+		var mk *MasterKey
+		if mk, err = NewMasterKey(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, mk)
+	}
+
+	switch scheme {
+	case "memory":
+		return NewMemory(), nil
+	case "sqlite3", "sqlite":
+		return OpenSQLite(path, keys...)
+	case "wal":
+		return OpenWAL(path, keys...)
+	default:
+		return nil, fmt.Errorf("%w: unhandled scheme %q", ErrInvalidDSN, scheme)
+	}
+}
+
+// Store is the top-level interface for all persistence backends used by the server.
+// Every backend must be closed when the server shuts down to flush any pending writes.
+type Store interface {
+	io.Closer
+	UserStore
+	EventStore
+	SessionStore
+}
+
+// UserStore manages users and their registered webauthn credentials. Implementations
+// must be safe for concurrent use and must keep the email and credential indices
+// consistent with the users they store.
+type UserStore interface {
+	// Create a new user with the specified name and email address; returns
+	// ErrUserAlreadyExists if the email address has already been registered.
+	NewUser(name, email string) (*User, error)
+
+	// Insert a user with an existing ID (e.g. when importing users) so that the user
+	// handle stored on discoverable credentials remains valid; returns
+	// ErrUserAlreadyExists if the ID or email address has already been registered.
+	InsertUser(id uuid.UUID, name, email string) (*User, error)
+
+	// Get a user by their email address (e.g. their webauthn name).
+	GetUser(email string) (*User, error)
+
+	// Lookup a user by their webauthn ID, which can be a string, []byte, or uuid.UUID.
+	Lookup(id interface{}) (*User, error)
+
+	// List all users in the store.
+	ListUsers() ([]*User, error)
+
+	// Delete a user and all of their credentials from the store.
+	DeleteUser(id uuid.UUID) error
+
+	// Change the email address of the user, updating the user in place; returns
+	// ErrUserAlreadyExists if the email address belongs to another user.
+	UpdateEmail(user *User, email string) error
+
+	// Change the display name of the user, updating the user in place.
+	UpdateName(user *User, name string) error
+
+	// Add a credential to the specified user, updating the user in place.
+	AddCredential(user *User, cred Credential) error
+
+	// Replace the stored credential that has the same ID as the specified credential
+	// (e.g. to change its nickname or record its last use), updating the user in place.
+	UpdateCredential(user *User, cred Credential) error
+
+	// Revoke a credential so that it can no longer be used to login while keeping it
+	// for auditing; revoking a credential that is already revoked has no effect.
+	RevokeCredential(user *User, credentialID []byte, reason string) error
+
+	// Remove a credential by its ID from the specified user, updating the user in place.
+	RemoveCredential(user *User, credentialID []byte) error
+
+	// Find the user that owns the credential with the specified ID along with the stored
+	// credential, which may be revoked; returns ErrCredentialNotFound if no user has
+	// registered the credential.
+	LookupByCredentialID(credentialID []byte) (*User, Credential, error)
+
+	// Returns true if the credential is already assigned to any user in the store.
+	CredentialExists(cred *webauthn.Credential) bool
+}
+
+// ParseUserID converts the various representations of a user ID (e.g. the webauthn
+// user handle, a string from a URL, etc.) into a uuid.UUID.
+func ParseUserID(id interface{}) (userID uuid.UUID, err error) {
+	switch idtyp := id.(type) {
+	case string:
+		if userID, err = uuid.Parse(idtyp); err != nil {
+			return uuid.Nil, err
+		}
+	case []byte:
+		if userID, err = uuid.FromBytes(idtyp); err != nil {
+			return uuid.Nil, err
+		}
+	case uuid.UUID:
+		userID = idtyp
+	default:
+		return uuid.Nil, ErrUnknownIDType
+	}
+	return userID, nil
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupByCredentialID(t *testing.T) {
+	dir := t.TempDir()
+	backends := []struct {
+		name       string
+		persistent bool
+		open       func() (Store, error)
+	}{
+		{"memory", false, func() (Store, error) { return NewMemory(), nil }},
+		{"sqlite", true, func() (Store, error) { return OpenSQLite(filepath.Join(dir, "yubikey.db")) }},
+		{"wal", true, func() (Store, error) { return OpenWAL(filepath.Join(dir, "wal")) }},
+	}
+
+	for _, backend := range backends {
+		db, err := backend.open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users := populate(t, db, 3, 2)
+		if err = db.RemoveCredential(users[1], testCredential(102).ID); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.DeleteUser(users[2].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// The index must survive changes to the email address of the user.
+		if err = db.UpdateEmail(users[0], "jane@example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name    string
+			id      byte
+			user    *User
+			revoked bool
+			err     error
+		}{
+			{"active", 100, users[0], false, nil},
+			{"revoked", 101, users[0], true, nil},
+			{"removed", 102, nil, false, ErrCredentialNotFound},
+			{"other user", 103, users[1], true, nil},
+			{"deleted user", 104, nil, false, ErrCredentialNotFound},
+			{"unknown", 42, nil, false, ErrCredentialNotFound},
+		}
+
+		check := func(db Store, name string) {
+			for _, tc := range tests {
+				user, cred, err := db.LookupByCredentialID(testCredential(tc.id).ID)
+				if !errors.Is(err, tc.err) {
+					t.Errorf("%s %s: expected error %v, got %v", name, tc.name, tc.err, err)
+					continue
+				}
+
+				if tc.err != nil {
+					continue
+				}
+
+				if user.ID != tc.user.ID {
+					t.Errorf("%s %s: expected user %s, got %s", name, tc.name, tc.user.ID, user.ID)
+				}
+
+				if cred.IsRevoked() != tc.revoked || cred.Nickname != "test key" {
+					t.Errorf("%s %s: unexpected credential %+v", name, tc.name, cred)
+				}
+			}
+		}
+
+		check(db, backend.name)
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Persistent backends must rebuild the index when they are reopened.
+		if backend.persistent {
+			if db, err = backend.open(); err != nil {
+				t.Fatal(err)
+			}
+			check(db, backend.name+" reopened")
+			db.Close()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// User implements the webauthn.User interface and is the primary model managed by the
+// UserStore. Users should only be modified by the store so that indices are maintained.
+type User struct {
+	sync.RWMutex
+	ID          uuid.UUID
+	Name        string
+	Email       string
+	credentials []Credential
+}
+
+// WebAuthnID provides the user handle of the user account. A user handle is an opaque byte sequence with a maximum
+// size of 64 bytes, and is not meant to be displayed to the user.
+//
+// To ensure secure operation, authentication and authorization decisions MUST be made on the basis of this id
+// member, not the displayName nor name members. See Section 6.1 of [RFC8266].
+//
+// It's recommended this value is completely random and uses the entire 64 bytes.
+//
+// Specification: §5.4.3. User Account Parameters for Credential Generation (https://w3c.github.io/webauthn/#dom-publickeycredentialuserentity-id)
+func (u *User) WebAuthnID() []byte {
+	u.RLock()
+	defer u.RUnlock()
+	return u.ID[:]
+}
+
+// WebAuthnName provides the name attribute of the user account during registration and is a human-palatable name for the user
+// account, intended only for display. For example, "Alex Müller" or "田中倫". The Relying Party SHOULD let the user
+// choose this, and SHOULD NOT restrict the choice more than necessary.
+//
+// Specification: §5.4.3. User Account Parameters for Credential Generation (https://w3c.github.io/webauthn/#dictdef-publickeycredentialuserentity)
+func (u *User) WebAuthnName() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.Email
+}
+
+// WebAuthnDisplayName provides the name attribute of the user account during registration and is a human-palatable
+// name for the user account, intended only for display. For example, "Alex Müller" or "田中倫". The Relying Party
+// SHOULD let the user choose this, and SHOULD NOT restrict the choice more than necessary.
+//
+// Specification: §5.4.3. User Account Parameters for Credential Generation (https://www.w3.org/TR/webauthn/#dom-publickeycredentialuserentity-displayname)
+func (u *User) WebAuthnDisplayName() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.Name
+}
+
+// WebAuthnCredentials provides the list of Credential objects owned by the user.
+// Revoked credentials are excluded so that they cannot be used to login.
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	u.RLock()
+	defer u.RUnlock()
+	creds := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, cred := range u.credentials {
+		if cred.IsRevoked() {
+			continue
+		}
+		creds = append(creds, cred.Credential)
+	}
+	return creds
+}
+
+// Credentials returns a copy of the credential records owned by the user.
+func (u *User) Credentials() []Credential {
+	u.RLock()
+	defer u.RUnlock()
+	creds := make([]Credential, len(u.credentials))
+	copy(creds, u.credentials)
+	return creds
+}
+
+// Credential returns the credential record owned by the user with the specified ID.
+func (u *User) Credential(credentialID []byte) (Credential, error) {
+	u.RLock()
+	defer u.RUnlock()
+	for _, cred := range u.credentials {
+		if bytes.Equal(cred.ID, credentialID) {
+			return cred, nil
+		}
+	}
+	return Credential{}, ErrCredentialNotFound
+}
+
+// CredentialExcludeList returns descriptors for all of the user's credentials, including
+// revoked credentials, so that the same authenticator cannot be registered twice.
+func (u *User) CredentialExcludeList() []protocol.CredentialDescriptor {
+	u.RLock()
+	defer u.RUnlock()
+	exclude := make([]protocol.CredentialDescriptor, 0, len(u.credentials))
+	for _, cred := range u.credentials {
+		descriptor := protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: cred.ID,
+		}
+		exclude = append(exclude, descriptor)
+	}
+	return exclude
+}
+
+// WebAuthnIcon is a deprecated option.
+// Deprecated: this has been removed from the specification recommendation. Suggest a blank string.
+func (u *User) WebAuthnIcon() string { return "" }
+
+// userRecord is the serializable representation of a user and their credentials.
+type userRecord struct {
+	ID          uuid.UUID    `json:"id"`
+	Name        string       `json:"name"`
+	Email       string       `json:"email"`
+	Credentials []Credential `json:"credentials"`
+}
+
+// Returns a serializable copy of the user; the caller must hold the user lock.
+func (u *User) record() *userRecord {
+	rec := &userRecord{
+		ID:          u.ID,
+		Name:        u.Name,
+		Email:       u.Email,
+		Credentials: make([]Credential, len(u.credentials)),
+	}
+	copy(rec.Credentials, u.credentials)
+	return rec
+}
+
+// Returns true if the user owns the credential; the caller must hold the user lock.
+func (u *User) hasCredential(credentialID []byte) bool {
+	for _, cred := range u.credentials {
+		if bytes.Equal(cred.ID, credentialID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Append a credential to the user; the caller must hold the user lock.
+func (u *User) addCredential(cred Credential) {
+	u.credentials = append(u.credentials, cred)
+}
+
+// Replace the credential with the same ID; the caller must hold the user lock.
+func (u *User) updateCredential(cred Credential) bool {
+	for i := range u.credentials {
+		if bytes.Equal(u.credentials[i].ID, cred.ID) {
+			u.credentials[i] = cred
+			return true
+		}
+	}
+	return false
+}
+
+// Remove a credential from the user by ID; the caller must hold the user lock.
+func (u *User) removeCredential(credentialID []byte) bool {
+	for i, cred := range u.credentials {
+		if bytes.Equal(cred.ID, credentialID) {
+			u.credentials = append(u.credentials[:i], u.credentials[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the string representation of a credential ID for use in indices.
+func credentialKey(id []byte) string {
+	return protocol.URLEncodedBase64(id).String()
+}
@@ -0,0 +1,874 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	walLogName             = "wal.log"
+	walSnapshotName        = "snapshot.json"
+	walLockName            = "LOCK"
+	walDataKeyName         = "datakey.json"
+	walEncryptingName      = "ENCRYPTING"
+	walHeaderSize          = 8
+	walMaxRecordSize       = 16 << 20
+	DefaultCompactionLimit = 1024
+)
+
+// Operations recorded in the write-ahead log.
+const (
+	opCreateUser       = "create_user"
+	opDeleteUser       = "delete_user"
+	opUpdateEmail      = "update_email"
+	opUpdateName       = "update_name"
+	opAddCredential    = "add_credential"
+	opUpdateCredential = "update_credential"
+	opRemoveCredential = "remove_credential"
+	opRecordEvent      = "record_event"
+	opSaveSession      = "save_session"
+	opDeleteSession    = "delete_session"
+	opDeleteSessions   = "delete_user_sessions"
+)
+
+// OpenWAL opens an append-only log store in the specified directory, creating it if it
+// does not exist. The latest snapshot is loaded and the log is replayed on top of it to
+// restore the state of the store. The DSN path may specify a compact query parameter
+// to set how many log records are written before the log is compacted to a snapshot.
+// If master keys are specified, the log records and snapshot are encrypted at rest.
+func OpenWAL(path string, masterKeys ...*MasterKey) (_ *WAL, err error) {
+	var dsn *url.URL
+	if dsn, err = url.Parse(path); err != nil || dsn.Path == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDSN, path)
+	}
+
+	store := &WAL{
+		mem:   NewMemory(),
+		dir:   dsn.Path,
+		limit: DefaultCompactionLimit,
+	}
+
+	if compact := dsn.Query().Get("compact"); compact != "" {
+		if store.limit, err = strconv.Atoi(compact); err != nil || store.limit < 1 {
+			return nil, fmt.Errorf("%w: invalid compaction limit %q", ErrInvalidDSN, compact)
+		}
+	}
+
+	if err = os.MkdirAll(store.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Ensure that no other process (e.g. the CLI while the server is running) can
+	// append to the log while this store has it open.
+	if store.lock, err = lockFile(filepath.Join(store.dir, walLockName)); err != nil {
+		return nil, err
+	}
+
+	if err = store.open(masterKeys); err != nil {
+		unlockFile(store.lock)
+		return nil, err
+	}
+	return store, nil
+}
+
+func (w *WAL) open(masterKeys []*MasterKey) (err error) {
+	var stored, wrapped *WrappedKey
+	if stored, err = w.loadDataKey(); err != nil {
+		return err
+	}
+
+	if w.keys, wrapped, err = UnlockKeyring(stored, masterKeys); err != nil {
+		return err
+	}
+
+	// If encryption is being enabled, the plaintext state is encrypted once it has been
+	// loaded. The marker is created before the data key is persisted and removed once
+	// the state is rewritten so that the migration is resumed if the process crashes.
+	marker := filepath.Join(w.dir, walEncryptingName)
+	if stored == nil && w.keys != nil {
+		if err = writeFileSync(marker, nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err = os.Stat(marker); err == nil {
+		w.migrate = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// Persist the data key before any encrypted data is written so that it is never lost.
+	if wrapped != nil {
+		var data []byte
+		if data, err = json.Marshal(wrapped); err != nil {
+			return err
+		}
+
+		path := filepath.Join(w.dir, walDataKeyName)
+		if err = writeFileSync(path+".tmp", data); err != nil {
+			return err
+		}
+
+		if err = os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+
+		if stored != nil {
+			log.Info().Str("from", stored.MasterKeyID).Str("to", wrapped.MasterKeyID).Msg("data key re-wrapped with rotated master key")
+		}
+	}
+
+	if err = w.loadSnapshot(); err != nil {
+		return err
+	}
+
+	if w.log, err = os.OpenFile(filepath.Join(w.dir, walLogName), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return err
+	}
+
+	if err = w.replay(); err != nil {
+		w.log.Close()
+		return err
+	}
+
+	// If encryption was just enabled, rewrite the plaintext state as an encrypted snapshot.
+	if w.migrate && w.keys != nil {
+		if err = w.compact(); err != nil {
+			w.log.Close()
+			return err
+		}
+
+		if err = os.Remove(marker); err != nil {
+			w.log.Close()
+			return err
+		}
+		w.migrate = false
+	}
+	return nil
+}
+
+// WAL is a file-backed implementation of the Store interface that keeps all users in
+// memory and appends every mutation to a write-ahead log before it is applied. Once
+// the log grows beyond the compaction limit, the state is written to a snapshot and
+// the log is truncated. Mutations are serialized so that the log order is the order
+// in which they are applied to the in-memory state.
+type WAL struct {
+	sync.Mutex
+	mem     *Memory
+	keys    *Keyring
+	dir     string
+	log     *os.File
+	lock    *os.File
+	seq     uint64 // sequence number of the last record applied
+	records int    // number of records in the log since the last snapshot
+	limit   int    // compact the log after this many records
+	migrate bool   // plaintext records are accepted while encryption is being enabled
+}
+
+var (
+	_ Store     = &WAL{}
+	_ Encrypted = &WAL{}
+)
+
+// walRecord is a single entry in the write-ahead log.
+type walRecord struct {
+	Seq          uint64         `json:"seq"`
+	Op           string         `json:"op"`
+	User         *userRecord    `json:"user,omitempty"`
+	UserID       uuid.UUID      `json:"user_id,omitempty"`
+	Value        string         `json:"value,omitempty"`
+	Credential   *Credential    `json:"credential,omitempty"`
+	CredentialID []byte         `json:"credential_id,omitempty"`
+	Event        *SecurityEvent `json:"event,omitempty"`
+	Session      *Session       `json:"session,omitempty"`
+}
+
+// walSnapshot is the compacted state of the store as of the record with the sequence.
+type walSnapshot struct {
+	Seq      uint64           `json:"seq"`
+	Users    []*userRecord    `json:"users"`
+	Events   []*SecurityEvent `json:"events"`
+	Sessions []*Session       `json:"sessions,omitempty"`
+}
+
+func (w *WAL) Close() (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.records > 0 {
+		if err = w.compact(); err != nil {
+			log.Error().Err(err).Msg("could not compact write-ahead log on close")
+		}
+	}
+
+	defer unlockFile(w.lock)
+	return w.log.Close()
+}
+
+func (w *WAL) NewUser(name, email string) (_ *User, err error) {
+	return w.InsertUser(uuid.New(), name, email)
+}
+
+func (w *WAL) InsertUser(id uuid.UUID, name, email string) (_ *User, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if _, err = w.mem.GetUser(email); err == nil {
+		return nil, ErrUserAlreadyExists
+	}
+
+	if _, err = w.mem.Lookup(id); err == nil {
+		return nil, ErrUserAlreadyExists
+	}
+
+	rec := &walRecord{Op: opCreateUser, User: &userRecord{ID: id, Name: name, Email: email}}
+	if err = w.commit(rec); err != nil {
+		return nil, err
+	}
+	return w.mem.Lookup(rec.User.ID)
+}
+
+func (w *WAL) GetUser(email string) (*User, error) {
+	return w.mem.GetUser(email)
+}
+
+func (w *WAL) Lookup(id interface{}) (*User, error) {
+	return w.mem.Lookup(id)
+}
+
+func (w *WAL) ListUsers() ([]*User, error) {
+	return w.mem.ListUsers()
+}
+
+func (w *WAL) DeleteUser(id uuid.UUID) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if _, err = w.mem.Lookup(id); err != nil {
+		return err
+	}
+	return w.commit(&walRecord{Op: opDeleteUser, UserID: id})
+}
+
+func (w *WAL) UpdateEmail(user *User, email string) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if _, err = w.mem.Lookup(user.ID); err != nil {
+		return err
+	}
+
+	var existing *User
+	if existing, err = w.mem.GetUser(email); err == nil {
+		if existing.ID == user.ID {
+			return nil
+		}
+		return ErrUserAlreadyExists
+	}
+	return w.commit(&walRecord{Op: opUpdateEmail, UserID: user.ID, Value: email})
+}
+
+func (w *WAL) UpdateName(user *User, name string) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if _, err = w.mem.Lookup(user.ID); err != nil {
+		return err
+	}
+	return w.commit(&walRecord{Op: opUpdateName, UserID: user.ID, Value: name})
+}
+
+func (w *WAL) AddCredential(user *User, cred Credential) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.mem.CredentialExists(&cred.Credential) {
+		return ErrCredentialExists
+	}
+
+	if cred.Created.IsZero() {
+		cred.Created = time.Now().UTC()
+	}
+	return w.commit(&walRecord{Op: opAddCredential, UserID: user.ID, Credential: &cred})
+}
+
+func (w *WAL) UpdateCredential(user *User, cred Credential) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	user.RLock()
+	exists := user.hasCredential(cred.ID)
+	user.RUnlock()
+
+	if !exists {
+		return ErrCredentialNotFound
+	}
+	return w.commit(&walRecord{Op: opUpdateCredential, UserID: user.ID, Credential: &cred})
+}
+
+func (w *WAL) RevokeCredential(user *User, credentialID []byte, reason string) (err error) {
+	var cred Credential
+	if cred, err = user.Credential(credentialID); err != nil {
+		return err
+	}
+
+	if cred.IsRevoked() {
+		return nil
+	}
+
+	cred.Revoke(reason)
+	return w.UpdateCredential(user, cred)
+}
+
+func (w *WAL) RemoveCredential(user *User, credentialID []byte) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	user.RLock()
+	exists := user.hasCredential(credentialID)
+	user.RUnlock()
+
+	if !exists {
+		return ErrCredentialNotFound
+	}
+	return w.commit(&walRecord{Op: opRemoveCredential, UserID: user.ID, CredentialID: credentialID})
+}
+
+func (w *WAL) LookupByCredentialID(credentialID []byte) (*User, Credential, error) {
+	return w.mem.LookupByCredentialID(credentialID)
+}
+
+func (w *WAL) CredentialExists(cred *webauthn.Credential) bool {
+	return w.mem.CredentialExists(cred)
+}
+
+func (w *WAL) RecordEvent(event *SecurityEvent) error {
+	w.Lock()
+	defer w.Unlock()
+	event.init()
+	return w.commit(&walRecord{Op: opRecordEvent, Event: event})
+}
+
+func (w *WAL) ListEvents(userID uuid.UUID) ([]*SecurityEvent, error) {
+	return w.mem.ListEvents(userID)
+}
+
+func (w *WAL) GetSession(id string) (*Session, error) {
+	return w.mem.GetSession(id)
+}
+
+func (w *WAL) SaveSession(session *Session) error {
+	w.Lock()
+	defer w.Unlock()
+	w.mem.touchSession(session)
+	return w.commit(&walRecord{Op: opSaveSession, Session: session})
+}
+
+func (w *WAL) UpdateSession(session *Session) error {
+	w.Lock()
+	defer w.Unlock()
+	if _, err := w.mem.GetSession(session.ID); err != nil {
+		return err
+	}
+
+	w.mem.touchSession(session)
+	return w.commit(&walRecord{Op: opSaveSession, Session: session})
+}
+
+func (w *WAL) DeleteSession(id string) error {
+	w.Lock()
+	defer w.Unlock()
+	if _, err := w.mem.GetSession(id); err != nil {
+		return nil
+	}
+	return w.commit(&walRecord{Op: opDeleteSession, Value: id})
+}
+
+func (w *WAL) ConsumeSession(id string) (session *Session, err error) {
+	w.Lock()
+	defer w.Unlock()
+	if session, err = w.mem.GetSession(id); err != nil {
+		return nil, err
+	}
+
+	if err = w.commit(&walRecord{Op: opDeleteSession, Value: id}); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (w *WAL) ListSessions(userID uuid.UUID) ([]*Session, error) {
+	return w.mem.ListSessions(userID)
+}
+
+func (w *WAL) DeleteUserSessions(userID uuid.UUID) (_ int, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	var sessions []*Session
+	if sessions, err = w.mem.ListSessions(userID); err != nil || len(sessions) == 0 {
+		return 0, err
+	}
+
+	if err = w.commit(&walRecord{Op: opDeleteSessions, UserID: userID}); err != nil {
+		return 0, err
+	}
+	return len(sessions), nil
+}
+
+// Expired sessions are only removed from the in-memory state; they are not logged
+// since they are skipped on replay and dropped from the snapshot when it is compacted.
+func (w *WAL) DeleteExpiredSessions() (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.mem.DeleteExpiredSessions()
+}
+
+// Commit a mutation by appending it to the log then applying it to the in-memory state,
+// compacting the log if it has grown beyond the limit. The caller must hold the lock and
+// must validate the mutation beforehand so that only records that apply are logged.
+func (w *WAL) commit(rec *walRecord) (err error) {
+	if err = w.append(rec); err != nil {
+		return err
+	}
+
+	if err = w.apply(rec); err != nil {
+		return err
+	}
+
+	if w.records >= w.limit {
+		if err = w.compact(); err != nil {
+			// The mutation is durable in the log so compaction will be retried later.
+			log.Error().Err(err).Msg("could not compact write-ahead log")
+		}
+	}
+	return nil
+}
+
+// Apply a record to the in-memory state; used both when replaying the log and when
+// committing new mutations that have been appended to the log.
+func (w *WAL) apply(rec *walRecord) (err error) {
+	switch rec.Op {
+	case opCreateUser:
+		return w.mem.putUser(rec.User)
+	case opDeleteUser:
+		return w.mem.DeleteUser(rec.UserID)
+	case opUpdateEmail:
+		var user *User
+		if user, err = w.mem.Lookup(rec.UserID); err != nil {
+			return err
+		}
+		return w.mem.UpdateEmail(user, rec.Value)
+	case opUpdateName:
+		var user *User
+		if user, err = w.mem.Lookup(rec.UserID); err != nil {
+			return err
+		}
+		return w.mem.UpdateName(user, rec.Value)
+	case opAddCredential:
+		var user *User
+		if user, err = w.mem.Lookup(rec.UserID); err != nil {
+			return err
+		}
+		return w.mem.AddCredential(user, *rec.Credential)
+	case opUpdateCredential:
+		var user *User
+		if user, err = w.mem.Lookup(rec.UserID); err != nil {
+			return err
+		}
+		return w.mem.UpdateCredential(user, *rec.Credential)
+	case opRemoveCredential:
+		var user *User
+		if user, err = w.mem.Lookup(rec.UserID); err != nil {
+			return err
+		}
+		return w.mem.RemoveCredential(user, rec.CredentialID)
+	case opRecordEvent:
+		return w.mem.RecordEvent(rec.Event)
+	case opSaveSession:
+		w.mem.putSession(rec.Session)
+		return nil
+	case opDeleteSession:
+		return w.mem.DeleteSession(rec.Value)
+	case opDeleteSessions:
+		_, err = w.mem.DeleteUserSessions(rec.UserID)
+		return err
+	default:
+		return fmt.Errorf("unknown write-ahead log operation %q", rec.Op)
+	}
+}
+
+// Append a record to the end of the log and sync it to disk. Each record is framed by
+// a header containing the length of the record and its checksum so that a torn write
+// can be detected on replay. The caller must hold the lock.
+func (w *WAL) append(rec *walRecord) (err error) {
+	rec.Seq = w.seq + 1
+
+	var data []byte
+	if data, err = json.Marshal(rec); err != nil {
+		return err
+	}
+
+	if data, err = w.keys.Encrypt(data); err != nil {
+		return err
+	}
+
+	buf := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[walHeaderSize:], data)
+
+	var offset int64
+	if offset, err = w.log.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+
+	// The sequence number is used even if the write fails since the record may have
+	// reached the disk; replay only requires sequence numbers to increase.
+	w.seq = rec.Seq
+
+	if _, err = w.log.Write(buf); err == nil {
+		err = w.log.Sync()
+	}
+
+	if err != nil {
+		// Remove any partial record so that the next record is not written after it.
+		if terr := w.log.Truncate(offset); terr != nil {
+			return errors.Join(err, terr)
+		}
+
+		if _, serr := w.log.Seek(offset, io.SeekStart); serr != nil {
+			return errors.Join(err, serr)
+		}
+		return err
+	}
+
+	w.records++
+	return nil
+}
+
+// Replay the log on top of the snapshot, skipping any records already included in the
+// snapshot. If the final record is torn (e.g. the process crashed mid-write) the log is
+// truncated to the end of the last complete record so that new records can be appended.
+// A record that cannot be read anywhere else in the log means the log is corrupt; an
+// error is returned and the log is left untouched so that no valid records are lost.
+func (w *WAL) replay() (err error) {
+	var (
+		info   os.FileInfo
+		offset int64
+		nrecs  int
+		reader = &countingReader{r: w.log}
+	)
+
+	if info, err = w.log.Stat(); err != nil {
+		return err
+	}
+
+	if _, err = w.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for {
+		var rec *walRecord
+		if rec, err = w.readRecord(reader, info.Size()-offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if !errors.Is(err, errTornRecord) {
+				return fmt.Errorf("%w: record at offset %d: %w", ErrCorruptLog, offset, err)
+			}
+
+			log.Warn().Err(err).Int64("offset", offset).Msg("truncating torn record at the end of the write-ahead log")
+			if err = w.log.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		offset = reader.n
+		nrecs++
+
+		if rec.Seq <= w.seq {
+			continue
+		}
+
+		if err = w.apply(rec); err != nil {
+			log.Warn().Err(err).Uint64("seq", rec.Seq).Str("op", rec.Op).Msg("could not apply write-ahead log record")
+		}
+		w.seq = rec.Seq
+	}
+
+	// Position the file at the end of the last valid record for appends.
+	if _, err = w.log.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	w.records = nrecs
+	log.Debug().Int("records", nrecs).Uint64("seq", w.seq).Str("dir", w.dir).Msg("write-ahead log replayed")
+	return nil
+}
+
+// errTornRecord is returned by readRecord if the record extends to the end of the log
+// and is incomplete, i.e. it was being written when the process crashed.
+var errTornRecord = errors.New("torn record")
+
+// Read a single framed record from the log, where remaining is the number of bytes from
+// the start of the record to the end of the log. Returns io.EOF only if the log ends
+// cleanly on a record boundary and errTornRecord if the final record is incomplete or
+// cannot be decoded, or if the rest of the log is zero-filled (e.g. the file was
+// extended but the records were never written), otherwise an error describing the
+// corruption is returned.
+func (w *WAL) readRecord(r io.Reader, remaining int64) (_ *walRecord, err error) {
+	header := make([]byte, walHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: incomplete record header: %w", errTornRecord, err)
+	}
+
+	// Check the length before allocating so that a corrupt header cannot exhaust memory.
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > walMaxRecordSize {
+		return nil, fmt.Errorf("record length %d exceeds the maximum record size", length)
+	}
+
+	end := walHeaderSize + length
+	if end > remaining {
+		return nil, fmt.Errorf("%w: record length %d extends past the end of the log", errTornRecord, length)
+	}
+
+	// Records are never empty, but an empty record has a zero checksum, so a zero header
+	// is the start of a zero-filled tail rather than a record.
+	if length == 0 {
+		if !isZeroFilled(header) || !isZeroFilledReader(r) {
+			return nil, errors.New("empty record")
+		}
+		return nil, fmt.Errorf("%w: zero-filled tail", errTornRecord)
+	}
+
+	data := make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("incomplete record: %w", err)
+	}
+
+	// A checksum mismatch is only a torn write if it is the final record in the log;
+	// records that fail to decrypt or parse have a valid checksum so were fully written.
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		if end == remaining {
+			return nil, fmt.Errorf("%w: record checksum mismatch", errTornRecord)
+		}
+		return nil, errors.New("record checksum mismatch")
+	}
+
+	rec := &walRecord{}
+	if data, err = w.decrypt(data); err == nil {
+		err = json.Unmarshal(data, rec)
+	}
+
+	if err != nil {
+		if end == remaining {
+			return nil, fmt.Errorf("%w: could not decode final record: %w", errTornRecord, err)
+		}
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Returns true if every byte is zero.
+func isZeroFilled(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if every byte remaining in the reader is zero.
+func isZeroFilledReader(r io.Reader) bool {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if !isZeroFilled(buf[:n]) {
+			return false
+		}
+
+		if err != nil {
+			return errors.Is(err, io.EOF)
+		}
+	}
+}
+
+// Load the snapshot from disk if it exists, populating the in-memory state.
+func (w *WAL) loadSnapshot() (err error) {
+	var data []byte
+	if data, err = os.ReadFile(filepath.Join(w.dir, walSnapshotName)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if data, err = w.decrypt(data); err != nil {
+		return fmt.Errorf("could not decrypt snapshot: %w", err)
+	}
+
+	snap := &walSnapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return fmt.Errorf("could not parse snapshot: %w", err)
+	}
+
+	for _, rec := range snap.Users {
+		if err = w.mem.putUser(rec); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range snap.Events {
+		if err = w.mem.RecordEvent(event); err != nil {
+			return err
+		}
+	}
+
+	for _, session := range snap.Sessions {
+		w.mem.putSession(session)
+	}
+
+	w.seq = snap.Seq
+	return nil
+}
+
+// Compact writes the current in-memory state to a new snapshot then truncates the log.
+// The snapshot is written to a temporary file and renamed so that it is replaced
+// atomically; if a crash occurs before the log is truncated, the records already in
+// the snapshot are skipped on replay by their sequence number. The caller must hold
+// the lock.
+func (w *WAL) compact() (err error) {
+	snap := &walSnapshot{Seq: w.seq}
+	if snap.Users, err = w.mem.records(); err != nil {
+		return err
+	}
+
+	if snap.Events, err = w.mem.ListEvents(uuid.Nil); err != nil {
+		return err
+	}
+	snap.Sessions = w.mem.listSessions()
+
+	var data []byte
+	if data, err = json.Marshal(snap); err != nil {
+		return err
+	}
+
+	if data, err = w.keys.Encrypt(data); err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.dir, walSnapshotName)
+	if err = writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	if err = w.log.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err = w.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w.records = 0
+	log.Debug().Uint64("seq", w.seq).Int("users", len(snap.Users)).Msg("write-ahead log compacted")
+	return nil
+}
+
+// MasterKeyIDs returns the IDs of the master keys that wrapped the data key when the
+// store was opened and after any rotation was applied.
+func (w *WAL) MasterKeyIDs() (opened, current string) {
+	return w.keys.MasterKeyIDs()
+}
+
+// Load the wrapped data key from disk; returns nil if the store is not encrypted.
+func (w *WAL) loadDataKey() (_ *WrappedKey, err error) {
+	var data []byte
+	if data, err = os.ReadFile(filepath.Join(w.dir, walDataKeyName)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	key := &WrappedKey{}
+	if err = json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("could not parse data key: %w", err)
+	}
+	return key, nil
+}
+
+// Decrypt a record or snapshot. Plaintext data is only accepted if the store is not
+// encrypted or while the data written before encryption was enabled is being encrypted,
+// so that unauthenticated records cannot be injected into an encrypted log.
+func (w *WAL) decrypt(data []byte) ([]byte, error) {
+	if !isCiphertext(data) {
+		if w.keys != nil && !w.migrate {
+			return nil, ErrNotEncrypted
+		}
+		return data, nil
+	}
+
+	if w.keys == nil {
+		return nil, ErrMissingMasterKey
+	}
+	return w.keys.Decrypt(data)
+}
+
+func writeFileSync(path string, data []byte) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// countingReader tracks the number of bytes read so that the offset of the end of the
+// last valid record in the log is known.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
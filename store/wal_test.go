@@ -0,0 +1,414 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWALReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []*MasterKey
+		users   int
+		corrupt func(t *testing.T, log []byte) []byte
+		err     error
+		expect  int
+	}{
+		{"clean", nil, 5, nil, nil, 5},
+		{"encrypted", []*MasterKey{testMasterKey(t, 1)}, 5, nil, nil, 5},
+		{"torn header", nil, 5, appendBytes(0x00, 0x00, 0x01), nil, 5},
+		{"torn record", nil, 5, appendBytes(0x00, 0x00, 0x00, 0x20, 0xde, 0xad, 0xbe, 0xef, '{'), nil, 5},
+		{"torn length", nil, 5, appendBytes(0x00, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00), nil, 5},
+		{"torn checksum", nil, 5, flipLastByte, nil, 4},
+		{"encrypted torn checksum", []*MasterKey{testMasterKey(t, 1)}, 5, flipLastByte, nil, 4},
+		{"corrupt first record", nil, 5, flipByte(walHeaderSize + 2), ErrCorruptLog, 0},
+		{"encrypted corrupt first record", []*MasterKey{testMasterKey(t, 1)}, 5, flipByte(walHeaderSize + 2), ErrCorruptLog, 0},
+		{"corrupt length", nil, 5, flipByte(0), ErrCorruptLog, 0},
+		{"oversized length", nil, 5, setLength(0, walMaxRecordSize+1), ErrCorruptLog, 0},
+		{"zero tail", nil, 5, appendBytes(make([]byte, 4096)...), nil, 5},
+		{"encrypted zero tail", []*MasterKey{testMasterKey(t, 1)}, 5, appendBytes(make([]byte, 64)...), nil, 5},
+		{"empty record", nil, 5, appendBytes(append(make([]byte, walHeaderSize), '{')...), ErrCorruptLog, 0},
+		{"undecodable final record", nil, 5, appendRecord([]byte("{not json")), nil, 5},
+		{"encrypted undecodable final record", []*MasterKey{testMasterKey(t, 1)}, 5, appendRecord([]byte("{not json")), nil, 5},
+		{"undecodable record", nil, 5, appendRecord([]byte("{not json"), []byte("{}")), ErrCorruptLog, 0},
+		{"plaintext record", nil, 5, appendRecord(injectedUser), nil, 6},
+		{"encrypted plaintext final record", []*MasterKey{testMasterKey(t, 1)}, 5, appendRecord(injectedUser), nil, 5},
+		{"encrypted plaintext record", []*MasterKey{testMasterKey(t, 1)}, 5, appendRecord(injectedUser, injectedUser), ErrCorruptLog, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := OpenWAL(dir, tc.keys...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tc.users; i++ {
+				if _, err = db.NewUser(fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@example.com", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			crashWAL(db)
+
+			path := filepath.Join(dir, walLogName)
+			if tc.corrupt != nil {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err = os.WriteFile(path, tc.corrupt(t, data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenWAL(dir, tc.keys...)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected error %v, got %v", tc.err, err)
+				}
+
+				// A corrupt log must be left untouched so that it can be recovered.
+				after, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(after) != string(before) {
+					t.Error("expected the corrupt log to be left untouched")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			users, err := db.ListUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(users) != tc.expect {
+				t.Fatalf("expected %d users to be recovered, got %d", tc.expect, len(users))
+			}
+
+			// New records must be appended after the last valid record.
+			if _, err = db.NewUser("Appended", "appended@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			crashWAL(db)
+
+			if db, err = OpenWAL(dir, tc.keys...); err != nil {
+				t.Fatalf("could not reopen log after append: %s", err)
+			}
+			defer db.Close()
+
+			if users, _ = db.ListUsers(); len(users) != tc.expect+1 {
+				t.Errorf("expected %d users after append, got %d", tc.expect+1, len(users))
+			}
+		})
+	}
+}
+
+func TestWALAppendFailure(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.NewUser("Jane Doe", "jane@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to a read-only handle fail, as would a full disk.
+	readonly, err := os.Open(filepath.Join(dir, walLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logf := db.log
+	db.log = readonly
+	if _, err = db.NewUser("John Doe", "john@example.com"); err == nil {
+		t.Fatal("expected an error when the log cannot be written")
+	}
+	db.log = logf
+	readonly.Close()
+
+	// The sequence number of the failed record must not be reused in case it was written.
+	if db.seq != 2 {
+		t.Errorf("expected the sequence number to advance past the failed record, got %d", db.seq)
+	}
+
+	// The store remains usable and the log remains valid after the failed append.
+	if _, err = db.NewUser("Mary Major", "mary@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	crashWAL(db)
+
+	if db, err = OpenWAL(dir); err != nil {
+		t.Fatalf("could not reopen log after a failed append: %s", err)
+	}
+	defer db.Close()
+
+	users, err := db.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 2 {
+		t.Errorf("expected 2 users after replay, got %d", len(users))
+	}
+
+	if _, err = db.GetUser("john@example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected the failed user not to be created, got %v", err)
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []*MasterKey
+		limit int
+		users int
+		log   int // number of records expected in the log after the writes
+	}{
+		{"below limit", nil, 10, 5, 5},
+		{"at limit", nil, 5, 5, 0},
+		{"above limit", nil, 3, 5, 2},
+		{"encrypted", []*MasterKey{testMasterKey(t, 1)}, 3, 7, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dsn := fmt.Sprintf("%s?compact=%d", dir, tc.limit)
+			db, err := OpenWAL(dsn, tc.keys...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tc.users; i++ {
+				if _, err = db.NewUser(fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@example.com", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if db.records != tc.log {
+				t.Errorf("expected %d records in the log, got %d", tc.log, db.records)
+			}
+			crashWAL(db)
+
+			if db, err = OpenWAL(dsn, tc.keys...); err != nil {
+				t.Fatal(err)
+			}
+
+			if users, _ := db.ListUsers(); len(users) != tc.users {
+				t.Errorf("expected %d users after replay, got %d", tc.users, len(users))
+			}
+
+			// Closing the store compacts any records remaining in the log.
+			if err = db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if info, err := os.Stat(filepath.Join(dir, walLogName)); err != nil || info.Size() != 0 {
+				t.Errorf("expected the log to be empty after close: %v", err)
+			}
+
+			if db, err = OpenWAL(dsn, tc.keys...); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if users, _ := db.ListUsers(); len(users) != tc.users {
+				t.Errorf("expected %d users from the snapshot, got %d", tc.users, len(users))
+			}
+		})
+	}
+}
+
+func TestWALCompactionCrash(t *testing.T) {
+	// If the process crashes after the snapshot is written but before the log is
+	// truncated, the records in the snapshot must not be applied twice.
+	dir := t.TempDir()
+	db, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.AddCredential(user, testCredential(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RemoveCredential(user, testCredential(1).ID); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(filepath.Join(dir, walLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, walLogName), log, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = OpenWAL(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, err := db.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 1 || len(users[0].Credentials()) != 0 {
+		t.Errorf("expected one user without credentials, got %d users", len(users))
+	}
+}
+
+// Simulate a crash by releasing the files of the store without compacting the log.
+func crashWAL(db *WAL) {
+	db.log.Close()
+	unlockFile(db.lock)
+}
+
+func appendBytes(b ...byte) func(*testing.T, []byte) []byte {
+	return func(_ *testing.T, data []byte) []byte {
+		return append(data, b...)
+	}
+}
+
+// A plaintext record that creates a user, as it could be injected by someone with write
+// access to the log.
+var injectedUser = []byte(`{"seq":100,"op":"create_user","user":{"id":"a5a8cfd8-13c8-4d3b-9a2c-67d8e9a1f10b","name":"Mallory","email":"mallory@example.com","credentials":[]}}`)
+
+// Appends records with valid headers and checksums to the log.
+func appendRecord(records ...[]byte) func(*testing.T, []byte) []byte {
+	return func(_ *testing.T, data []byte) []byte {
+		for _, record := range records {
+			header := make([]byte, walHeaderSize)
+			binary.BigEndian.PutUint32(header[0:4], uint32(len(record)))
+			binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(record))
+			data = append(append(data, header...), record...)
+		}
+		return data
+	}
+}
+
+func flipByte(offset int) func(*testing.T, []byte) []byte {
+	return func(t *testing.T, data []byte) []byte {
+		if offset >= len(data) {
+			t.Fatalf("cannot flip byte %d of %d byte log", offset, len(data))
+		}
+		data[offset] ^= 0xff
+		return data
+	}
+}
+
+func flipLastByte(t *testing.T, data []byte) []byte {
+	return flipByte(len(data)-1)(t, data)
+}
+
+func setLength(offset int, length uint32) func(*testing.T, []byte) []byte {
+	return func(_ *testing.T, data []byte) []byte {
+		binary.BigEndian.PutUint32(data[offset:offset+4], length)
+		return data
+	}
+}
+
+func TestWALEncryptResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		marker bool
+		err    error
+	}{
+		{"resumed", true, nil},
+		{"plaintext without marker", false, ErrCorruptLog},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := OpenWAL(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 3; i++ {
+				if _, err = db.NewUser(fmt.Sprintf("User %d", i), fmt.Sprintf("user%d@example.com", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			crashWAL(db)
+
+			plaintext, err := os.ReadFile(filepath.Join(dir, walLogName))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Enable encryption, then restore the state of a crash after the data key was
+			// written but before the plaintext log was rewritten.
+			key := testMasterKey(t, 1)
+			if db, err = OpenWAL(dir, key); err != nil {
+				t.Fatal(err)
+			}
+			crashWAL(db)
+
+			if err = os.Remove(filepath.Join(dir, walSnapshotName)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = os.WriteFile(filepath.Join(dir, walLogName), plaintext, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.marker {
+				if err = os.WriteFile(filepath.Join(dir, walEncryptingName), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err = OpenWAL(dir, key)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+
+			if tc.err != nil {
+				return
+			}
+			defer db.Close()
+
+			if users, _ := db.ListUsers(); len(users) != 3 {
+				t.Errorf("expected 3 users after encryption was resumed, got %d", len(users))
+			}
+
+			if _, err = os.Stat(filepath.Join(dir, walEncryptingName)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected the marker to be removed, got %v", err)
+			}
+		})
+	}
+}
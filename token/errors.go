@@ -0,0 +1,14 @@
+package token
+
+import "errors"
+
+var (
+	ErrUnsupportedKey      = errors.New("unsupported signing key type")
+	ErrNoPrivateKey        = errors.New("no PEM encoded private key found")
+	ErrMissingTokenSubject = errors.New("token grant must have a user")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	ErrInvalidAccessToken  = errors.New("invalid access token")
+	ErrUnknownKeyID        = errors.New("token was not signed by a known key")
+)
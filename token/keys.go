@@ -0,0 +1,185 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a private key used to sign tokens. The key ID is the RFC 7638 thumbprint
+// of the public key so that it is stable across restarts and replicas that load the
+// same key; it is used as the kid header of tokens and in the JWKS.
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+// LoadSigningKey loads a PEM encoded PKCS #8, SEC 1 (EC), or PKCS #1 (RSA) private key.
+func LoadSigningKey(path string) (_ *SigningKey, err error) {
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, ErrNoPrivateKey
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			// Skip other blocks such as EC PARAMETERS
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("could not parse private key in %s: %w", path, err)
+		}
+		return NewSigningKey(key)
+	}
+}
+
+// GenerateSigningKey creates a random ES256 (P-256) signing key.
+func GenerateSigningKey() (_ *SigningKey, err error) {
+	var key *ecdsa.PrivateKey
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+	return NewSigningKey(key)
+}
+
+// NewSigningKey wraps an ECDSA (P-256, P-384, or P-521), RSA, or Ed25519 private key,
+// selecting the JWT signing algorithm from the key type.
+func NewSigningKey(key interface{}) (_ *SigningKey, err error) {
+	sk := &SigningKey{}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			sk.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			sk.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			sk.Method = jwt.SigningMethodES512
+		default:
+			return nil, ErrUnsupportedKey
+		}
+		sk.key = k
+	case *rsa.PrivateKey:
+		sk.Method = jwt.SigningMethodRS256
+		sk.key = k
+	case ed25519.PrivateKey:
+		sk.Method = jwt.SigningMethodEdDSA
+		sk.key = k
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	if sk.ID, err = sk.JWK().Thumbprint(); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// Public returns the public key used to verify tokens signed by the key.
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+// PEM encodes the private key as a PKCS #8 PEM block.
+func (k *SigningKey) PEM() (_ []byte, err error) {
+	var der []byte
+	if der, err = x509.MarshalPKCS8PrivateKey(k.key); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// JWK returns the public key in JSON Web Key format.
+func (k *SigningKey) JWK() *JWK {
+	jwk := &JWK{
+		Use: "sig",
+		Alg: k.Method.Alg(),
+		Kid: k.ID,
+	}
+
+	switch pub := k.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = encode(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = encode(pub.Y.FillBytes(make([]byte, size)))
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(pub.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(pub)
+	}
+	return jwk
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set containing the public keys that verify issued tokens.
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// Thumbprint computes the RFC 7638 thumbprint of the key: the base64url encoded SHA-256
+// hash of the required members of the key in lexicographic order.
+func (k *JWK) Thumbprint() (string, error) {
+	var members string
+	switch k.Kty {
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, k.E, k.Kty, k.N)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	default:
+		return "", ErrUnsupportedKey
+	}
+
+	hash := sha256.Sum256([]byte(members))
+	return encode(hash[:]), nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
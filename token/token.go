@@ -0,0 +1,398 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// TokenType is the type of the issued access tokens.
+	TokenType = "Bearer"
+
+	// AccessTokenType is the typ header of access tokens (RFC 9068).
+	AccessTokenType = "at+jwt"
+
+	// SecretLength is the number of random bytes in the family ID and in the secret of
+	// a refresh token.
+	SecretLength = 32
+)
+
+// Authentication methods (RFC 8176) that are added to the amr claim of access tokens.
+const (
+	MethodHardwareKey = "hwk" // proof of possession of a hardware-secured key
+	MethodMultiFactor = "mfa" // the authenticator verified the user (PIN or biometric)
+)
+
+// Claims of the access tokens. The subject is the ID of the user; CredentialID is the
+// base64url encoded ID of the credential used to login and SessionID is the ID of the
+// login session that the tokens were issued for.
+type Claims struct {
+	jwt.RegisteredClaims
+	Email        string           `json:"email,omitempty"`
+	AMR          []string         `json:"amr"`
+	CredentialID string           `json:"cid"`
+	UserVerified bool             `json:"uv"`
+	SessionID    string           `json:"sid"`
+	AuthTime     *jwt.NumericDate `json:"auth_time,omitempty"`
+}
+
+// Grant describes the login that tokens are issued for. Refresh tokens cannot be used
+// after the grant expires, e.g. when the login session ends.
+type Grant struct {
+	UserID       uuid.UUID `json:"user_id"`
+	CredentialID []byte    `json:"credential_id"`
+	UserVerified bool      `json:"user_verified"`
+	SessionID    string    `json:"session_id"`
+	AuthTime     time.Time `json:"auth_time"`
+	Expires      time.Time `json:"expires"`
+}
+
+// Family is the server-side record of a chain of rotating refresh tokens issued for a
+// grant. Only the hash of the most recently issued refresh token is stored; presenting
+// an older token of the family is treated as a sign that the token was stolen.
+type Family struct {
+	ID string `json:"-"`
+	Grant
+	Secret []byte `json:"secret"`
+}
+
+// Tokens are the access and refresh tokens issued for a grant.
+type Tokens struct {
+	AccessToken    string
+	AccessExpires  time.Time
+	RefreshToken   string
+	RefreshExpires time.Time
+}
+
+// Issuer signs access tokens and issues rotating refresh tokens whose families are kept
+// in the persistence backend as sessions without a user, so that they are swept when
+// they expire but are never mistaken for login sessions.
+type Issuer struct {
+	sync.Mutex
+	conf config.TokenConfig
+	keys []*SigningKey
+	db   store.SessionStore
+}
+
+// New creates a token issuer, loading the signing keys from the configuration or
+// generating a random key if none are configured.
+func New(conf config.TokenConfig, db store.SessionStore) (_ *Issuer, err error) {
+	issuer := &Issuer{conf: conf, db: db}
+	for _, path := range conf.Keys {
+		var key *SigningKey
+		if key, err = LoadSigningKey(path); err != nil {
+			return nil, err
+		}
+		issuer.keys = append(issuer.keys, key)
+	}
+
+	if len(issuer.keys) == 0 {
+		var key *SigningKey
+		if key, err = GenerateSigningKey(); err != nil {
+			return nil, err
+		}
+		issuer.keys = append(issuer.keys, key)
+	}
+	return issuer, nil
+}
+
+// Issue access and refresh tokens for a new grant, starting a new refresh token family.
+func (i *Issuer) Issue(grant *Grant, email string) (_ *Tokens, err error) {
+	if grant.UserID == uuid.Nil {
+		return nil, ErrMissingTokenSubject
+	}
+
+	var id []byte
+	if id, err = random(); err != nil {
+		return nil, err
+	}
+
+	family := &Family{ID: encode(id), Grant: *grant}
+
+	i.Lock()
+	defer i.Unlock()
+	return i.issue(family, email)
+}
+
+// Lookup the family of the refresh token. If the token is not the most recently issued
+// token of its family, the family is revoked and ErrRefreshTokenReused is returned along
+// with the family so that the caller can respond to the suspected theft. The lock is
+// held so that a concurrent rotation cannot save the family after it is revoked.
+func (i *Issuer) Lookup(refreshToken string) (_ *Family, err error) {
+	var (
+		id     string
+		secret []byte
+	)
+
+	if id, secret, err = parseRefresh(refreshToken); err != nil {
+		return nil, err
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	var family *Family
+	if family, err = i.family(id); err != nil {
+		return nil, err
+	}
+
+	if !family.matches(secret) {
+		if err = i.db.DeleteSession(family.ID); err != nil {
+			return family, err
+		}
+		return family, ErrRefreshTokenReused
+	}
+	return family, nil
+}
+
+// Rotate issues new access and refresh tokens for the family of a refresh token returned
+// by Lookup; the previous refresh token can no longer be used. If another request
+// rotated the family after it was looked up, the same refresh token was used twice so
+// the family is revoked and ErrRefreshTokenReused is returned.
+func (i *Issuer) Rotate(family *Family, email string) (_ *Tokens, err error) {
+	i.Lock()
+	defer i.Unlock()
+
+	var current *Family
+	if current, err = i.family(family.ID); err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(current.Secret, family.Secret) != 1 {
+		if err = i.db.DeleteSession(current.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	return i.issue(current, email)
+}
+
+// Revoke the family of the refresh token so that none of its tokens can be used. Access
+// tokens that have already been issued remain valid until they expire. Tokens that are
+// invalid or have already been revoked are ignored as described by RFC 7009.
+func (i *Issuer) Revoke(refreshToken string) (err error) {
+	var (
+		id     string
+		secret []byte
+	)
+
+	if id, secret, err = parseRefresh(refreshToken); err != nil {
+		return nil
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	var family *Family
+	if family, err = i.family(id); err != nil {
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenExpired) {
+			return nil
+		}
+		return err
+	}
+
+	if !family.matches(secret) {
+		return nil
+	}
+	return i.db.DeleteSession(family.ID)
+}
+
+// Verify the signature and claims of an access token issued by this issuer. Tokens are
+// issued for every configured audience, but only the first audience is checked since it
+// identifies this server; other audiences verify tokens with the published JWKS.
+func (i *Issuer) Verify(accessToken string) (_ *Claims, err error) {
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range i.keys {
+			if key.ID == kid && key.Method.Alg() == token.Method.Alg() {
+				return key.Public(), nil
+			}
+		}
+		return nil, ErrUnknownKeyID
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithIssuer(i.conf.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods(i.methods()),
+	}
+
+	if len(i.conf.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(i.conf.Audience[0]))
+	}
+
+	claims := &Claims{}
+	if _, err = jwt.ParseWithClaims(accessToken, claims, keyfunc, opts...); err != nil {
+		return nil, errors.Join(ErrInvalidAccessToken, err)
+	}
+	return claims, nil
+}
+
+// JWKS returns the public keys of all configured signing keys.
+func (i *Issuer) JWKS() *JWKS {
+	jwks := &JWKS{Keys: make([]*JWK, 0, len(i.keys))}
+	for _, key := range i.keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+	return jwks
+}
+
+// Sign a new access token and rotate the refresh token of the family; must be called
+// while holding the lock.
+func (i *Issuer) issue(family *Family, email string) (_ *Tokens, err error) {
+	now := time.Now().UTC()
+	tokens := &Tokens{
+		AccessExpires:  now.Add(i.conf.AccessTTL),
+		RefreshExpires: now.Add(i.conf.RefreshTTL),
+	}
+
+	// Tokens cannot outlive the login they were issued for
+	if family.Expires.Before(now) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if tokens.AccessExpires.After(family.Expires) {
+		tokens.AccessExpires = family.Expires
+	}
+
+	if tokens.RefreshExpires.After(family.Expires) {
+		tokens.RefreshExpires = family.Expires
+	}
+
+	var jti []byte
+	if jti, err = random(); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        encode(jti),
+			Issuer:    i.conf.Issuer,
+			Subject:   family.UserID.String(),
+			Audience:  i.conf.Audience,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(tokens.AccessExpires),
+		},
+		Email:        email,
+		AMR:          []string{MethodHardwareKey},
+		CredentialID: encode(family.CredentialID),
+		UserVerified: family.UserVerified,
+		SessionID:    family.SessionID,
+		AuthTime:     jwt.NewNumericDate(family.AuthTime),
+	}
+
+	if family.UserVerified {
+		claims.AMR = append(claims.AMR, MethodMultiFactor)
+	}
+
+	key := i.keys[0]
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = AccessTokenType
+
+	if tokens.AccessToken, err = token.SignedString(key.key); err != nil {
+		return nil, err
+	}
+
+	var secret []byte
+	if secret, err = random(); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(secret)
+	family.Secret = hash[:]
+
+	record := &store.Session{
+		ID:      family.ID,
+		Expires: tokens.RefreshExpires,
+	}
+
+	if record.Data, err = json.Marshal(family); err != nil {
+		return nil, err
+	}
+
+	if err = i.db.SaveSession(record); err != nil {
+		return nil, err
+	}
+
+	tokens.RefreshToken = family.ID + "." + encode(secret)
+	return tokens, nil
+}
+
+// Load the family of a refresh token from the persistence backend.
+func (i *Issuer) family(id string) (_ *Family, err error) {
+	var record *store.Session
+	if record, err = i.db.GetSession(id); err != nil {
+		if errors.Is(err, store.ErrSessionNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	// Login sessions are stored alongside refresh token families
+	if record.UserID != uuid.Nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	family := &Family{}
+	if err = json.Unmarshal(record.Data, family); err != nil || family.UserID == uuid.Nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if record.Expired() {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	family.ID = record.ID
+	return family, nil
+}
+
+// Returns the signing algorithms of the configured keys.
+func (i *Issuer) methods() []string {
+	methods := make([]string, 0, len(i.keys))
+	for _, key := range i.keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
+
+// Returns true if the secret is the most recently issued secret of the family.
+func (f *Family) matches(secret []byte) bool {
+	hash := sha256.Sum256(secret)
+	return subtle.ConstantTimeCompare(hash[:], f.Secret) == 1
+}
+
+// Splits a refresh token into the ID of its family and its secret.
+func parseRefresh(refreshToken string) (id string, secret []byte, err error) {
+	var encoded string
+	var ok bool
+	if id, encoded, ok = strings.Cut(refreshToken, "."); !ok || id == "" {
+		return "", nil, ErrInvalidRefreshToken
+	}
+
+	if secret, err = base64.RawURLEncoding.DecodeString(encoded); err != nil || len(secret) != SecretLength {
+		return "", nil, ErrInvalidRefreshToken
+	}
+	return id, secret, nil
+}
+
+func random() (b []byte, err error) {
+	b = make([]byte, SecretLength)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
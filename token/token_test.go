@@ -0,0 +1,247 @@
+package token
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestRefreshRotation(t *testing.T) {
+	issuer, db := newTestIssuer(t, "https://yubikey.local")
+	grant := testGrant(time.Hour)
+
+	first, err := issuer.Issue(grant, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	family, err := issuer.Lookup(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if family.UserID != grant.UserID || family.SessionID != grant.SessionID {
+		t.Fatalf("unexpected family %+v", family)
+	}
+
+	second, err := issuer.Rotate(family, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Fatal("expected new tokens to be issued on rotation")
+	}
+
+	// The rotated token can be used but the first token has been replaced.
+	if _, err = issuer.Lookup(second.RefreshToken); err != nil {
+		t.Errorf("expected the rotated refresh token to be valid, got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"reused", first.RefreshToken, ErrRefreshTokenReused},
+		{"family revoked", second.RefreshToken, ErrInvalidRefreshToken},
+		{"malformed", "not a token", ErrInvalidRefreshToken},
+		{"unknown family", "unknown." + encode(make([]byte, SecretLength)), ErrInvalidRefreshToken},
+	}
+
+	for _, tc := range tests {
+		if _, err = issuer.Lookup(tc.token); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	if _, err = db.GetSession(family.ID); !errors.Is(err, store.ErrSessionNotFound) {
+		t.Errorf("expected the family to be revoked after reuse, got %v", err)
+	}
+}
+
+func TestRefreshExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires time.Duration
+		err     error
+	}{
+		{"active", time.Hour, nil},
+		{"grant expired", -time.Second, ErrRefreshTokenExpired},
+	}
+
+	for _, tc := range tests {
+		issuer, _ := newTestIssuer(t, "https://yubikey.local")
+		tokens, err := issuer.Issue(testGrant(tc.expires), "jane@example.com")
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		if tc.err == nil && tokens.RefreshExpires.After(time.Now().Add(tc.expires)) {
+			t.Errorf("%s: refresh token outlives the grant", tc.name)
+		}
+	}
+}
+
+func TestConcurrentRotation(t *testing.T) {
+	// Presenting the same refresh token in concurrent requests is a reuse: at most one
+	// request can rotate the family and the family must end up revoked.
+	issuer, db := newTestIssuer(t, "https://yubikey.local")
+	tokens, err := issuer.Issue(testGrant(time.Hour), "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		rotated int
+		id      string
+	)
+
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			family, err := issuer.Lookup(tokens.RefreshToken)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			id = family.ID
+			mu.Unlock()
+
+			if _, err = issuer.Rotate(family, "jane@example.com"); err == nil {
+				mu.Lock()
+				rotated++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if rotated > 1 {
+		t.Errorf("expected at most one rotation, got %d", rotated)
+	}
+
+	if _, err = db.GetSession(id); !errors.Is(err, store.ErrSessionNotFound) {
+		t.Errorf("expected the family to be revoked after concurrent reuse, got %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	issuer, _ := newTestIssuer(t, "https://yubikey.local")
+	tokens, err := issuer.Issue(testGrant(time.Hour), "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid and unknown tokens are ignored.
+	for _, token := range []string{"", "not a token", tokens.RefreshToken, tokens.RefreshToken} {
+		if err = issuer.Revoke(token); err != nil {
+			t.Errorf("expected revoking %q to succeed, got %v", token, err)
+		}
+	}
+
+	if _, err = issuer.Lookup(tokens.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected a revoked refresh token to be invalid, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer, _ := newTestIssuer(t, "https://yubikey.local", "https://api.yubikey.local")
+	grant := testGrant(time.Hour)
+	tokens, err := issuer.Issue(grant, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := issuer.Verify(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != grant.UserID.String() || claims.SessionID != grant.SessionID || len(claims.Audience) != 2 {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// Only the first audience identifies this server, so tokens issued for another
+	// service with the same keys are rejected.
+	api, _ := newTestIssuer(t, "https://api.yubikey.local")
+	api.keys = issuer.keys
+	apiTokens, err := api.Issue(grant, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown, _ := newTestIssuer(t, "https://yubikey.local")
+
+	tests := []struct {
+		name   string
+		issuer *Issuer
+		token  string
+		err    error
+	}{
+		{"valid", issuer, tokens.AccessToken, nil},
+		{"other service", api, tokens.AccessToken, nil},
+		{"other audience", issuer, apiTokens.AccessToken, ErrInvalidAccessToken},
+		{"unknown key", unknown, tokens.AccessToken, ErrInvalidAccessToken},
+		{"tampered", issuer, tokens.AccessToken + "x", ErrInvalidAccessToken},
+		{"malformed", issuer, "not a token", ErrInvalidAccessToken},
+	}
+
+	for _, tc := range tests {
+		if _, err = tc.issuer.Verify(tc.token); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// Tokens without an expiration are rejected.
+	token := jwt.NewWithClaims(issuer.keys[0].Method, &Claims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "https://yubikey.local", Audience: jwt.ClaimStrings{"https://yubikey.local"}}})
+	token.Header["kid"] = issuer.keys[0].ID
+	unexpiring, err := token.SignedString(issuer.keys[0].key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = issuer.Verify(unexpiring); !errors.Is(err, ErrInvalidAccessToken) {
+		t.Errorf("expected a token without an expiration to be invalid, got %v", err)
+	}
+}
+
+// Creates an issuer with a random signing key backed by an in-memory store.
+func newTestIssuer(t *testing.T, audience ...string) (*Issuer, store.SessionStore) {
+	db := store.NewMemory()
+	issuer, err := New(config.TokenConfig{
+		Enabled:    true,
+		Issuer:     "https://yubikey.local",
+		Audience:   audience,
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 24 * time.Hour,
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer, db
+}
+
+// Returns a grant for a new user whose login expires after the duration.
+func testGrant(expires time.Duration) *Grant {
+	now := time.Now()
+	return &Grant{
+		UserID:       uuid.New(),
+		CredentialID: []byte{0xc0, 0xde},
+		UserVerified: true,
+		SessionID:    "session",
+		AuthTime:     now,
+		Expires:      now.Add(expires),
+	}
+}
@@ -0,0 +1,190 @@
+package yubikey
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/bbengfort/yubikey/token"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// JWKS publishes the public keys that verify access tokens so that other services can
+// trust logins without sharing the session keys.
+func (s *Server) JWKS(c *gin.Context) {
+	if s.tokens == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTokensDisabled.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s.tokens.JWKS())
+}
+
+// BearerToken is middleware that authenticates the request with an access token in the
+// Authorization header in place of the session cookie, so that clients holding tokens
+// can check the login they were issued for. The login session, user, and credential
+// must still be valid; requests without a bearer token are left to the session cookie.
+func (s *Server) BearerToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, accessToken, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+		if s.tokens == nil || !ok || !strings.EqualFold(scheme, token.TokenType) {
+			c.Next()
+			return
+		}
+
+		claims, err := s.tokens.Verify(accessToken)
+		if err != nil {
+			log.Debug().Err(err).Msg("could not verify access token")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidAccessToken.Error()})
+			return
+		}
+
+		var userID uuid.UUID
+		if userID, err = uuid.Parse(claims.Subject); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidAccessToken.Error()})
+			return
+		}
+
+		auth := &session.Authentication{
+			SessionID:    claims.SessionID,
+			UserID:       userID[:],
+			UserVerified: claims.UserVerified,
+			Expires:      claims.ExpiresAt.Time,
+		}
+
+		if claims.AuthTime != nil {
+			auth.AuthTime = claims.AuthTime.Time
+		}
+
+		if auth.CredentialID, err = store.DecodeKeyID(claims.CredentialID); err != nil || !s.authenticate(c, auth) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidAccessToken.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new refresh token.
+// Refresh tokens can only be used while the login session they were issued for is
+// active and the credential used to login has not been revoked. If a refresh token is
+// used more than once, the tokens and the login session are revoked since the token was
+// most likely stolen.
+func (s *Server) RefreshToken(c *gin.Context) {
+	if s.tokens == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTokensDisabled.Error()})
+		return
+	}
+
+	in := &v1.TokenRefresh{}
+	if err := c.BindJSON(in); err != nil {
+		log.Warn().Err(err).Msg("could not bind token refresh")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not bind token refresh"})
+		return
+	}
+
+	family, err := s.tokens.Lookup(in.RefreshToken)
+	if err != nil {
+		if errors.Is(err, token.ErrRefreshTokenReused) {
+			s.refreshTokenReused(c, family)
+		} else if !errors.Is(err, token.ErrInvalidRefreshToken) && !errors.Is(err, token.ErrRefreshTokenExpired) {
+			log.Error().Err(err).Msg("could not lookup refresh token")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not refresh token"})
+			return
+		}
+
+		c.JSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidRefreshToken.Error()})
+		return
+	}
+
+	// The login session, user, and credential must all still be valid
+	var (
+		login *session.LoginSession
+		user  *store.User
+		cred  store.Credential
+	)
+
+	if login, err = s.sessions.Logins.Get(family.SessionID); err != nil || login.UserID != family.UserID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidRefreshToken.Error()})
+		return
+	}
+
+	if user, err = s.users.Lookup(family.UserID); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidRefreshToken.Error()})
+		return
+	}
+
+	if cred, err = user.Credential(family.CredentialID); err != nil || cred.IsRevoked() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidRefreshToken.Error()})
+		return
+	}
+
+	var tokens *token.Tokens
+	if tokens, err = s.tokens.Rotate(family, user.WebAuthnName()); err != nil {
+		if errors.Is(err, token.ErrRefreshTokenReused) {
+			s.refreshTokenReused(c, family)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": token.ErrInvalidRefreshToken.Error()})
+			return
+		}
+
+		log.Error().Err(err).Msg("could not rotate refresh token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not refresh token"})
+		return
+	}
+	c.JSON(http.StatusOK, tokensReply(tokens))
+}
+
+// RevokeToken revokes a refresh token and all refresh tokens rotated from it; access
+// tokens remain valid until they expire. As described by RFC 7009 the response is the
+// same whether or not the token was valid.
+func (s *Server) RevokeToken(c *gin.Context) {
+	if s.tokens == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrTokensDisabled.Error()})
+		return
+	}
+
+	in := &v1.TokenRevoke{}
+	if err := c.BindJSON(in); err != nil {
+		log.Warn().Err(err).Msg("could not bind token revocation")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not bind token revocation"})
+		return
+	}
+
+	if err := s.tokens.Revoke(in.Token); err != nil {
+		log.Error().Err(err).Msg("could not revoke refresh token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "token revoked"})
+}
+
+// Respond to a refresh token that was used more than once by revoking the login session
+// it was issued for and recording a security event. The refresh token family has
+// already been revoked by the issuer.
+func (s *Server) refreshTokenReused(c *gin.Context, family *token.Family) {
+	if err := s.sessions.Logins.Revoke(family.SessionID); err != nil {
+		log.Error().Err(err).Msg("could not revoke login session after refresh token reuse")
+	}
+
+	user, err := s.users.Lookup(family.UserID)
+	if err != nil {
+		log.Warn().Err(err).Msg("refresh token reused by unknown user")
+		return
+	}
+	s.securityEvent(c, store.EventRefreshTokenReused, user, family.CredentialID, "refresh token reused, login session revoked")
+}
+
+// tokensReply converts issued tokens into their API representation.
+func tokensReply(tokens *token.Tokens) *v1.Tokens {
+	return &v1.Tokens{
+		AccessToken:    tokens.AccessToken,
+		TokenType:      token.TokenType,
+		ExpiresIn:      int64(time.Until(tokens.AccessExpires).Round(time.Second).Seconds()),
+		RefreshToken:   tokens.RefreshToken,
+		RefreshExpires: tokens.RefreshExpires.Format(time.RFC3339),
+	}
+}
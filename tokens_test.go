@@ -0,0 +1,111 @@
+package yubikey
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/token"
+	"github.com/gin-gonic/gin"
+)
+
+func TestBearerToken(t *testing.T) {
+	conf := config.Config{
+		AllowOrigins: []string{"https://yubikey.local"},
+		Token: config.TokenConfig{
+			Enabled:    true,
+			Issuer:     "https://yubikey.local",
+			Audience:   []string{"https://yubikey.local"},
+			AccessTTL:  15 * time.Minute,
+			RefreshTTL: time.Hour,
+		},
+	}
+
+	s := newTestServer(t, conf)
+	s.router = gin.New()
+	if err := s.setupRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	s.SetStatus(true, true)
+
+	var err error
+	if s.tokens, err = token.New(conf.Token, s.users); err != nil {
+		t.Fatal(err)
+	}
+
+	user, cookie := testLogin(t, s, "jane@example.com")
+	logins, err := s.sessions.Logins.List(user.ID)
+	if err != nil || len(logins) != 1 {
+		t.Fatalf("expected one login session: %v", err)
+	}
+
+	grant := &token.Grant{
+		UserID:       user.ID,
+		CredentialID: logins[0].CredentialID,
+		SessionID:    logins[0].ID,
+		AuthTime:     time.Now(),
+		Expires:      logins[0].Expires,
+	}
+
+	tokens, err := s.tokens.Issue(grant, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        bool
+		status        int
+	}{
+		{"anonymous", "", false, http.StatusUnauthorized},
+		{"cookie", "", true, http.StatusOK},
+		{"bearer", "Bearer " + tokens.AccessToken, false, http.StatusOK},
+		{"lowercase scheme", "bearer " + tokens.AccessToken, false, http.StatusOK},
+		{"invalid token", "Bearer " + tokens.AccessToken + "x", false, http.StatusUnauthorized},
+		{"invalid token with cookie", "Bearer not-a-token", true, http.StatusUnauthorized},
+		{"other scheme", "Basic amFuZTpzZWNyZXQ=", false, http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/session", nil)
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+
+		if tc.cookie {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+			continue
+		}
+
+		if tc.status == http.StatusOK {
+			reply := &v1.Session{}
+			if err = json.Unmarshal(w.Body.Bytes(), reply); err != nil || reply.UserID != user.ID.String() {
+				t.Errorf("%s: unexpected session reply %s", tc.name, w.Body.String())
+			}
+		}
+	}
+
+	// Access tokens cannot be used once the login session has been revoked.
+	if err = s.sessions.Logins.Revoke(logins[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/session", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a token of a revoked login session to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,9 @@
+package transaction
+
+import "errors"
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported transaction receipt version")
+	ErrChallengeMismatch  = errors.New("transaction does not match the issued challenge")
+	ErrInvalidReceipt     = errors.New("transaction receipt is not valid")
+)
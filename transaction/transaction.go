@@ -0,0 +1,142 @@
+package transaction
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/google/uuid"
+)
+
+// ReceiptVersion is the current version of the receipt format.
+const ReceiptVersion = 1
+
+// NonceLength is the number of random bytes combined with the payload so that the same
+// payload produces a different challenge each time it is confirmed.
+const NonceLength = 16
+
+// NewNonce generates a random nonce for a transaction.
+func NewNonce() (nonce []byte, err error) {
+	nonce = make([]byte, NonceLength)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// Challenge derives the WebAuthn challenge of a transaction as the SHA-256 hash of the
+// nonce followed by the payload, so that the signature of the assertion commits to the
+// exact bytes of the payload.
+func Challenge(nonce, payload []byte) []byte {
+	hash := sha256.New()
+	hash.Write(nonce)
+	hash.Write(payload)
+	return hash.Sum(nil)
+}
+
+// EncodeChallenge returns the challenge as it appears in the client data and the
+// webauthn session data.
+func EncodeChallenge(nonce, payload []byte) string {
+	return base64.RawURLEncoding.EncodeToString(Challenge(nonce, payload))
+}
+
+// Receipt is a verifiable record that a user confirmed a transaction payload with their
+// authenticator; it contains everything needed to verify the assertion signature again
+// later with the stored public key of the credential. Byte fields are base64 encoded.
+type Receipt struct {
+	Version           int       `json:"version"`
+	UserID            uuid.UUID `json:"user_id"`
+	CredentialID      []byte    `json:"credential_id"`
+	Payload           []byte    `json:"payload"`
+	Nonce             []byte    `json:"nonce"`
+	AuthenticatorData []byte    `json:"authenticator_data"`
+	ClientDataJSON    []byte    `json:"client_data_json"`
+	Signature         []byte    `json:"signature"`
+	Signed            time.Time `json:"signed"`
+}
+
+// NewReceipt creates a receipt from a validated transaction assertion.
+func NewReceipt(userID uuid.UUID, nonce, payload []byte, assertion *protocol.ParsedCredentialAssertionData) *Receipt {
+	return &Receipt{
+		Version:           ReceiptVersion,
+		UserID:            userID,
+		CredentialID:      assertion.RawID,
+		Payload:           payload,
+		Nonce:             nonce,
+		AuthenticatorData: assertion.Raw.AssertionResponse.AuthenticatorData,
+		ClientDataJSON:    assertion.Raw.AssertionResponse.ClientDataJSON,
+		Signature:         assertion.Raw.AssertionResponse.Signature,
+		Signed:            time.Now().UTC(),
+	}
+}
+
+// ReadReceipt reads a JSON encoded receipt.
+func ReadReceipt(r io.Reader) (receipt *Receipt, err error) {
+	receipt = &Receipt{}
+	if err = json.NewDecoder(r).Decode(receipt); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidReceipt, err)
+	}
+	return receipt, nil
+}
+
+// Verify the receipt with the COSE encoded public key of the credential that signed it.
+// The client data must contain the challenge derived from the nonce and payload and an
+// allowed origin, the authenticator data must be scoped to the relying party, and the
+// signature must be valid over the authenticator data and client data hash.
+func (r *Receipt) Verify(publicKey []byte, rpID string, origins []string) (err error) {
+	if r.Version < 1 || r.Version > ReceiptVersion {
+		return fmt.Errorf("%w %d", ErrUnsupportedVersion, r.Version)
+	}
+
+	response := protocol.CredentialAssertionResponse{
+		PublicKeyCredential: protocol.PublicKeyCredential{
+			Credential: protocol.Credential{
+				ID:   base64.RawURLEncoding.EncodeToString(r.CredentialID),
+				Type: string(protocol.PublicKeyCredentialType),
+			},
+			RawID: r.CredentialID,
+		},
+		AssertionResponse: protocol.AuthenticatorAssertionResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{
+				ClientDataJSON: r.ClientDataJSON,
+			},
+			AuthenticatorData: r.AuthenticatorData,
+			Signature:         r.Signature,
+		},
+	}
+
+	var parsed *protocol.ParsedCredentialAssertionData
+	if parsed, err = response.Parse(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidReceipt, err)
+	}
+
+	if err = parsed.Verify(EncodeChallenge(r.Nonce, r.Payload), rpID, origins, "", false, publicKey); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidReceipt, err)
+	}
+	return nil
+}
+
+// Verify the receipt against the credential in the store that signed it, returning the
+// user and credential. The credential must be registered to the user in the receipt.
+// Receipts signed by credentials that have since been revoked are still verified; the
+// caller should check the status of the returned credential.
+func Verify(db store.UserStore, receipt *Receipt, rpID string, origins []string) (user *store.User, cred store.Credential, err error) {
+	if user, cred, err = db.LookupByCredentialID(receipt.CredentialID); err != nil {
+		return nil, cred, fmt.Errorf("%w: %w", ErrInvalidReceipt, err)
+	}
+
+	if user.ID != receipt.UserID {
+		return nil, cred, fmt.Errorf("%w: credential is not registered to user %s", ErrInvalidReceipt, receipt.UserID)
+	}
+
+	if err = receipt.Verify(cred.PublicKey, rpID, origins); err != nil {
+		return nil, cred, err
+	}
+	return user, cred, nil
+}
@@ -0,0 +1,263 @@
+package transaction
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/store"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+const (
+	testRPID   = "yubikey.local"
+	testOrigin = "https://yubikey.local"
+)
+
+func TestChallenge(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0x01}, NonceLength)
+	payload := []byte(`{"deploy":"v1.2.3"}`)
+
+	if !bytes.Equal(Challenge(nonce, payload), Challenge(nonce, payload)) {
+		t.Error("expected the challenge to be derived deterministically")
+	}
+
+	tests := []struct {
+		name           string
+		nonce, payload []byte
+	}{
+		{"different nonce", bytes.Repeat([]byte{0x02}, NonceLength), payload},
+		{"different payload", nonce, []byte(`{"deploy":"v1.2.4"}`)},
+	}
+
+	expected := EncodeChallenge(nonce, payload)
+	for _, tc := range tests {
+		if EncodeChallenge(tc.nonce, tc.payload) == expected {
+			t.Errorf("%s: expected a different challenge", tc.name)
+		}
+	}
+
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonce) != NonceLength {
+		t.Errorf("expected nonce of %d bytes, got %d", NonceLength, len(nonce))
+	}
+}
+
+func TestReceiptVerify(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	other := newTestAuthenticator(t)
+
+	tests := []struct {
+		name    string
+		modify  func(*Receipt)
+		rpID    string
+		origins []string
+		err     error
+	}{
+		{"valid", func(*Receipt) {}, testRPID, []string{testOrigin}, nil},
+		{"modified payload", func(r *Receipt) { r.Payload = []byte(`{"deploy":"v6.6.6"}`) }, testRPID, []string{testOrigin}, ErrInvalidReceipt},
+		{"modified nonce", func(r *Receipt) { r.Nonce[0] ^= 0xff }, testRPID, []string{testOrigin}, ErrInvalidReceipt},
+		{"modified signature", func(r *Receipt) { r.Signature[len(r.Signature)-1] ^= 0xff }, testRPID, []string{testOrigin}, ErrInvalidReceipt},
+		{"other signer", func(r *Receipt) { r.Signature = other.sign(t, r.AuthenticatorData, r.ClientDataJSON) }, testRPID, []string{testOrigin}, ErrInvalidReceipt},
+		{"other relying party", func(*Receipt) {}, "example.com", []string{testOrigin}, ErrInvalidReceipt},
+		{"other origin", func(*Receipt) {}, testRPID, []string{"https://example.com"}, ErrInvalidReceipt},
+		{"truncated authenticator data", func(r *Receipt) { r.AuthenticatorData = r.AuthenticatorData[:16] }, testRPID, []string{testOrigin}, ErrInvalidReceipt},
+		{"no version", func(r *Receipt) { r.Version = 0 }, testRPID, []string{testOrigin}, ErrUnsupportedVersion},
+		{"future version", func(r *Receipt) { r.Version = ReceiptVersion + 1 }, testRPID, []string{testOrigin}, ErrUnsupportedVersion},
+	}
+
+	for _, tc := range tests {
+		receipt := authenticator.receipt(t, uuid.New(), []byte(`{"deploy":"v1.2.3"}`))
+		tc.modify(receipt)
+
+		if err := receipt.Verify(authenticator.publicKey(t), tc.rpID, tc.origins); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db := store.NewMemory()
+	jane, err := db.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	john, err := db.NewUser("John Doe", "john@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := newTestAuthenticator(t)
+	revoked := newTestAuthenticator(t)
+	for _, authenticator := range []*testAuthenticator{active, revoked} {
+		if err = db.AddCredential(jane, authenticator.credential(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.RevokeCredential(jane, revoked.id, "lost"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		receipt *Receipt
+		revoked bool
+		err     error
+	}{
+		{"valid", active.receipt(t, jane.ID, []byte("approve")), false, nil},
+		{"revoked credential", revoked.receipt(t, jane.ID, []byte("approve")), true, nil},
+		{"other user", active.receipt(t, john.ID, []byte("approve")), false, ErrInvalidReceipt},
+		{"unknown credential", newTestAuthenticator(t).receipt(t, jane.ID, []byte("approve")), false, ErrInvalidReceipt},
+	}
+
+	for _, tc := range tests {
+		user, cred, err := Verify(db, tc.receipt, testRPID, []string{testOrigin})
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+
+		if tc.err != nil {
+			continue
+		}
+
+		if user.ID != jane.ID {
+			t.Errorf("%s: expected user %s, got %s", tc.name, jane.ID, user.ID)
+		}
+
+		if !bytes.Equal(cred.ID, tc.receipt.CredentialID) {
+			t.Errorf("%s: expected the credential that signed the receipt", tc.name)
+		}
+
+		if cred.IsRevoked() != tc.revoked {
+			t.Errorf("%s: expected revoked %t, got %t", tc.name, tc.revoked, cred.IsRevoked())
+		}
+	}
+}
+
+func TestReadReceipt(t *testing.T) {
+	receipt := newTestAuthenticator(t).receipt(t, uuid.New(), []byte("approve"))
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ReadReceipt(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.UserID != receipt.UserID || !bytes.Equal(parsed.Payload, receipt.Payload) || !bytes.Equal(parsed.Signature, receipt.Signature) || !parsed.Signed.Equal(receipt.Signed) {
+		t.Errorf("expected receipt %+v, got %+v", receipt, parsed)
+	}
+
+	for _, invalid := range []string{"", "{", `{"version": "one"}`} {
+		if _, err = ReadReceipt(strings.NewReader(invalid)); !errors.Is(err, ErrInvalidReceipt) {
+			t.Errorf("%q: expected invalid receipt error, got %v", invalid, err)
+		}
+	}
+}
+
+// An ES256 authenticator that signs transaction assertions for the tests.
+type testAuthenticator struct {
+	id  []byte
+	key *ecdsa.PrivateKey
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthenticator{id: id, key: key}
+}
+
+// Returns the COSE encoded public key as stored with the credential.
+func (a *testAuthenticator) publicKey(t *testing.T) []byte {
+	key := webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	}
+
+	data, err := webauthncbor.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (a *testAuthenticator) credential(t *testing.T) store.Credential {
+	return store.Credential{Credential: webauthn.Credential{ID: a.id, PublicKey: a.publicKey(t)}}
+}
+
+// Returns a receipt for the payload as created by FinishTransaction.
+func (a *testAuthenticator) receipt(t *testing.T, userID uuid.UUID, payload []byte) *Receipt {
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientData, err := json.Marshal(protocol.CollectedClientData{
+		Type:      protocol.AssertCeremony,
+		Challenge: EncodeChallenge(nonce, payload),
+		Origin:    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RP ID hash, user present and verified flags, and the signature counter
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	authData := append(rpIDHash[:], byte(protocol.FlagUserPresent|protocol.FlagUserVerified))
+	authData = binary.BigEndian.AppendUint32(authData, 1)
+
+	return &Receipt{
+		Version:           ReceiptVersion,
+		UserID:            userID,
+		CredentialID:      a.id,
+		Payload:           payload,
+		Nonce:             nonce,
+		AuthenticatorData: authData,
+		ClientDataJSON:    clientData,
+		Signature:         a.sign(t, authData, clientData),
+		Signed:            time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func (a *testAuthenticator) sign(t *testing.T, authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
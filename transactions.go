@@ -0,0 +1,182 @@
+package yubikey
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/bbengfort/yubikey/transaction"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+// The maximum size of a transaction payload.
+const maxPayloadSize = 64 * 1024
+
+// BeginTransaction accepts an arbitrary transaction payload (e.g. JSON describing a
+// deployment approval) as the request body and issues a login challenge to the user in
+// the URL that is derived from the hash of the payload, so that the signature of the
+// assertion commits to the payload.
+func (s *Server) BeginTransaction(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPayloadSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("could not read transaction payload (maximum size %d bytes)", maxPayloadSize)})
+		return
+	}
+
+	if len(payload) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a transaction payload is required"})
+		return
+	}
+
+	var nonce []byte
+	if nonce, err = transaction.NewNonce(); err != nil {
+		log.Error().Err(err).Msg("could not generate transaction nonce")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not begin transaction"})
+		return
+	}
+
+	opts, session, err := s.authn.BeginLogin(user)
+	if err != nil {
+		log.Error().Err(err).Msg("could not begin webauthn transaction")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Replace the random challenge with the challenge derived from the transaction
+	opts.Response.Challenge = transaction.Challenge(nonce, payload)
+	session.Challenge = transaction.EncodeChallenge(nonce, payload)
+
+	// Session values must be stored
+	if err := s.sessions.SaveWebauthnSession("transaction", session, c.Request, c.Writer); err != nil {
+		log.Error().Err(err).Msg("could not save session data")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash := sha256.Sum256(payload)
+	c.JSON(http.StatusOK, &v1.TransactionChallenge{
+		Nonce:       nonce,
+		PayloadHash: hex.EncodeToString(hash[:]),
+		Options:     opts,
+	})
+}
+
+// FinishTransaction validates the assertion over the transaction challenge and returns a
+// signed receipt that can be verified later with the stored public key.
+func (s *Server) FinishTransaction(c *gin.Context) {
+	var (
+		user        *store.User
+		sessionData webauthn.SessionData
+		err         error
+		ok          bool
+	)
+
+	if sessionData, err = s.sessions.GetWebauthnSession("transaction", c.Request, c.Writer); err != nil {
+		log.Warn().Err(err).Msg("could not get session data from request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user, ok = s.lookupUser(c); !ok {
+		return
+	}
+
+	if !bytes.Equal(sessionData.UserID, user.WebAuthnID()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "transaction challenge was not issued for this user"})
+		return
+	}
+
+	in := &v1.TransactionConfirmation{}
+	if err = c.BindJSON(in); err != nil {
+		log.Warn().Err(err).Msg("could not bind transaction confirmation")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not bind transaction confirmation"})
+		return
+	}
+
+	// The nonce and payload must be the same as those used to derive the challenge
+	if transaction.EncodeChallenge(in.Nonce, in.Payload) != sessionData.Challenge {
+		c.JSON(http.StatusBadRequest, gin.H{"error": transaction.ErrChallengeMismatch.Error()})
+		return
+	}
+
+	var parsed *protocol.ParsedCredentialAssertionData
+	if parsed, err = protocol.ParseCredentialRequestResponseBody(bytes.NewReader(in.Assertion)); err != nil {
+		log.Warn().Err(err).Msg("could not parse transaction assertion")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var credential *webauthn.Credential
+	if credential, err = s.authn.ValidateLogin(user, sessionData, parsed); err != nil {
+		log.Warn().Err(err).Msg("could not confirm transaction")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err = s.updateCredential(c, user, credential, parsed); err != nil {
+		return
+	}
+
+	receipt := transaction.NewReceipt(user.ID, in.Nonce, in.Payload, parsed)
+	hash := sha256.Sum256(in.Payload)
+	s.securityEvent(c, store.EventTransactionConfirmed, user, credential.ID, fmt.Sprintf("transaction %s confirmed", hex.EncodeToString(hash[:])))
+	c.JSON(http.StatusOK, receipt)
+}
+
+// VerifyTransaction checks a transaction receipt against the stored public key of the
+// credential that signed it. Anyone holding a receipt can verify it, but the details of
+// the user and credential are only returned to the user who signed it.
+func (s *Server) VerifyTransaction(c *gin.Context) {
+	receipt, err := transaction.ReadReceipt(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, cred, err := transaction.Verify(s.users, receipt, s.conf.WebAuthn.RPID, s.conf.WebAuthn.Origins)
+	if err != nil {
+		if !errors.Is(err, transaction.ErrInvalidReceipt) && !errors.Is(err, transaction.ErrUnsupportedVersion) {
+			log.Error().Err(err).Msg("could not verify transaction receipt")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not verify transaction receipt"})
+			return
+		}
+
+		c.JSON(http.StatusOK, &v1.ReceiptVerification{Valid: false, Error: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, receiptVerification(c, user, cred, receipt))
+}
+
+// Describes a valid receipt, only identifying the user and credential that signed it if
+// that user is logged in.
+func receiptVerification(c *gin.Context, user *store.User, cred store.Credential, receipt *transaction.Receipt) *v1.ReceiptVerification {
+	out := &v1.ReceiptVerification{
+		Valid:   true,
+		Revoked: cred.IsRevoked(),
+		Signed:  receipt.Signed.Format(time.RFC3339),
+	}
+
+	if current := CurrentUser(c); current != nil && current.ID == user.ID {
+		out.UserID = user.ID.String()
+		out.Email = user.WebAuthnName()
+		out.CredentialID = cred.KeyID()
+		out.Nickname = cred.Nickname
+	}
+	return out
+}
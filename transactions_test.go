@@ -0,0 +1,102 @@
+package yubikey
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/bbengfort/yubikey/transaction"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestReceiptVerification(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	jane, err := s.users.NewUser("Jane Doe", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	john, err := s.users.NewUser("John Doe", "john@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred := store.Credential{Credential: webauthn.Credential{ID: []byte("jane")}, Nickname: "work key"}
+	receipt := &transaction.Receipt{UserID: jane.ID, CredentialID: cred.ID, Signed: time.Now()}
+
+	tests := []struct {
+		name     string
+		current  *store.User
+		identify bool
+	}{
+		{"anonymous", nil, false},
+		{"other user", john, false},
+		{"signer", jane, true},
+	}
+
+	for _, tc := range tests {
+		c, _ := newTestContext(http.MethodPost, "/v1/transactions/verify")
+		if tc.current != nil {
+			c.Set(ctxUserKey, tc.current)
+		}
+
+		out := receiptVerification(c, jane, cred, receipt)
+		if !out.Valid || out.Revoked || out.Signed == "" {
+			t.Errorf("%s: expected a valid, unrevoked, signed receipt, got %+v", tc.name, out)
+		}
+
+		identified := out.UserID != "" || out.Email != "" || out.CredentialID != "" || out.Nickname != ""
+		if identified != tc.identify {
+			t.Errorf("%s: expected signer identified %t, got %+v", tc.name, tc.identify, out)
+			continue
+		}
+
+		if tc.identify && (out.UserID != jane.ID.String() || out.Email != "jane@example.com" || out.CredentialID != cred.KeyID() || out.Nickname != "work key") {
+			t.Errorf("%s: unexpected signer %+v", tc.name, out)
+		}
+	}
+}
+
+func TestTransactionRoutesAuthorized(t *testing.T) {
+	s := newDefaultServer(t)
+	owner, ownerCookie := testLogin(t, s, "jane@example.com")
+	_, otherCookie := testLogin(t, s, "john@example.com")
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"anonymous begin", "/v1/users/%s/transactions/begin", nil, http.StatusUnauthorized},
+		{"anonymous finish", "/v1/users/%s/transactions/finish", nil, http.StatusUnauthorized},
+		{"other user begin", "/v1/users/%s/transactions/begin", otherCookie, http.StatusForbidden},
+		{"other user finish", "/v1/users/%s/transactions/finish", otherCookie, http.StatusForbidden},
+		{"owner begin", "/v1/users/%s/transactions/begin", ownerCookie, http.StatusOK},
+		{"owner finish without challenge", "/v1/users/%s/transactions/finish", ownerCookie, http.StatusBadRequest},
+		{"anonymous verify", "/v1/transactions/verify", nil, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		path := tc.path
+		if strings.Contains(path, "%s") {
+			path = fmt.Sprintf(path, owner.ID)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"deploy":"v1.2.3"}`))
+		if tc.cookie != nil {
+			r.AddCookie(tc.cookie)
+		}
+
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
@@ -2,174 +2,291 @@ package yubikey
 
 import (
 	"errors"
-	"sync"
+	"io"
+	"net/http"
+	"time"
 
-	"github.com/go-webauthn/webauthn/protocol"
-	"github.com/go-webauthn/webauthn/webauthn"
-	"github.com/google/uuid"
+	v1 "github.com/bbengfort/yubikey/api/v1"
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 )
 
-var (
-	ErrUserNotFound      = errors.New("user not found")
-	ErrUserAlreadyExists = errors.New("user already exists")
-	ErrUnknownIDType     = errors.New("unknown user ID type must be uuid")
-)
-
-func NewUsers() *Users {
-	return &Users{
-		users:  make(map[uuid.UUID]*User),
-		emails: make(map[string]uuid.UUID),
-		creds:  make(map[string]struct{}),
+// ListUsers returns the users visible to the logged in user and their credentials;
+// users can only see their own account.
+func (s *Server) ListUsers(c *gin.Context) {
+	out := &v1.UserList{Users: make([]*v1.User, 0, 1)}
+	if user := CurrentUser(c); user != nil {
+		out.Users = append(out.Users, userReply(user))
 	}
+	c.JSON(http.StatusOK, out)
 }
 
-type Users struct {
-	sync.RWMutex
-	users  map[uuid.UUID]*User
-	emails map[string]uuid.UUID
-	creds  map[string]struct{}
+// UserDetail returns the user specified by the userID in the URL.
+func (s *Server) UserDetail(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, userReply(user))
 }
 
-func (db *Users) Lookup(id interface{}) (_ *User, err error) {
-	var userID uuid.UUID
-	switch idtyp := id.(type) {
-	case string:
-		if userID, err = uuid.Parse(idtyp); err != nil {
-			return nil, err
+// UpdateUser changes the email address and/or display name of the user in the URL.
+func (s *Server) UpdateUser(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+
+	in := &v1.UserUpdate{}
+	if err := c.BindJSON(in); err != nil {
+		log.Warn().Err(err).Msg("could not bind user update")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not bind user update"})
+		return
+	}
+
+	if in.Email == "" && in.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "specify either a name or email address to update"})
+		return
+	}
+
+	if in.Email != "" && in.Email != user.WebAuthnName() {
+		if err := s.users.UpdateEmail(user, in.Email); err != nil {
+			if errors.Is(err, store.ErrUserAlreadyExists) {
+				c.JSON(http.StatusConflict, gin.H{"error": "email address is already registered"})
+				return
+			}
+
+			log.Error().Err(err).Msg("could not update user email")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update user"})
+			return
 		}
-	case []byte:
-		if userID, err = uuid.FromBytes(idtyp); err != nil {
-			return nil, err
+		s.securityEvent(c, store.EventEmailChanged, user, nil, "email address changed")
+	}
+
+	if in.Name != "" {
+		if err := s.users.UpdateName(user, in.Name); err != nil {
+			log.Error().Err(err).Msg("could not update user name")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update user"})
+			return
 		}
-	case uuid.UUID:
-		userID = idtyp
-	default:
-		return nil, ErrUnknownIDType
 	}
 
-	if user, ok := db.users[userID]; ok {
-		return user, nil
+	c.JSON(http.StatusOK, userReply(user))
+}
+
+// DeleteUser removes the user in the URL and all of their credentials. Security events
+// for the user are kept for auditing.
+func (s *Server) DeleteUser(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
 	}
-	return nil, ErrUserNotFound
+
+	if err := s.users.DeleteUser(user.ID); err != nil {
+		if errors.Is(err, store.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		log.Error().Err(err).Msg("could not delete user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete user"})
+		return
+	}
+
+	s.securityEvent(c, store.EventUserDeleted, user, nil, "user deleted")
+	s.revokeSessions(c, user, "user deleted")
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
 }
 
-func (db *Users) GetUser(email string) (*User, error) {
-	db.RLock()
-	defer db.RUnlock()
-	id := db.emails[email]
-	if user, ok := db.users[id]; ok {
-		return user, nil
+// ListCredentials returns the credentials registered by the user in the URL.
+func (s *Server) ListCredentials(c *gin.Context) {
+	user, ok := s.lookupUser(c)
+	if !ok {
+		return
+	}
+
+	creds := user.Credentials()
+	out := &v1.CredentialList{Credentials: make([]*v1.Credential, 0, len(creds))}
+	for _, cred := range creds {
+		out.Credentials = append(out.Credentials, credentialReply(cred))
 	}
-	return nil, ErrUserNotFound
+	c.JSON(http.StatusOK, out)
 }
 
-func (db *Users) NewUser(name, email string) (*User, error) {
-	user := &User{
-		ID:          uuid.New(),
-		Name:        name,
-		Email:       email,
-		credentials: make([]webauthn.Credential, 0, 1),
-		db:          db,
+// UpdateCredential allows the user to modify the editable fields of a credential such
+// as its nickname so that they can identify which authenticator it belongs to.
+func (s *Server) UpdateCredential(c *gin.Context) {
+	user, cred, ok := s.lookupCredential(c)
+	if !ok {
+		return
 	}
 
-	db.Lock()
-	defer db.Unlock()
-	if _, ok := db.emails[email]; ok {
-		return nil, ErrUserAlreadyExists
+	in := &v1.CredentialUpdate{}
+	if err := c.BindJSON(in); err != nil {
+		log.Warn().Err(err).Msg("could not bind credential update")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not bind credential update"})
+		return
 	}
 
-	db.emails[email] = user.ID
-	db.users[user.ID] = user
-	return user, nil
+	cred.Nickname = in.Nickname
+	if err := s.users.UpdateCredential(user, cred); err != nil {
+		log.Error().Err(err).Msg("could not update credential")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update credential"})
+		return
+	}
+	c.JSON(http.StatusOK, credentialReply(cred))
 }
 
-func (db *Users) CredentialExists(creds *webauthn.Credential) bool {
-	ids := creds.Descriptor().CredentialID.String()
+// RevokeCredential disables a credential so that it can no longer be used to login
+// (e.g. if the authenticator was lost) while keeping it for auditing purposes.
+func (s *Server) RevokeCredential(c *gin.Context) {
+	user, cred, ok := s.lookupCredential(c)
+	if !ok {
+		return
+	}
 
-	db.RLock()
-	_, ok := db.creds[ids]
-	db.RUnlock()
-	return ok
-}
+	in := &v1.CredentialRevoke{}
+	if err := c.ShouldBindJSON(in); err != nil && !errors.Is(err, io.EOF) {
+		log.Warn().Err(err).Msg("could not bind credential revocation")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not bind credential revocation"})
+		return
+	}
 
-type User struct {
-	sync.RWMutex
-	ID          uuid.UUID
-	Name        string
-	Email       string
-	credentials []webauthn.Credential
-	db          *Users
-}
+	if in.Reason == "" {
+		in.Reason = "revoked by user"
+	}
 
-// WebAuthnID provides the user handle of the user account. A user handle is an opaque byte sequence with a maximum
-// size of 64 bytes, and is not meant to be displayed to the user.
-//
-// To ensure secure operation, authentication and authorization decisions MUST be made on the basis of this id
-// member, not the displayName nor name members. See Section 6.1 of [RFC8266].
-//
-// It's recommended this value is completely random and uses the entire 64 bytes.
-//
-// Specification: §5.4.3. User Account Parameters for Credential Generation (https://w3c.github.io/webauthn/#dom-publickeycredentialuserentity-id)
-func (u *User) WebAuthnID() []byte {
-	u.RLock()
-	defer u.RUnlock()
-	return u.ID[:]
-}
+	if err := s.users.RevokeCredential(user, cred.ID, in.Reason); err != nil {
+		log.Error().Err(err).Msg("could not revoke credential")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke credential"})
+		return
+	}
 
-// WebAuthnName provides the name attribute of the user account during registration and is a human-palatable name for the user
-// account, intended only for display. For example, "Alex Müller" or "田中倫". The Relying Party SHOULD let the user
-// choose this, and SHOULD NOT restrict the choice more than necessary.
-//
-// Specification: §5.4.3. User Account Parameters for Credential Generation (https://w3c.github.io/webauthn/#dictdef-publickeycredentialuserentity)
-func (u *User) WebAuthnName() string {
-	u.RLock()
-	defer u.RUnlock()
-	return u.Email
-}
+	s.securityEvent(c, store.EventCredentialRevoked, user, cred.ID, in.Reason)
+	s.revokeSessions(c, user, "credential revoked")
 
-// WebAuthnDisplayName provides the name attribute of the user account during registration and is a human-palatable
-// name for the user account, intended only for display. For example, "Alex Müller" or "田中倫". The Relying Party
-// SHOULD let the user choose this, and SHOULD NOT restrict the choice more than necessary.
-//
-// Specification: §5.4.3. User Account Parameters for Credential Generation (https://www.w3.org/TR/webauthn/#dom-publickeycredentialuserentity-displayname)
-func (u *User) WebAuthnDisplayName() string {
-	u.RLock()
-	defer u.RUnlock()
-	return u.Name
+	// Return the updated credential with its revocation timestamp
+	cred, _ = user.Credential(cred.ID)
+	c.JSON(http.StatusOK, credentialReply(cred))
 }
 
-// WebAuthnCredentials provides the list of Credential objects owned by the user.
-func (u *User) WebAuthnCredentials() []webauthn.Credential {
-	u.RLock()
-	defer u.RUnlock()
-	return u.credentials
+// DeleteCredential permanently removes a credential from the user.
+func (s *Server) DeleteCredential(c *gin.Context) {
+	user, cred, ok := s.lookupCredential(c)
+	if !ok {
+		return
+	}
+
+	if err := s.users.RemoveCredential(user, cred.ID); err != nil {
+		log.Error().Err(err).Msg("could not delete credential")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete credential"})
+		return
+	}
+
+	s.securityEvent(c, store.EventCredentialDeleted, user, cred.ID, "credential deleted by user")
+	s.revokeSessions(c, user, "credential deleted")
+	c.JSON(http.StatusOK, gin.H{"message": "credential deleted"})
 }
 
-func (u *User) CredentialExcludeList() []protocol.CredentialDescriptor {
-	u.RLock()
-	defer u.RUnlock()
-	exclude := make([]protocol.CredentialDescriptor, 0, len(u.credentials))
-	for _, cred := range u.credentials {
-		descriptor := protocol.CredentialDescriptor{
-			Type:         protocol.PublicKeyCredentialType,
-			CredentialID: cred.ID,
+// Lookup the user from the userID URL parameter, writing an error response and
+// returning false if the user cannot be found.
+func (s *Server) lookupUser(c *gin.Context) (user *store.User, ok bool) {
+	var err error
+	if user, err = s.users.Lookup(c.Param("userID")); err != nil {
+		if errors.Is(err, store.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return nil, false
 		}
-		exclude = append(exclude, descriptor)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse user id"})
+		return nil, false
 	}
-	return exclude
+	return user, true
 }
 
-func (u *User) AddCredential(cred webauthn.Credential) {
-	u.Lock()
-	defer u.Unlock()
-	u.credentials = append(u.credentials, cred)
+// Lookup the user and credential from the userID and credentialID URL parameters,
+// writing an error response and returning false if either cannot be found.
+func (s *Server) lookupCredential(c *gin.Context) (user *store.User, cred store.Credential, ok bool) {
+	if user, ok = s.lookupUser(c); !ok {
+		return nil, cred, false
+	}
+
+	credentialID, err := store.DecodeKeyID(c.Param("credentialID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not parse credential id"})
+		return nil, cred, false
+	}
 
-	ids := cred.Descriptor().CredentialID.String()
-	u.db.Lock()
-	defer u.db.Unlock()
-	u.db.creds[ids] = struct{}{}
+	if cred, err = user.Credential(credentialID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, cred, false
+	}
+	return user, cred, true
 }
 
-// WebAuthnIcon is a deprecated option.
-// Deprecated: this has been removed from the specification recommendation. Suggest a blank string.
-func (u *User) WebAuthnIcon() string { return "" }
+// userReply converts a stored user into its API representation.
+func userReply(user *store.User) *v1.User {
+	user.RLock()
+	out := &v1.User{
+		ID:    user.ID.String(),
+		Name:  user.Name,
+		Email: user.Email,
+	}
+	user.RUnlock()
+
+	creds := user.Credentials()
+	out.Credentials = make([]*v1.Credential, 0, len(creds))
+	for _, cred := range creds {
+		out.Credentials = append(out.Credentials, credentialReply(cred))
+	}
+	return out
+}
+
+// credentialReply converts a stored credential into its API representation.
+func credentialReply(cred store.Credential) *v1.Credential {
+	out := &v1.Credential{
+		ID:              cred.KeyID(),
+		Nickname:        cred.Nickname,
+		Authenticator:   cred.AuthenticatorName(),
+		AAGUID:          cred.AAGUID().String(),
+		AttestationType: cred.AttestationType,
+		Transports:      cred.TransportNames(),
+		Attachment:      string(cred.Authenticator.Attachment),
+		SignCount:       cred.Authenticator.SignCount,
+		CloneWarning:    cred.Authenticator.CloneWarning,
+		UserPresent:     cred.Flags.UserPresent,
+		UserVerified:    cred.Flags.UserVerified,
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		Created:         cred.Created.Format(time.RFC3339),
+		ClientIP:        cred.ClientIP,
+		UserAgent:       cred.UserAgent,
+		Reason:          cred.Reason,
+
+		AttestationFormat:   cred.Metadata.Format,
+		AttestationVerified: cred.Metadata.Verified,
+		MetadataStatus:      cred.Metadata.Status,
+		CredProtect:         config.CredProtectName(cred.Extensions.CredProtect),
+		PRF:                 cred.Extensions.PRF,
+		LargeBlob:           cred.Extensions.LargeBlob,
+	}
+
+	if !cred.LastUsed.IsZero() {
+		out.LastUsed = cred.LastUsed.Format(time.RFC3339)
+	}
+
+	if cred.IsRevoked() {
+		out.Revoked = cred.Revoked.Format(time.RFC3339)
+	}
+
+	if rk := cred.Extensions.ResidentKey; rk != nil {
+		out.CredProps = true
+		out.ResidentKey = *rk
+	}
+
+	if alg := cred.KeyAlgorithm(); alg != 0 {
+		out.Algorithm = config.AlgorithmName(alg)
+	}
+	return out
+}
@@ -0,0 +1,130 @@
+package yubikey
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+)
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		email  string
+		user   string
+	}{
+		{"change email", `{"email": "janet@example.com"}`, http.StatusOK, "janet@example.com", "Jane Doe"},
+		{"rename", `{"name": "Janet Doe"}`, http.StatusOK, "jane@example.com", "Janet Doe"},
+		{"change both", `{"email": "janet@example.com", "name": "Janet Doe"}`, http.StatusOK, "janet@example.com", "Janet Doe"},
+		{"same email", `{"email": "jane@example.com"}`, http.StatusOK, "jane@example.com", "Jane Doe"},
+		{"email registered", `{"email": "john@example.com"}`, http.StatusConflict, "jane@example.com", "Jane Doe"},
+		{"no changes", `{}`, http.StatusBadRequest, "jane@example.com", "Jane Doe"},
+		{"bad json", `{"email"`, http.StatusBadRequest, "jane@example.com", "Jane Doe"},
+	}
+
+	for _, tc := range tests {
+		s := newTestServer(t, config.Config{})
+		user, err := s.users.NewUser("Jane Doe", "jane@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.users.NewUser("John Doe", "john@example.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		c, w := newTestContext(http.MethodPut, "/v1/users/"+user.ID.String())
+		c.Request.Body = io.NopCloser(strings.NewReader(tc.body))
+		c.Params = gin.Params{{Key: "userID", Value: user.ID.String()}}
+		s.UpdateUser(c)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+			continue
+		}
+
+		if user, err = s.users.Lookup(user.ID.String()); err != nil {
+			t.Fatalf("%s: could not lookup user: %s", tc.name, err)
+		}
+		if user.WebAuthnName() != tc.email {
+			t.Errorf("%s: expected email %q, got %q", tc.name, tc.email, user.WebAuthnName())
+		}
+		if user.WebAuthnDisplayName() != tc.user {
+			t.Errorf("%s: expected name %q, got %q", tc.name, tc.user, user.WebAuthnDisplayName())
+		}
+
+		if _, err = s.users.GetUser(tc.email); err != nil {
+			t.Errorf("%s: could not lookup user by email %q: %s", tc.name, tc.email, err)
+		}
+
+		if tc.email != "jane@example.com" {
+			if _, err = s.users.GetUser("jane@example.com"); !errors.Is(err, store.ErrUserNotFound) {
+				t.Errorf("%s: expected previous email to be released, got %v", tc.name, err)
+			}
+		}
+
+		// Security events must not record email addresses since they are logged.
+		events, _ := s.users.ListEvents(user.ID)
+		for _, event := range events {
+			if strings.Contains(event.Detail, "@") {
+				t.Errorf("%s: %s event detail contains an email address: %q", tc.name, event.Type, event.Detail)
+			}
+		}
+
+		changed := tc.email != "jane@example.com"
+		if found := len(events) == 1 && events[0].Type == store.EventEmailChanged; found != changed {
+			t.Errorf("%s: expected email changed event %t, got %d events", tc.name, changed, len(events))
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	s := newTestServer(t, config.Config{})
+	user, _ := testLogin(t, s, "jane@example.com")
+
+	c, w := newTestContext(http.MethodDelete, "/v1/users/"+user.ID.String())
+	c.Params = gin.Params{{Key: "userID", Value: user.ID.String()}}
+	s.DeleteUser(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if _, err := s.users.Lookup(user.ID.String()); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("expected user to be deleted, got %v", err)
+	}
+	if _, _, err := s.users.LookupByCredentialID([]byte("jane@example.com")); !errors.Is(err, store.ErrCredentialNotFound) {
+		t.Errorf("expected credential to be deleted, got %v", err)
+	}
+
+	if logins, _ := s.sessions.Logins.List(user.ID); len(logins) != 0 {
+		t.Errorf("expected login sessions to be revoked, got %d", len(logins))
+	}
+
+	// Events are kept for auditing and must not record the email address.
+	events, _ := s.users.ListEvents(user.ID)
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+		if strings.Contains(event.Detail, "@") {
+			t.Errorf("%s event detail contains an email address: %q", event.Type, event.Detail)
+		}
+	}
+	if len(types) != 2 || types[0] != store.EventUserDeleted || types[1] != store.EventSessionsRevoked {
+		t.Errorf("expected user deleted and sessions revoked events, got %v", types)
+	}
+
+	// Deleting the user again returns not found.
+	c, w = newTestContext(http.MethodDelete, "/v1/users/"+user.ID.String())
+	c.Params = gin.Params{{Key: "userID", Value: user.ID.String()}}
+	s.DeleteUser(c)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
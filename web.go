@@ -3,36 +3,61 @@ package yubikey
 import (
 	"net/http"
 
+	v1 "github.com/bbengfort/yubikey/api/v1"
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 )
 
+// Index shows the account and credentials of the logged in user; anonymous users are
+// prompted to login or register.
 func (s *Server) Index(c *gin.Context) {
-	data := &UserList{}
-	data.Version = Version()
-
-	for _, user := range s.users.users {
-		data.Users = append(data.Users, struct {
-			ID          string
-			Name        string
-			Email       string
-			Credentials int
-		}{
-			ID:          user.ID.String(),
-			Name:        user.Name,
-			Email:       user.Email,
-			Credentials: len(user.WebAuthnCredentials()),
-		})
+	data := &UserList{WebData: s.webData(c)}
+	if user := CurrentUser(c); user != nil {
+		data.Users = append(data.Users, userReply(user))
 	}
-
 	c.HTML(http.StatusOK, "index.html", data)
 }
 
 func (s *Server) Register(c *gin.Context) {
-	c.HTML(http.StatusOK, "register.html", &WebData{Version: Version()})
+	c.HTML(http.StatusOK, "register.html", s.webData(c))
 }
 
 func (s *Server) Login(c *gin.Context) {
-	c.HTML(http.StatusOK, "login.html", &WebData{Version: Version()})
+	c.HTML(http.StatusOK, "login.html", s.webData(c))
+}
+
+func (s *Server) Diagnostics(c *gin.Context) {
+	data := &DiagnosticsData{WebData: s.webData(c)}
+
+	var err error
+	if data.Algorithms, err = s.algorithmReport(); err != nil {
+		log.Error().Err(err).Msg("could not create algorithm report")
+		c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	c.HTML(http.StatusOK, "diagnostics.html", data)
+}
+
+// Account lists the active login sessions of the logged in user so that they can be
+// revoked; anonymous users are redirected to the login page.
+func (s *Server) Account(c *gin.Context) {
+	user := CurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	data := &AccountData{WebData: s.webData(c)}
+
+	var err error
+	if data.Sessions, err = s.activeSessions(user, currentLogin(c)); err != nil {
+		log.Error().Err(err).Msg("could not list login sessions")
+		c.String(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	c.HTML(http.StatusOK, "account.html", data)
 }
 
 func (s *Server) NotFound(c *gin.Context) {
@@ -45,14 +70,28 @@ func (s *Server) NotAllowed(c *gin.Context) {
 
 type WebData struct {
 	Version string
+	Session *v1.Session // the session of the logged in user, nil if anonymous
+}
+
+// Returns the common data rendered by all web pages.
+func (s *Server) webData(c *gin.Context) WebData {
+	return WebData{
+		Version: Version(),
+		Session: sessionReply(CurrentUser(c), currentSession(c)),
+	}
 }
 
 type UserList struct {
 	WebData
-	Users []struct {
-		ID          string
-		Name        string
-		Email       string
-		Credentials int
-	}
+	Users []*v1.User
+}
+
+type DiagnosticsData struct {
+	WebData
+	Algorithms *v1.AlgorithmReport
+}
+
+type AccountData struct {
+	WebData
+	Sessions []*v1.ActiveSession
 }
@@ -15,7 +15,11 @@ import (
 
 	"github.com/bbengfort/yubikey/config"
 	"github.com/bbengfort/yubikey/logger"
+	"github.com/bbengfort/yubikey/mds"
+	"github.com/bbengfort/yubikey/policy"
 	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/bbengfort/yubikey/token"
 	"github.com/gin-gonic/gin"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/rs/zerolog"
@@ -53,7 +57,42 @@ func New(conf config.Config) (s *Server, err error) {
 		errc:    make(chan error, 1),
 		healthy: false,
 		ready:   false,
-		users:   NewUsers(),
+	}
+
+	// Open the users and credentials store
+	var keys [][]byte
+	if keys, err = s.conf.Database.Keys(); err != nil {
+		return nil, err
+	}
+
+	var users store.Store
+	if users, err = store.Open(s.conf.Database.URL, keys...); err != nil {
+		return nil, err
+	}
+	s.users = users
+
+	// Close the store if the server cannot be created so that its files are unlocked
+	defer func() {
+		if err != nil {
+			users.Close()
+		}
+	}()
+
+	// Load the fido metadata to verify attestation statements if configured
+	if s.conf.Metadata.Enabled() {
+		var root []byte
+		if root, err = mds.LoadRoot(s.conf.Metadata.RootCert); err != nil {
+			return nil, err
+		}
+
+		if s.mds, err = mds.Load(s.conf.Metadata.Path, root); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load the registration policy that restricts which authenticators can be registered
+	if s.policy, err = s.loadPolicy(); err != nil {
+		return nil, err
 	}
 
 	// Create the webauthn instance
@@ -62,19 +101,56 @@ func New(conf config.Config) (s *Server, err error) {
 	}
 
 	// Create the session store
-	if s.sessions, err = session.New(); err != nil {
+	var sessionKeys [][]byte
+	if sessionKeys, err = s.conf.Session.KeyPairs(); err != nil {
+		return nil, err
+	}
+
+	if len(sessionKeys) == 0 {
+		log.Warn().Msg("no session keys configured, sessions will not survive a restart or be shared between replicas")
+	}
+
+	if !s.conf.Session.Cookie.IsSecure() {
+		log.Warn().Msg("session cookies are not secure, set YUBIKEY_SESSION_COOKIE_SECURE=true if tls is terminated by a proxy")
+	}
+
+	switch s.conf.Session.Store {
+	case config.SessionStoreServer:
+		s.sessions, err = session.NewServerSide(s.users, s.conf.Session.TTL, s.conf.Session.Cookie.Options(), sessionKeys...)
+	default:
+		s.sessions, err = session.New(s.users, s.conf.Session.Cookie.Options(), sessionKeys...)
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
+	// Create the token issuer if access and refresh tokens are issued on login
+	if s.conf.Token.Enabled {
+		if len(s.conf.Token.Keys) == 0 {
+			log.Warn().Msg("no token signing keys configured, tokens cannot be verified after a restart or between replicas")
+		}
+
+		if s.tokens, err = token.New(s.conf.Token, s.users); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create the Gin router and setup its routes
 	gin.SetMode(conf.Mode)
 	s.router = gin.New()
 	s.router.RedirectTrailingSlash = true
 	s.router.RedirectFixedPath = false
 	s.router.HandleMethodNotAllowed = true
-	s.router.ForwardedByClientIP = true
 	s.router.UseRawPath = false
 	s.router.UnescapePathValues = true
+
+	// Only use the client IP forwarded by trusted proxies, since it is recorded on login
+	// sessions and security events.
+	s.router.ForwardedByClientIP = len(conf.TrustedProxies) > 0
+	if err = s.router.SetTrustedProxies(conf.TrustedProxies); err != nil {
+		return nil, err
+	}
 	if err = s.setupRoutes(); err != nil {
 		return nil, err
 	}
@@ -97,8 +173,11 @@ type Server struct {
 	conf     config.Config      // configuration of the API server
 	authn    *webauthn.WebAuthn // the passwordless authentication module
 	srv      *http.Server       // handle to a custom http server with specified API defaults
-	users    *Users             // the users "database" for testing registration
+	users    store.Store        // the users database for registration and login
+	mds      *mds.Metadata      // fido metadata used to verify attestation, nil if not configured
+	policy   *policy.Policy     // the registration policy, guarded by the mutex since it can be reloaded
 	sessions *session.Store     // the sessions "database" for testing registration and login
+	tokens   *token.Issuer      // issues access and refresh tokens on login, nil if not enabled
 	router   *gin.Engine        // the http handler and associated middlware
 	healthy  bool               // application state of the server for health checks
 	ready    bool               // application state of the server for ready checks
@@ -116,6 +195,17 @@ func (s *Server) Serve() (err error) {
 		s.errc <- s.Shutdown()
 	}()
 
+	// Reload the registration policy on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := s.ReloadPolicy(); err != nil {
+				log.Error().Err(err).Msg("could not reload registration policy, the previous policy is still in effect")
+			}
+		}
+	}()
+
 	// Create a socket to listen on and infer the final URL.
 	// NOTE: if the bindaddr is 127.0.0.1:0 for testing, a random port will be assigned,
 	// manually creating the listener will allow us to determine which port.
@@ -126,6 +216,9 @@ func (s *Server) Serve() (err error) {
 		return fmt.Errorf("could not listen on bind addr %s: %s", s.srv.Addr, err)
 	}
 
+	// Remove expired challenges of abandoned ceremonies and expired sessions
+	s.sessions.Start(session.DefaultSweepInterval)
+
 	s.SetStatus(true, true)
 	s.started = time.Now()
 	s.setURL(sock.Addr())
@@ -171,6 +264,11 @@ func (s *Server) Shutdown() error {
 		errs = append(errs, err)
 	}
 
+	s.sessions.Stop()
+	if err := s.users.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
 	switch len(errs) {
 	case 0:
 		return nil
@@ -0,0 +1,84 @@
+package yubikey
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bbengfort/yubikey/config"
+	"github.com/bbengfort/yubikey/session"
+	"github.com/bbengfort/yubikey/store"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+}
+
+// Creates a server with an in-memory store and cookie sessions that is not started, so
+// that handlers and helpers can be tested directly.
+func newTestServer(t *testing.T, conf config.Config) *Server {
+	db := store.NewMemory()
+	sessions, err := session.New(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		conf:     conf,
+		users:    db,
+		sessions: sessions,
+	}
+}
+
+// Creates a server with the default configuration, including its webauthn relying
+// party and routes, that is ready to handle requests.
+func newDefaultServer(t *testing.T) *Server {
+	conf, err := config.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.users.Close() })
+	s.SetStatus(true, true)
+	return s
+}
+
+// Creates a gin context for a request to the path, returning the recorder that captures
+// the response written by the handler.
+func newTestContext(method, path string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, path, nil)
+	return c, w
+}
+
+func TestNewClosesStore(t *testing.T) {
+	// If the server cannot be created the store must be closed so that its files are
+	// unlocked and the server can be created again in the same process.
+	t.Setenv("YUBIKEY_DATABASE_URL", "wal://"+t.TempDir())
+
+	conf, err := config.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpid := conf.WebAuthn.RPID
+	conf.WebAuthn.RPID = ""
+	if _, err = New(conf); err == nil {
+		t.Fatal("expected an error for a missing relying party id")
+	}
+
+	conf.WebAuthn.RPID = rpid
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("could not create the server after a failed attempt: %s", err)
+	}
+	s.users.Close()
+}